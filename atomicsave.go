@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackupMode selects the copy of a file kept when a save overwrites it.
+// BackupMode задаёт резервную копию, создаваемую при перезаписи файла.
+type BackupMode int
+
+const (
+	// BackupNone keeps no copy.
+	BackupNone BackupMode = iota
+	// BackupTilde keeps the previous version as "file~".
+	BackupTilde
+	// BackupTimestamp keeps every version as "file.YYYYMMDD-HHMMSS~".
+	BackupTimestamp
+)
+
+// parseBackupMode parses the value of the -backup flag.
+func parseBackupMode(s string) (BackupMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none", "off":
+		return BackupNone, nil
+	case "tilde", "~":
+		return BackupTilde, nil
+	case "time", "timestamp":
+		return BackupTimestamp, nil
+	}
+	return BackupNone, fmt.Errorf("unknown backup mode %q (use none, tilde or time)", s)
+}
+
+// backupPath returns the backup file of path for mode, or "" for none.
+func backupPath(path string, mode BackupMode, now time.Time) string {
+	switch mode {
+	case BackupTilde:
+		return path + "~"
+	case BackupTimestamp:
+		return path + "." + now.Format("20060102-150405") + "~"
+	}
+	return ""
+}
+
+// copyFile copies the content and permissions of src to a new file dst.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// writeFileAtomic replaces the file at path with data. The data goes to a
+// temporary file in the same directory, is synced and then renamed over the
+// original, so a failed or interrupted save leaves the original untouched.
+// The permissions of an existing file are kept and a symlink keeps pointing
+// to the file it named. With a backup mode the previous version is kept too.
+// writeFileAtomic атомарно перезаписывает файл, сохраняя права доступа.
+func writeFileAtomic(path string, data []byte, backup BackupMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	mode := os.FileMode(0644)
+	info, err := os.Stat(path)
+	exists := err == nil
+	if exists {
+		mode = info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fail(err)
+	}
+
+	if bak := backupPath(path, backup, time.Now()); exists && bak != "" {
+		// A hard link keeps the original in place until the rename below.
+		os.Remove(bak)
+		if os.Link(path, bak) != nil {
+			if err := copyFile(path, bak, mode); err != nil {
+				os.Remove(tmpName)
+				return fmt.Errorf("backup failed: %w", err)
+			}
+		}
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -5,8 +5,8 @@ import (
 )
 
 
-// BracketPair представляет пару совпадающих скобок и их позиций.
 // BracketPair represents a pair of matching brackets and their positions
+// BracketPair представляет пару совпадающих скобок и их позиций.
 type BracketPair struct {
 	OpenLine  int
 	OpenCol   int
@@ -14,8 +14,8 @@ type BracketPair struct {
 	CloseCol  int
 }
 
-// BracketMatcher отвечает за поиск соответствующих скобок.
 // BracketMatcher is responsible for finding matching brackets
+// BracketMatcher отвечает за поиск соответствующих скобок.
 type BracketMatcher struct {
 	editor *Editor
 }
@@ -29,11 +29,11 @@ func NewBracketMatcher(editor *Editor) *BracketMatcher {
 
 // findMatchingBracket finds the matching bracket for the character at the given position
 func (bm *BracketMatcher) findMatchingBracket(lineIdx, colIdx int) *BracketPair {
-	if lineIdx < 0 || lineIdx >= len(bm.editor.lines) {
+	if lineIdx < 0 || lineIdx >= bm.editor.buf.LineCount() {
 		return nil
 	}
 
-	line := bm.editor.lines[lineIdx]
+	line := bm.editor.buf.Line(lineIdx)
 	if colIdx < 0 || colIdx >= len([]rune(line)) {
 		return nil
 	}
@@ -66,11 +66,11 @@ func (bm *BracketMatcher) findMatchingBracket(lineIdx, colIdx int) *BracketPair
 
 // findClosingBracket searches forward for a matching closing bracket
 func (bm *BracketMatcher) findClosingBracket(startLine, startCol int, opening, closing rune) *BracketPair {
-	if startLine < 0 || startLine >= len(bm.editor.lines) {
+	if startLine < 0 || startLine >= bm.editor.buf.LineCount() {
 		return nil
 	}
 	
-	line := bm.editor.lines[startLine]
+	line := bm.editor.buf.Line(startLine)
 	runes := []rune(line)
 	
 	if startCol < 0 || startCol >= len(runes) {
@@ -82,12 +82,12 @@ func (bm *BracketMatcher) findClosingBracket(startLine, startCol int, opening, c
 	lineIdx := startLine
 	colIdx := startCol + 1
 	
-	for lineIdx < len(bm.editor.lines) {
-		if lineIdx < 0 || lineIdx >= len(bm.editor.lines) {
+	for lineIdx < bm.editor.buf.LineCount() {
+		if lineIdx < 0 || lineIdx >= bm.editor.buf.LineCount() {
 			return nil
 		}
 		
-		line := bm.editor.lines[lineIdx]
+		line := bm.editor.buf.Line(lineIdx)
 		runes := []rune(line)
 		
 		for colIdx < len(runes) {
@@ -123,11 +123,11 @@ func (bm *BracketMatcher) findClosingBracket(startLine, startCol int, opening, c
 
 // findOpeningBracket searches backward for a matching opening bracket
 func (bm *BracketMatcher) findOpeningBracket(startLine, startCol int, opening, closing rune) *BracketPair {
-	if startLine < 0 || startLine >= len(bm.editor.lines) {
+	if startLine < 0 || startLine >= bm.editor.buf.LineCount() {
 		return nil
 	}
 	
-	line := bm.editor.lines[startLine]
+	line := bm.editor.buf.Line(startLine)
 	runes := []rune(line)
 	
 	if startCol < 0 || startCol >= len(runes) {
@@ -140,17 +140,17 @@ func (bm *BracketMatcher) findOpeningBracket(startLine, startCol int, opening, c
 	colIdx := startCol - 1
 	
 	for lineIdx >= 0 {
-		if lineIdx < 0 || lineIdx >= len(bm.editor.lines) {
+		if lineIdx < 0 || lineIdx >= bm.editor.buf.LineCount() {
 			return nil
 		}
 		
-		line := bm.editor.lines[lineIdx]
+		line := bm.editor.buf.Line(lineIdx)
 		runes := []rune(line)
 		
 		if colIdx < 0 {
 			lineIdx--
-			if lineIdx >= 0 && lineIdx < len(bm.editor.lines) {
-				colIdx = len([]rune(bm.editor.lines[lineIdx])) - 1
+			if lineIdx >= 0 && lineIdx < bm.editor.buf.LineCount() {
+				colIdx = bm.editor.buf.LineLen(lineIdx) - 1
 			}
 			continue
 		}
@@ -180,8 +180,8 @@ func (bm *BracketMatcher) findOpeningBracket(startLine, startCol int, opening, c
 			
 			if colIdx < 0 && lineIdx > 0 {
 				lineIdx--
-				if lineIdx >= 0 && lineIdx < len(bm.editor.lines) {
-					colIdx = len([]rune(bm.editor.lines[lineIdx])) - 1
+				if lineIdx >= 0 && lineIdx < bm.editor.buf.LineCount() {
+					colIdx = bm.editor.buf.LineLen(lineIdx) - 1
 				} else {
 					break
 				}
@@ -189,8 +189,8 @@ func (bm *BracketMatcher) findOpeningBracket(startLine, startCol int, opening, c
 		}
 		
 		lineIdx--
-		if lineIdx >= 0 && lineIdx < len(bm.editor.lines) {
-			colIdx = len([]rune(bm.editor.lines[lineIdx])) - 1
+		if lineIdx >= 0 && lineIdx < bm.editor.buf.LineCount() {
+			colIdx = bm.editor.buf.LineLen(lineIdx) - 1
 		}
 	}
 	
@@ -199,11 +199,11 @@ func (bm *BracketMatcher) findOpeningBracket(startLine, startCol int, opening, c
 
 // getBracketAtCursor returns the bracket pair at the current cursor position
 func (bm *BracketMatcher) getBracketAtCursor() *BracketPair {
-	if bm.editor.cy < 0 || bm.editor.cy >= len(bm.editor.lines) {
+	if bm.editor.cy < 0 || bm.editor.cy >= bm.editor.buf.LineCount() {
 		return nil
 	}
 	
-	line := bm.editor.lines[bm.editor.cy]
+	line := bm.editor.buf.Line(bm.editor.cy)
 	runes := []rune(line)
 	
 	if bm.editor.cx >= 0 && bm.editor.cx < len(runes) {
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"unicode/utf8"
+)
+
+// TextBuffer is the text storage behind a canvas: an ordered sequence of lines
+// addressed by (line, column) in runes.
+// TextBuffer — хранилище текста канваса: упорядоченная последовательность строк,
+// адресуемая парой (строка, колонка) в рунах.
+//
+// A buffer always holds at least one (possibly empty) line.
+// Буфер всегда содержит хотя бы одну (возможно пустую) строку.
+type TextBuffer interface {
+	// LineCount returns the number of lines.
+	LineCount() int
+	// Line returns the text of line i without the line terminator.
+	Line(i int) string
+	// LineLen returns the length of line i in runes.
+	LineLen(i int) int
+	// SetLine replaces the text of line i.
+	SetLine(i int, s string)
+	// InsertLines inserts whole lines before line at (at == LineCount appends).
+	InsertLines(at int, lines []string)
+	// DeleteLines removes lines in the half-open range [from, to).
+	DeleteLines(from, to int)
+	// Insert inserts text (which may contain '\n') at (line, col) and returns
+	// the position right after the inserted text.
+	Insert(line, col int, text string) (int, int)
+	// Delete removes the text between (startLine, startCol) and (endLine, endCol)
+	// and returns it.
+	Delete(startLine, startCol, endLine, endCol int) string
+	// Slice returns the text between two positions without modifying the buffer.
+	Slice(startLine, startCol, endLine, endCol int) string
+	// Offset converts (line, col) into an absolute rune offset, counting one
+	// rune for every line break.
+	Offset(line, col int) int
+	// Position converts an absolute rune offset back into (line, col).
+	Position(offset int) (int, int)
+	// Len returns the total length in runes, line breaks included.
+	Len() int
+	// Lines returns a copy of all lines.
+	Lines() []string
+	// String returns the whole text joined with '\n'.
+	String() string
+}
+
+// ropeNode is a node of an implicit treap; each node holds one line.
+// ropeNode — узел неявного декартова дерева; каждый узел хранит одну строку.
+type ropeNode struct {
+	left, right *ropeNode
+	prio        uint32
+	line        string
+	runes       int // runes in line
+	count       int // lines in subtree
+	weight      int // sum of (runes+1) over subtree
+}
+
+// LineRope stores lines in a balanced tree so that line access, line
+// insertion/removal and offset conversion cost O(log n) instead of O(n).
+// LineRope хранит строки в сбалансированном дереве: доступ к строке,
+// вставка/удаление строк и пересчёт смещений выполняются за O(log n).
+type LineRope struct {
+	root *ropeNode
+	rnd  *rand.Rand
+}
+
+// NewTextBuffer creates a buffer holding text split on '\n'.
+// NewTextBuffer создает буфер с текстом, разбитым по '\n'.
+func NewTextBuffer(text string) TextBuffer {
+	return NewTextBufferFromLines(strings.Split(text, "\n"))
+}
+
+// NewTextBufferFromLines creates a buffer holding the given lines.
+// NewTextBufferFromLines создает буфер из готовых строк.
+func NewTextBufferFromLines(lines []string) TextBuffer {
+	r := &LineRope{rnd: rand.New(rand.NewSource(int64(len(lines)) + 1))}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	r.root = r.build(lines)
+	return r
+}
+
+func (n *ropeNode) update() {
+	n.count = 1
+	n.weight = n.runes + 1
+	if n.left != nil {
+		n.count += n.left.count
+		n.weight += n.left.weight
+	}
+	if n.right != nil {
+		n.count += n.right.count
+		n.weight += n.right.weight
+	}
+}
+
+func nodeCount(n *ropeNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.count
+}
+
+func nodeWeight(n *ropeNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.weight
+}
+
+func (r *LineRope) newNode(line string) *ropeNode {
+	n := &ropeNode{prio: r.rnd.Uint32(), line: line, runes: utf8.RuneCountInString(line)}
+	n.update()
+	return n
+}
+
+// build creates a treap from lines in O(n) using the Cartesian tree stack algorithm.
+// build строит дерево из строк за O(n) алгоритмом декартова дерева на стеке.
+func (r *LineRope) build(lines []string) *ropeNode {
+	var stack []*ropeNode
+	for _, l := range lines {
+		n := r.newNode(l)
+		var last *ropeNode
+		for len(stack) > 0 && stack[len(stack)-1].prio < n.prio {
+			last = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			last.update()
+		}
+		n.left = last
+		if len(stack) > 0 {
+			stack[len(stack)-1].right = n
+		}
+		stack = append(stack, n)
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		stack[i].update()
+	}
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[0]
+}
+
+// split divides n into the first k lines and the rest.
+func split(n *ropeNode, k int) (*ropeNode, *ropeNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if nodeCount(n.left) >= k {
+		l, rr := split(n.left, k)
+		n.left = rr
+		n.update()
+		return l, n
+	}
+	l, rr := split(n.right, k-nodeCount(n.left)-1)
+	n.right = l
+	n.update()
+	return n, rr
+}
+
+// merge joins two treaps where every line of a precedes every line of b.
+func merge(a, b *ropeNode) *ropeNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = merge(a, b.left)
+	b.update()
+	return b
+}
+
+func (r *LineRope) clampLine(i int) int {
+	if i < 0 {
+		return 0
+	}
+	if c := nodeCount(r.root); i >= c {
+		return c - 1
+	}
+	return i
+}
+
+// node returns the node for line i, or nil if out of range.
+func (r *LineRope) node(i int) *ropeNode {
+	n := r.root
+	for n != nil {
+		lc := nodeCount(n.left)
+		switch {
+		case i < lc:
+			n = n.left
+		case i == lc:
+			return n
+		default:
+			i -= lc + 1
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// LineCount returns the number of lines.
+func (r *LineRope) LineCount() int {
+	return nodeCount(r.root)
+}
+
+// Line returns the text of line i, or "" if i is out of range.
+func (r *LineRope) Line(i int) string {
+	if n := r.node(i); n != nil {
+		return n.line
+	}
+	return ""
+}
+
+// LineLen returns the length of line i in runes.
+func (r *LineRope) LineLen(i int) int {
+	if n := r.node(i); n != nil {
+		return n.runes
+	}
+	return 0
+}
+
+// SetLine replaces the text of line i; out of range indexes are ignored.
+func (r *LineRope) SetLine(i int, s string) {
+	if i < 0 || i >= nodeCount(r.root) {
+		return
+	}
+	var path []*ropeNode
+	n := r.root
+	for n != nil {
+		path = append(path, n)
+		lc := nodeCount(n.left)
+		if i < lc {
+			n = n.left
+		} else if i == lc {
+			break
+		} else {
+			i -= lc + 1
+			n = n.right
+		}
+	}
+	n.line = s
+	n.runes = utf8.RuneCountInString(s)
+	for j := len(path) - 1; j >= 0; j-- {
+		path[j].update()
+	}
+}
+
+// InsertLines inserts lines before line at.
+func (r *LineRope) InsertLines(at int, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	if at < 0 {
+		at = 0
+	}
+	if c := nodeCount(r.root); at > c {
+		at = c
+	}
+	left, right := split(r.root, at)
+	r.root = merge(merge(left, r.build(lines)), right)
+}
+
+// DeleteLines removes lines [from, to). Removing every line leaves one empty line.
+func (r *LineRope) DeleteLines(from, to int) {
+	c := nodeCount(r.root)
+	if from < 0 {
+		from = 0
+	}
+	if to > c {
+		to = c
+	}
+	if from >= to {
+		return
+	}
+	left, rest := split(r.root, from)
+	_, right := split(rest, to-from)
+	r.root = merge(left, right)
+	if r.root == nil {
+		r.root = r.newNode("")
+	}
+}
+
+// clampPos limits (line, col) to a valid position in the buffer.
+func (r *LineRope) clampPos(line, col int) (int, int) {
+	line = r.clampLine(line)
+	if col < 0 {
+		col = 0
+	}
+	if n := r.LineLen(line); col > n {
+		col = n
+	}
+	return line, col
+}
+
+// Insert inserts text at (line, col) and returns the position after it.
+func (r *LineRope) Insert(line, col int, text string) (int, int) {
+	line, col = r.clampPos(line, col)
+	cur := []rune(r.Line(line))
+	left, right := string(cur[:col]), string(cur[col:])
+	parts := strings.Split(text, "\n")
+	if len(parts) == 1 {
+		r.SetLine(line, left+text+right)
+		return line, col + utf8.RuneCountInString(text)
+	}
+	last := len(parts) - 1
+	endCol := utf8.RuneCountInString(parts[last])
+	r.SetLine(line, left+parts[0])
+	rest := make([]string, last)
+	copy(rest, parts[1:])
+	rest[last-1] += right
+	r.InsertLines(line+1, rest)
+	return line + last, endCol
+}
+
+// orderRange normalises a range so that the start precedes the end.
+func (r *LineRope) orderRange(sl, sc, el, ec int) (int, int, int, int) {
+	sl, sc = r.clampPos(sl, sc)
+	el, ec = r.clampPos(el, ec)
+	if sl > el || (sl == el && sc > ec) {
+		sl, sc, el, ec = el, ec, sl, sc
+	}
+	return sl, sc, el, ec
+}
+
+// Slice returns the text between two positions.
+func (r *LineRope) Slice(startLine, startCol, endLine, endCol int) string {
+	sl, sc, el, ec := r.orderRange(startLine, startCol, endLine, endCol)
+	if sl == el {
+		return string([]rune(r.Line(sl))[sc:ec])
+	}
+	var sb strings.Builder
+	sb.WriteString(string([]rune(r.Line(sl))[sc:]))
+	for i := sl + 1; i < el; i++ {
+		sb.WriteByte('\n')
+		sb.WriteString(r.Line(i))
+	}
+	sb.WriteByte('\n')
+	sb.WriteString(string([]rune(r.Line(el))[:ec]))
+	return sb.String()
+}
+
+// Delete removes the text between two positions and returns it.
+func (r *LineRope) Delete(startLine, startCol, endLine, endCol int) string {
+	sl, sc, el, ec := r.orderRange(startLine, startCol, endLine, endCol)
+	removed := r.Slice(sl, sc, el, ec)
+	first := []rune(r.Line(sl))
+	last := []rune(r.Line(el))
+	r.SetLine(sl, string(first[:sc])+string(last[ec:]))
+	if el > sl {
+		r.DeleteLines(sl+1, el+1)
+	}
+	return removed
+}
+
+// Offset converts (line, col) into an absolute rune offset.
+func (r *LineRope) Offset(line, col int) int {
+	line, col = r.clampPos(line, col)
+	off := 0
+	n := r.root
+	i := line
+	for n != nil {
+		lc := nodeCount(n.left)
+		if i < lc {
+			n = n.left
+			continue
+		}
+		off += nodeWeight(n.left)
+		if i == lc {
+			break
+		}
+		off += n.runes + 1
+		i -= lc + 1
+		n = n.right
+	}
+	return off + col
+}
+
+// Position converts an absolute rune offset into (line, col).
+func (r *LineRope) Position(offset int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	line := 0
+	n := r.root
+	for n != nil {
+		lw := nodeWeight(n.left)
+		if offset < lw {
+			n = n.left
+			continue
+		}
+		offset -= lw
+		line += nodeCount(n.left)
+		if offset <= n.runes || n.right == nil {
+			if offset > n.runes {
+				offset = n.runes
+			}
+			return line, offset
+		}
+		offset -= n.runes + 1
+		line++
+		n = n.right
+	}
+	return r.clampPos(line, offset)
+}
+
+// Len returns the total length in runes including line breaks.
+func (r *LineRope) Len() int {
+	return nodeWeight(r.root) - 1
+}
+
+// each calls fn for every line in order.
+func (r *LineRope) each(fn func(line string)) {
+	var stack []*ropeNode
+	n := r.root
+	for n != nil || len(stack) > 0 {
+		for n != nil {
+			stack = append(stack, n)
+			n = n.left
+		}
+		n = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		fn(n.line)
+		n = n.right
+	}
+}
+
+// Lines returns a copy of all lines.
+func (r *LineRope) Lines() []string {
+	lines := make([]string, 0, nodeCount(r.root))
+	r.each(func(line string) {
+		lines = append(lines, line)
+	})
+	return lines
+}
+
+// String returns the whole text joined with '\n'.
+func (r *LineRope) String() string {
+	var sb strings.Builder
+	sb.Grow(nodeWeight(r.root))
+	first := true
+	r.each(func(line string) {
+		if !first {
+			sb.WriteByte('\n')
+		}
+		first = false
+		sb.WriteString(line)
+	})
+	return sb.String()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestInsert checks Insert, the position it returns and the resulting text.
+// TestInsert проверяет Insert и возвращаемую позицию.
+func TestInsert(t *testing.T) {
+	tests := []struct {
+		text      string
+		line, col int
+		insert    string
+		want      string
+		wantLine  int
+		wantCol   int
+	}{
+		{"abc", 0, 1, "x", "axbc", 0, 2},
+		{"abc", 0, 3, "\n", "abc\n", 1, 0},
+		{"abc", 0, 0, "", "abc", 0, 0},
+		{"abc\ndef", 1, 1, "1\n2\n3", "abc\nd1\n2\n3ef", 3, 1},
+		{"", 0, 0, "\n\n", "\n\n", 2, 0},
+		{"привет", 0, 3, "ж\nё", "приж\nёвет", 1, 1},
+		{"a\n\nb", 1, 0, "日本", "a\n日本\nb", 1, 2},
+		{"abc", 5, 9, "x", "abcx", 0, 4},
+		{"abc", -1, -1, "x", "xabc", 0, 1},
+	}
+	for _, tt := range tests {
+		buf := NewTextBuffer(tt.text)
+		line, col := buf.Insert(tt.line, tt.col, tt.insert)
+		if got := buf.String(); got != tt.want || line != tt.wantLine || col != tt.wantCol {
+			t.Errorf("Insert(%q, %d, %d, %q) = %q at %d:%d, want %q at %d:%d",
+				tt.text, tt.line, tt.col, tt.insert, got, line, col, tt.want, tt.wantLine, tt.wantCol)
+		}
+	}
+}
+
+// TestDelete checks Delete on ranges inside a line, across lines and given
+// end first.
+// TestDelete проверяет Delete внутри строки и через несколько строк.
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		text              string
+		sl, sc, el, ec    int
+		want, wantRemoved string
+		wantLines         int
+	}{
+		{"abcdef", 0, 1, 0, 3, "adef", "bc", 1},
+		{"abc\ndef", 0, 3, 1, 0, "abcdef", "\n", 1},
+		{"abc\ndef\nghi", 0, 1, 2, 2, "ai", "bc\ndef\ngh", 1},
+		{"abc\ndef\nghi", 2, 2, 0, 1, "ai", "bc\ndef\ngh", 1},
+		{"a\n\n\nb", 0, 1, 3, 0, "ab", "\n\n\n", 1},
+		{"a\n\n\nb", 1, 0, 2, 0, "a\n\nb", "\n", 3},
+		{"жёлтый\nсиний", 0, 2, 1, 3, "жёий", "лтый\nсин", 1},
+		{"abc\ndef", 0, 0, 1, 3, "", "abc\ndef", 1},
+		{"abc", 0, 1, 0, 1, "abc", "", 1},
+	}
+	for _, tt := range tests {
+		buf := NewTextBuffer(tt.text)
+		removed := buf.Delete(tt.sl, tt.sc, tt.el, tt.ec)
+		if got := buf.String(); got != tt.want || removed != tt.wantRemoved || buf.LineCount() != tt.wantLines {
+			t.Errorf("Delete(%q, %d:%d-%d:%d) = %q removing %q (%d lines), want %q removing %q (%d lines)",
+				tt.text, tt.sl, tt.sc, tt.el, tt.ec, got, removed, buf.LineCount(), tt.want, tt.wantRemoved, tt.wantLines)
+		}
+	}
+}
+
+// TestDeleteLines checks DeleteLines, including removing every line.
+// TestDeleteLines проверяет DeleteLines, в том числе удаление всех строк.
+func TestDeleteLines(t *testing.T) {
+	tests := []struct {
+		text     string
+		from, to int
+		want     string
+	}{
+		{"a\nb\nc", 1, 2, "a\nc"},
+		{"a\nb\nc", 0, 2, "c"},
+		{"a\nb\nc", 0, 3, ""},
+		{"a\nb\nc", -5, 9, ""},
+		{"a\n\nc", 1, 2, "a\nc"},
+		{"a\nb\nc", 2, 2, "a\nb\nc"},
+		{"a\nb\nc", 2, 1, "a\nb\nc"},
+	}
+	for _, tt := range tests {
+		buf := NewTextBuffer(tt.text)
+		buf.DeleteLines(tt.from, tt.to)
+		if got := buf.String(); got != tt.want || buf.LineCount() < 1 {
+			t.Errorf("DeleteLines(%q, %d, %d) = %q (%d lines), want %q",
+				tt.text, tt.from, tt.to, got, buf.LineCount(), tt.want)
+		}
+	}
+}
+
+// TestOffsetPosition checks that Offset and Position convert every position
+// of a buffer with multi-byte runes and empty lines back and forth, and that
+// Position clamps offsets outside the buffer.
+// TestOffsetPosition проверяет перевод позиций в смещения и обратно.
+func TestOffsetPosition(t *testing.T) {
+	text := "ab\n\nжёлт\n\n日本語\n"
+	buf := NewTextBuffer(text)
+	off := 0
+	for line := 0; line < buf.LineCount(); line++ {
+		for col := 0; col <= buf.LineLen(line); col++ {
+			if got := buf.Offset(line, col); got != off {
+				t.Errorf("Offset(%d, %d) = %d, want %d", line, col, got, off)
+			}
+			if l, c := buf.Position(off); l != line || c != col {
+				t.Errorf("Position(%d) = %d:%d, want %d:%d", off, l, c, line, col)
+			}
+			off++
+		}
+	}
+	if off-1 != buf.Len() || buf.Len() != len([]rune(text)) {
+		t.Errorf("Len() = %d, want %d", buf.Len(), len([]rune(text)))
+	}
+	if l, c := buf.Position(-3); l != 0 || c != 0 {
+		t.Errorf("Position(-3) = %d:%d, want 0:0", l, c)
+	}
+	last := buf.LineCount() - 1
+	if l, c := buf.Position(buf.Len() + 10); l != last || c != buf.LineLen(last) {
+		t.Errorf("Position past the end = %d:%d, want %d:%d", l, c, last, buf.LineLen(last))
+	}
+}
+
+// TestRandomEdits applies random edits to a buffer and to a plain string
+// and compares them after every step.
+// TestRandomEdits сравнивает буфер со строкой после случайных правок.
+func TestRandomEdits(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	pieces := []string{"x", "ж", "日本", "\n", "\n\n", "ab\ncd", "ё\n", ""}
+	ref := []rune("abc\nжёлт\n\nghij")
+	buf := NewTextBuffer(string(ref))
+	for step := 0; step < 3000; step++ {
+		lines := strings.Split(string(ref), "\n")
+		switch rnd.Intn(5) {
+		case 0, 1:
+			line := rnd.Intn(len(lines))
+			col := rnd.Intn(len([]rune(lines[line])) + 1)
+			text := pieces[rnd.Intn(len(pieces))]
+			off := buf.Offset(line, col)
+			ref = []rune(string(ref[:off]) + text + string(ref[off:]))
+			endLine, endCol := buf.Insert(line, col, text)
+			if got := buf.Offset(endLine, endCol); got != off+len([]rune(text)) {
+				t.Fatalf("step %d: Insert ends at offset %d, want %d", step, got, off+len([]rune(text)))
+			}
+		case 2, 3:
+			a := rnd.Intn(len(ref) + 1)
+			z := a + rnd.Intn(min(len(ref)-a, 12)+1)
+			sl, sc := buf.Position(a)
+			el, ec := buf.Position(z)
+			if got := buf.Slice(sl, sc, el, ec); got != string(ref[a:z]) {
+				t.Fatalf("step %d: Slice = %q, want %q", step, got, string(ref[a:z]))
+			}
+			if got := buf.Delete(sl, sc, el, ec); got != string(ref[a:z]) {
+				t.Fatalf("step %d: Delete removed %q, want %q", step, got, string(ref[a:z]))
+			}
+			ref = append(ref[:a:a], ref[z:]...)
+		case 4:
+			from := rnd.Intn(len(lines))
+			to := from + rnd.Intn(min(len(lines)-from, 3)+1)
+			lines = append(lines[:from], lines[to:]...)
+			if len(lines) == 0 {
+				lines = []string{""}
+			}
+			buf.DeleteLines(from, to)
+			ref = []rune(strings.Join(lines, "\n"))
+		}
+		if got := buf.String(); got != string(ref) {
+			t.Fatalf("step %d: buffer %q, want %q", step, got, string(ref))
+		}
+		lines = strings.Split(string(ref), "\n")
+		if buf.LineCount() != len(lines) || buf.Len() != len(ref) {
+			t.Fatalf("step %d: %d lines of %d runes, want %d of %d", step, buf.LineCount(), buf.Len(), len(lines), len(ref))
+		}
+		line := rnd.Intn(len(lines))
+		if buf.Line(line) != lines[line] || buf.LineLen(line) != len([]rune(lines[line])) {
+			t.Fatalf("step %d: line %d is %q, want %q", step, line, buf.Line(line), lines[line])
+		}
+	}
+}
+
+// benchLines is the size of the buffer the benchmarks edit.
+const benchLines = 50000
+
+// newBenchBuffer returns a buffer of benchLines short lines.
+// newBenchBuffer возвращает буфер из benchLines коротких строк.
+func newBenchBuffer() TextBuffer {
+	lines := make([]string, benchLines)
+	for i := range lines {
+		lines[i] = "line " + strconv.Itoa(i) + " of the benchmark buffer"
+	}
+	return NewTextBufferFromLines(lines)
+}
+
+// BenchmarkInsert inserts a character and a line break at spread-out
+// positions of a large buffer.
+// BenchmarkInsert вставляет символ и перевод строки в большой буфер.
+func BenchmarkInsert(b *testing.B) {
+	buf := newBenchBuffer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		line := (i * 7919) % buf.LineCount()
+		if i%2 == 0 {
+			buf.Insert(line, 3, "x")
+		} else {
+			buf.Insert(line, 3, "\n")
+		}
+	}
+}
+
+// BenchmarkDelete removes a character and joins two lines at spread-out
+// positions of a large buffer.
+// BenchmarkDelete удаляет символ и склеивает строки в большом буфере.
+func BenchmarkDelete(b *testing.B) {
+	buf := newBenchBuffer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buf.LineCount() < benchLines/2 {
+			b.StopTimer()
+			buf = newBenchBuffer()
+			b.StartTimer()
+		}
+		line := (i * 7919) % (buf.LineCount() - 1)
+		if i%2 == 0 {
+			buf.Delete(line, 0, line, 1)
+		} else {
+			buf.Delete(line, buf.LineLen(line), line+1, 0)
+		}
+	}
+}
+
+// BenchmarkLineOffset converts positions to offsets and back in a large
+// buffer.
+// BenchmarkLineOffset переводит позиции в смещения и обратно.
+func BenchmarkLineOffset(b *testing.B) {
+	buf := newBenchBuffer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		line := (i * 7919) % buf.LineCount()
+		off := buf.Offset(line, 5)
+		if l, _ := buf.Position(off); l != line {
+			b.Fatalf("Position(%d) = line %d, want %d", off, l, line)
+		}
+	}
+}
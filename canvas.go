@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -10,19 +13,36 @@ import (
 // Максимальное количество канвасов
 const MaxCanvases = 100
 
-// Canvas представляет отдельный канвас редактора.
+// CanvasKind tells a file canvas from a canvas generated by the editor.
+// CanvasKind отличает канвас файла от канваса, созданного редактором.
+type CanvasKind int
+
+const (
+	CanvasFile CanvasKind = iota
+	CanvasSearchResults
+	CanvasReplacePreview
+	CanvasDiff
+)
+
 // Canvas represents a separate editor canvas.
+// Canvas представляет отдельный канвас редактора.
 type Canvas struct {
 	filename      string
-	lines         []string
+	buf           TextBuffer
 	cx, cy        int
 	offsetX       int
 	offsetY       int
+	offsetSeg     int
 	dirty         bool
 	language      Language
-	undoStack     []EditorState
-	redoStack     []EditorState
+	format        textFormat
+	history       *UndoTree
 	githubProject *GitHubProject
+	kind          CanvasKind
+	swapFile      string
+	swapHash      string
+	disk          diskState
+	conflictHash  string
 }
 
 // switchToNextCanvas переключается на следующий канвас по кругу.
@@ -42,15 +62,143 @@ func (e *Editor) switchToNextCanvas() {
 		}
 	}
 	if _, exists := e.canvases[nextCanvas]; exists {
-		e.currentCanvas = nextCanvas
-		e.syncCanvasToEditor()
-		e.ensureVisible()
+		e.switchToCanvas(nextCanvas)
 		e.statusMessage("Canvas " + strconv.Itoa(nextCanvas))
 	} else {
 		e.statusMessage("There are no other canvases")
 	}
 }
 
+// switchToCanvas makes canvas num current and remembers the canvas it leaves
+// for the previous-canvas toggle. It reports false if there is no such canvas.
+// switchToCanvas делает канвас num текущим и запоминает предыдущий канвас.
+func (e *Editor) switchToCanvas(num int) bool {
+	if _, exists := e.canvases[num]; !exists {
+		return false
+	}
+	e.syncEditorToCanvas()
+	if num != e.currentCanvas {
+		e.prevCanvas = e.currentCanvas
+	}
+	e.currentCanvas = num
+	e.syncCanvasToEditor()
+	e.ensureVisible()
+	if c := e.canvases[num]; c.kind == CanvasFile {
+		e.noteRecentFile(c.filename)
+	}
+	return true
+}
+
+// switchToPreviousCanvas returns to the canvas that was current before.
+// switchToPreviousCanvas возвращается к предыдущему канвасу.
+func (e *Editor) switchToPreviousCanvas() {
+	if !e.switchToCanvas(e.prevCanvas) || e.prevCanvas == e.currentCanvas {
+		e.statusMessage("There is no previous canvas")
+		return
+	}
+	e.statusMessage("Canvas " + strconv.Itoa(e.currentCanvas))
+}
+
+// showGoToCanvasPrompt asks for a canvas number and switches to it.
+// showGoToCanvasPrompt запрашивает номер канваса и переключается на него.
+func (e *Editor) showGoToCanvasPrompt() {
+	e.promptShow("Go to canvas", func(input string) {
+		num, err := strconv.Atoi(strings.TrimSpace(input))
+		if err != nil || !e.switchToCanvas(num) {
+			e.showError("No canvas " + strings.TrimSpace(input))
+			return
+		}
+		e.statusMessage("Canvas " + strconv.Itoa(num))
+	})
+}
+
+// showCanvasPicker lists all canvases with their number, name, unsaved mark
+// and language; typing filters the list and Enter switches to the choice.
+// showCanvasPicker показывает список канвасов с фильтром по набранному тексту.
+func (e *Editor) showCanvasPicker() {
+	e.syncEditorToCanvas()
+	nums := make([]int, 0, len(e.canvases))
+	for num := range e.canvases {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	var shown []int
+	filter := func(query string) []string {
+		words := strings.Fields(strings.ToLower(query))
+		shown = shown[:0]
+		var items []string
+		for _, num := range nums {
+			c := e.canvases[num]
+			mark := " "
+			if c.hasUnsavedChanges() {
+				mark = "*"
+			}
+			lang := ""
+			if c.language != LangUnknown && c.language != "" {
+				lang = "[" + string(c.language) + "]"
+			}
+			item := fmt.Sprintf("%3d %s %s  %s", num, mark, c.getDisplayName(), lang)
+			lower := strings.ToLower(item)
+			matched := true
+			for _, w := range words {
+				if !strings.Contains(lower, w) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				shown = append(shown, num)
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	e.showFilterPopup("Canvases (type to filter, Enter: switch, Esc: close)", filter, func(i int) {
+		e.switchToCanvas(shown[i])
+	})
+	for i, num := range shown {
+		if num == e.currentCanvas {
+			e.listPopup.Selected = i
+		}
+	}
+	e.scrollPopupToSelected()
+}
+
+// load reads the file of a project canvas that has not been viewed yet; such
+// a canvas has no buffer. An unreadable file leaves the canvas empty.
+// load читает файл канваса проекта при первом показе.
+func (c *Canvas) load() error {
+	if c.buf != nil {
+		return nil
+	}
+	data, err := os.ReadFile(c.filename)
+	if err != nil {
+		c.buf = NewTextBuffer("")
+		return err
+	}
+	text, format := decodeText(data)
+	c.buf = NewTextBuffer(text)
+	c.format = format
+	c.disk = diskStateOf(c.filename, data)
+	c.restoreUndoHistory()
+	return nil
+}
+
+// text returns the text of the canvas. The file of a canvas that has not
+// been viewed yet is read from disk without keeping it in memory.
+// text возвращает текст канваса, не загружая ещё не открытый файл в память.
+func (c *Canvas) text() string {
+	if c.buf != nil {
+		return c.buf.String()
+	}
+	data, err := os.ReadFile(c.filename)
+	if err != nil {
+		return ""
+	}
+	text, _ := decodeText(data)
+	return text
+}
+
 // syncCanvasToEditor синхронизирует текущий канвас с редактором.
 func (e *Editor) syncCanvasToEditor() {
 	canvas, exists := e.canvases[e.currentCanvas]
@@ -58,16 +206,25 @@ func (e *Editor) syncCanvasToEditor() {
 		return
 	}
 
+	fresh := canvas.buf == nil
+	if err := canvas.load(); err != nil {
+		e.showError("Unable to open the file: " + err.Error())
+	}
 	e.filename = canvas.filename
-	e.lines = canvas.lines
+	e.buf = canvas.buf
 	e.cx = canvas.cx
 	e.cy = canvas.cy
+	if fresh {
+		e.cy, e.cx = e.clampPos(e.cy, e.cx)
+	}
 	e.offsetX = canvas.offsetX
 	e.offsetY = canvas.offsetY
+	e.offsetSeg = canvas.offsetSeg
 	e.dirty = canvas.dirty
 	e.language = canvas.language
-	e.undoStack = canvas.undoStack
-	e.redoStack = canvas.redoStack
+	e.format = canvas.format
+	e.history = canvas.history
+	e.undoOpen = false
 	if canvas.githubProject != nil {
 		e.githubProject = canvas.githubProject
 	}
@@ -81,15 +238,16 @@ func (e *Editor) syncEditorToCanvas() {
 	}
 
 	canvas.filename = e.filename
-	canvas.lines = e.lines
+	canvas.buf = e.buf
 	canvas.cx = e.cx
 	canvas.cy = e.cy
 	canvas.offsetX = e.offsetX
 	canvas.offsetY = e.offsetY
+	canvas.offsetSeg = e.offsetSeg
 	canvas.dirty = e.dirty
 	canvas.language = e.language
-	canvas.undoStack = e.undoStack
-	canvas.redoStack = e.redoStack
+	canvas.format = e.format
+	canvas.history = e.history
 	if e.githubProject != nil {
 		canvas.githubProject = e.githubProject
 	}
@@ -112,7 +270,7 @@ func (e *Editor) createNewCanvas() {
 	}
 	e.canvases[newCanvasNum] = &Canvas{
 		filename: "",
-		lines:    []string{""},
+		buf:      NewTextBuffer(""),
 		cx:       0,
 		cy:       0,
 		offsetX:  0,
@@ -120,16 +278,115 @@ func (e *Editor) createNewCanvas() {
 		dirty:    false,
 		language: LangUnknown,
 	}
-	e.currentCanvas = newCanvasNum
-	e.syncCanvasToEditor()
-	e.ensureVisible()
+	e.switchToCanvas(newCanvasNum)
 
 	e.statusMessage("Canvas created " + strconv.Itoa(newCanvasNum))
 }
 
+// isProjectOverview reports whether the canvas shows the project directory.
+func (c *Canvas) isProjectOverview() bool {
+	if c.kind != CanvasFile || c.filename == "" {
+		return false
+	}
+	info, err := os.Stat(c.filename)
+	return err == nil && info.IsDir()
+}
+
+// closeCurrentCanvas closes the current canvas, asking first whether to save
+// unsaved changes.
+// closeCurrentCanvas закрывает текущий канвас, предлагая сохранить изменения.
+func (e *Editor) closeCurrentCanvas() {
+	if c, ok := e.canvases[e.currentCanvas]; ok && c.isProjectOverview() {
+		e.showError("The project overview canvas cannot be closed")
+		return
+	}
+	e.closeCanvases([]int{e.currentCanvas})
+}
+
+// closeSavedCanvases closes every canvas without unsaved changes except the
+// project overview.
+// closeSavedCanvases закрывает все канвасы без несохранённых изменений.
+func (e *Editor) closeSavedCanvases() {
+	e.syncEditorToCanvas()
+	var nums []int
+	for num, c := range e.canvases {
+		if !c.hasUnsavedChanges() && !c.isProjectOverview() {
+			nums = append(nums, num)
+		}
+	}
+	if len(nums) == 0 {
+		e.statusMessage("No saved canvases to close")
+		return
+	}
+	e.closeCanvases(nums)
+}
+
+// closeCanvases closes the canvases nums. Unsaved ones go through the same
+// save/discard/cancel prompts as quitting.
+// closeCanvases закрывает канвасы nums; для несохранённых задаются те же
+// вопросы, что и при выходе.
+func (e *Editor) closeCanvases(nums []int) {
+	em := NewExitManager(e)
+	em.closeMode = true
+	em.closing = nums
+	e.syncEditorToCanvas()
+	for _, num := range nums {
+		if c, ok := e.canvases[num]; ok && c.hasUnsavedChanges() {
+			em.canvasesToSave = append(em.canvasesToSave, num)
+		}
+	}
+	if len(em.canvasesToSave) == 0 {
+		em.finishExit()
+		return
+	}
+	em.promptForCanvasSave(em.canvasesToSave[0])
+}
+
+// removeCanvas frees the slot of canvas num. If it was current, the next
+// canvas (or the previous one if there is none) becomes current; closing the
+// last canvas leaves an empty one.
+// removeCanvas освобождает слот канваса num и переключается на соседний.
+func (e *Editor) removeCanvas(num int) {
+	c, ok := e.canvases[num]
+	if !ok {
+		return
+	}
+	delete(e.canvases, num)
+	c.removeSwap()
+	if e.projectReplace != nil && c.kind == CanvasReplacePreview {
+		e.projectReplace = nil
+	}
+	if e.prevCanvas == num {
+		e.prevCanvas = 0
+	}
+	if num != e.currentCanvas {
+		return
+	}
+	next := 0
+	for i := num + 1; i <= MaxCanvases && next == 0; i++ {
+		if _, exists := e.canvases[i]; exists {
+			next = i
+		}
+	}
+	for i := num - 1; i >= 1 && next == 0; i-- {
+		if _, exists := e.canvases[i]; exists {
+			next = i
+		}
+	}
+	if next == 0 {
+		next = 1
+		e.canvases[next] = &Canvas{buf: NewTextBuffer(""), language: LangUnknown}
+	}
+	e.currentCanvas = next
+	e.syncCanvasToEditor()
+	e.ensureVisible()
+}
+
+// hasUnsavedChanges reports whether a file canvas has unsaved changes.
+// Generated canvases are never saved.
 // hasUnsavedChanges проверяет, есть ли несохраненные изменения в канвасе.
 func (c *Canvas) hasUnsavedChanges() bool {
-	return c.dirty
+	return c.dirty && c.kind == CanvasFile
 }
 
 // saveAllCanvases сохраняет все канвасы с несохраненными изменениями
@@ -162,21 +419,41 @@ func (e *Editor) saveAllCanvases() error {
 
 // getDisplayName возвращает отображаемое имя канваса.
 func (c *Canvas) getDisplayName() string {
+	if c.kind == CanvasSearchResults {
+		return "[search results]"
+	}
+	if c.kind == CanvasReplacePreview {
+		return "[replace preview]"
+	}
+	if c.kind == CanvasDiff {
+		return "[diff]"
+	}
 	if c.filename == "" {
 		return "[new file]"
 	}
 	return c.filename
 }
 
-// canvas.go - добавляем функцию для получения списка файлов проекта
+// samePath reports whether a and b name the same file.
+// samePath сообщает, указывают ли a и b на один и тот же файл.
+func samePath(a, b string) bool {
+	if a == b {
+		return true
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// getProjectFiles returns the canvases of all project files keyed by file
+// name; their text is read with text when it is needed.
 // getProjectFiles возвращает map всех файлов проекта из всех канвасов
-func (e *Editor) getProjectFiles() map[string]string {
-	files := make(map[string]string)
+func (e *Editor) getProjectFiles() map[string]*Canvas {
+	files := make(map[string]*Canvas)
 
 	for _, canvas := range e.canvases {
-		if canvas.filename != "" && len(canvas.lines) > 0 {
-			content := strings.Join(canvas.lines, "\n")
-			files[canvas.filename] = content
+		if canvas.filename != "" {
+			files[canvas.filename] = canvas
 		}
 	}
 
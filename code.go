@@ -718,7 +718,7 @@ func (e *Editor) llmQueryWithoutInsert(instruction string) (string, error) {
 
 func (e *Editor) handleRunCode() {
 	e.statusMessage("Analyzing code with LLM...")
-	code := strings.Join(e.lines, "\n")
+	code := e.buf.String()
 	analysisQuery := "Analyze this code and return a JSON object with fields: language, flags, and args to run the" +
 		"code (if the argument of the program is necessary for its correct launch, then come up with it yourself, based on" +
 		"the requirements of the code, but do not specify the flags of the program name, for example: -o multiplication)." +
@@ -1163,63 +1163,22 @@ func (e *Editor) insertContextualLLMResponse(resp string, isIncomplete bool) {
 	if e.cy < 0 {
 		e.cy = 0
 	}
-
-	for e.cy >= len(e.lines) {
-		e.lines = append(e.lines, "")
+	if e.cy >= e.buf.LineCount() {
+		e.cy = e.buf.LineCount() - 1
 	}
 
-	if isIncomplete && len(respLines) > 0 {
-		currentLine := e.lines[e.cy]
-		if len(currentLine) > 0 {
-			e.lines[e.cy] = currentLine + respLines[0]
-
-			insertIndex := e.cy + 1
-			for i := 1; i < len(respLines); i++ {
-				if insertIndex >= len(e.lines) {
-					e.lines = append(e.lines, respLines[i])
-				} else {
-					e.lines = append(e.lines[:insertIndex], append([]string{respLines[i]}, e.lines[insertIndex:]...)...)
-				}
-				insertIndex++
-			}
-
-			e.cy = insertIndex - 1
-			if e.cy >= 0 && e.cy < len(e.lines) {
-				e.cx = len([]rune(e.lines[e.cy]))
-			}
-		} else {
-			// Insert all lines after the current line
-			insertIndex := e.cy + 1
-			for i := 0; i < len(respLines); i++ {
-				if insertIndex >= len(e.lines) {
-					e.lines = append(e.lines, respLines[i])
-				} else {
-					e.lines = append(e.lines[:insertIndex], append([]string{respLines[i]}, e.lines[insertIndex:]...)...)
-				}
-				insertIndex++
-			}
-
-			e.cy = insertIndex - 1
-			if e.cy >= 0 && e.cy < len(e.lines) {
-				e.cx = len([]rune(e.lines[e.cy]))
-			}
-		}
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	if isIncomplete && e.buf.LineLen(e.cy) > 0 {
+		e.setLine(e.cy, e.buf.Line(e.cy)+respLines[0])
+		e.insertLines(e.cy+1, respLines[1:])
+		e.cy += len(respLines) - 1
 	} else {
-		insertIndex := e.cy + 1
-		for i := 0; i < len(respLines); i++ {
-			if insertIndex >= len(e.lines) {
-				e.lines = append(e.lines, respLines[i])
-			} else {
-				e.lines = append(e.lines[:insertIndex], append([]string{respLines[i]}, e.lines[insertIndex:]...)...)
-			}
-			insertIndex++
-		}
-
-		e.cy = insertIndex - 1
-		if e.cy >= 0 && e.cy < len(e.lines) {
-			e.cx = len([]rune(e.lines[e.cy]))
-		}
+		// Insert all lines after the current line
+		e.insertLines(e.cy+1, respLines)
+		e.cy += len(respLines)
 	}
+	e.cx = e.buf.LineLen(e.cy)
 
 	e.dirty = true
 	e.ensureVisible()
@@ -1227,11 +1186,11 @@ func (e *Editor) insertContextualLLMResponse(resp string, isIncomplete bool) {
 
 // isAtEndOfIncompleteStatement checks if the cursor is at the end of an incomplete statement
 func (e *Editor) isAtEndOfIncompleteStatement() bool {
-	if e.cy < 0 || e.cy >= len(e.lines) {
+	if e.cy < 0 || e.cy >= e.buf.LineCount() {
 		return false
 	}
 
-	line := e.lines[e.cy]
+	line := e.buf.Line(e.cy)
 	lineRunes := []rune(line)
 
 	if e.cx != len(lineRunes) {
@@ -1294,13 +1253,13 @@ func (e *Editor) getContextAroundCursor() (string, bool) {
 	}
 
 	endLine := e.cy + linesAfter
-	if endLine >= len(e.lines) {
-		endLine = len(e.lines) - 1
+	if endLine >= e.buf.LineCount() {
+		endLine = e.buf.LineCount() - 1
 	}
 
 	contextLines := make([]string, 0)
 	for i := startLine; i <= endLine; i++ {
-		contextLines = append(contextLines, e.lines[i])
+		contextLines = append(contextLines, e.buf.Line(i))
 	}
 
 	isIncomplete := e.isAtEndOfIncompleteStatement()
@@ -1310,11 +1269,11 @@ func (e *Editor) getContextAroundCursor() (string, bool) {
 
 // findKeywordCompletion checks if the word before cursor is a partial keyword and returns the full keyword
 func (e *Editor) findKeywordCompletion() string {
-	if e.cy < 0 || e.cy >= len(e.lines) {
+	if e.cy < 0 || e.cy >= e.buf.LineCount() {
 		return ""
 	}
 
-	line := e.lines[e.cy]
+	line := e.buf.Line(e.cy)
 	runes := []rune(line)
 
 	if e.cx != len(runes) {
@@ -1364,11 +1323,11 @@ func (e *Editor) findKeywordCompletion() string {
 
 // findIdentifierCompletion checks if the word before cursor is a partial identifier and returns the full identifier
 func (e *Editor) findIdentifierCompletion() string {
-	if e.cy < 0 || e.cy >= len(e.lines) {
+	if e.cy < 0 || e.cy >= e.buf.LineCount() {
 		return ""
 	}
 
-	line := e.lines[e.cy]
+	line := e.buf.Line(e.cy)
 	runes := []rune(line)
 
 	if e.cx != len(runes) {
@@ -1417,11 +1376,11 @@ func (e *Editor) findIdentifierCompletion() string {
 
 // shouldAutoCloseBracket checks if we should automatically close a bracket
 func (e *Editor) shouldAutoCloseBracket(openBracket rune) bool {
-	if e.cy < 0 || e.cy >= len(e.lines) {
+	if e.cy < 0 || e.cy >= e.buf.LineCount() {
 		return false
 	}
 
-	line := e.lines[e.cy]
+	line := e.buf.Line(e.cy)
 	runes := []rune(line)
 
 	if e.cx >= len(runes) {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -19,7 +20,6 @@ import (
 	"github.com/mattn/go-runewidth"
 )
 
-
 // Style definitions for syntax highlighting.
 // Определения стилей для подсветки синтаксиса.
 var (
@@ -44,6 +44,7 @@ const (
 type DisplayRow struct {
 	lineIndex int
 	segIndex  int
+	start     int // rune offset of text in the line
 	text      string
 	widths    []int
 }
@@ -59,6 +60,8 @@ type Prompt struct {
 	Label    string
 	Value    string
 	Callback func(string)
+	// OnKey, if set, sees every key first; returning true consumes it.
+	OnKey func(*tcell.EventKey) bool
 }
 
 // MultiLinePrompt represents a multi-line prompt for user input.
@@ -74,11 +77,17 @@ type TerminalPrompt struct {
 	Callback func(string)
 }
 
+// ExitManager runs the exit, checking every canvas for unsaved changes.
+// In close mode it closes the canvases in closing instead of quitting.
 // ExitManager управляет процессом выхода с проверкой всех канвасов.
+// В режиме закрытия вместо выхода закрываются канвасы из closing.
 type ExitManager struct {
 	editor         *Editor
 	canvasesToSave []int
 	currentPrompt  int
+	closeMode      bool
+	closing        []int
+	discarded      map[int]bool
 }
 
 func getLineCommentPrefix(lang Language) (string, bool) {
@@ -109,7 +118,17 @@ func (e *Editor) refreshSize() {
 	if w > 150 {
 		w = 150
 	}
+	e.tabBarHeight = 0
+	if e.showTabBar && h > 6 {
+		e.tabBarHeight = 1
+	}
+	e.layoutSize(w, h)
+}
 
+// layoutSize sets the content sizes and the widths derived from them for a
+// screen of w×h cells.
+// layoutSize задаёт размеры области текста для экрана w×h.
+func (e *Editor) layoutSize(w, h int) {
 	e.contentWidth = w
 	e.contentHeight = h
 	e.width = e.contentWidth
@@ -121,7 +140,7 @@ func (e *Editor) refreshSize() {
 		e.structurePanelWidth = e.contentWidth / 3
 	}
 	if e.showLineNumbers {
-		maxLineNum := len(e.lines)
+		maxLineNum := e.buf.LineCount()
 		e.lineNumbersWidth = len(strconv.Itoa(maxLineNum)) + LineNumbersPadding
 		if e.lineNumbersWidth < LineNumbersMinWidth {
 			e.lineNumbersWidth = LineNumbersMinWidth
@@ -188,18 +207,19 @@ func (e *Editor) wrapLine(line string) []string {
 	return parts
 }
 
-// renderLineNumbers отображает номера строк слева от текста.
 // renderLineNumbers displays line numbers to the left of the text.
+// renderLineNumbers отображает номера строк слева от текста.
 func (e *Editor) renderLineNumbers(display []DisplayRow, contentRows int) {
 	if !e.showLineNumbers || e.lineNumbersWidth <= 0 {
 		return
 	}
+	top := e.textTop()
 
 	for i := 0; i < contentRows; i++ {
-		di := e.offsetY + i
+		di := i
 		if di >= len(display) {
 			for x := 0; x < e.lineNumbersWidth; x++ {
-				e.screen.SetContent(x, i+1, ' ', nil,
+				e.screen.SetContent(x, i+top, ' ', nil,
 					tcell.StyleDefault.Background(tcell.ColorDarkBlue).Foreground(tcell.ColorGray))
 			}
 			continue
@@ -221,7 +241,7 @@ func (e *Editor) renderLineNumbers(display []DisplayRow, contentRows int) {
 		padding := e.lineNumbersWidth - len(lineNumStr) - LineNumbersPadding
 
 		for x := 0; x < e.lineNumbersWidth; x++ {
-			e.screen.SetContent(x, i+1, ' ', nil, lineNumStyle)
+			e.screen.SetContent(x, i+top, ' ', nil, lineNumStyle)
 		}
 
 		xPos := padding
@@ -229,41 +249,57 @@ func (e *Editor) renderLineNumbers(display []DisplayRow, contentRows int) {
 			if xPos >= e.lineNumbersWidth {
 				break
 			}
-			e.screen.SetContent(xPos, i+1, r, nil, lineNumStyle)
+			e.screen.SetContent(xPos, i+top, r, nil, lineNumStyle)
 			xPos++
 		}
 
 		if e.lineNumbersWidth > 1 {
 			separatorX := e.lineNumbersWidth - 1
-			e.screen.SetContent(separatorX, i+1, '│', nil, lineNumStyle)
+			e.screen.SetContent(separatorX, i+top, '│', nil, lineNumStyle)
 		}
 	}
 }
 
-// buildDisplayBuffer builds the display buffer from the editor's lines.
-// buildDisplayBuffer строит буфер отображения из строк редактора.
-func (e *Editor) buildDisplayBuffer() []DisplayRow {
+// lineRows wraps line li into display rows.
+// lineRows разбивает строку li на строки отображения.
+func (e *Editor) lineRows(li int) []DisplayRow {
+	parts := e.wrapLine(e.buf.Line(li))
+	rows := make([]DisplayRow, len(parts))
+	start := 0
+	for si, seg := range parts {
+		runes := []rune(seg)
+		widths := make([]int, len(runes))
+		for i, r := range runes {
+			widths[i] = runewidth.RuneWidth(r)
+		}
+		rows[si] = DisplayRow{
+			lineIndex: li,
+			segIndex:  si,
+			start:     start,
+			text:      seg,
+			widths:    widths,
+		}
+		start += len(runes)
+	}
+	return rows
+}
+
+// buildDisplayBuffer builds up to n display rows of the visible window,
+// starting at segment offsetSeg of line offsetY. Lines below the window are
+// not wrapped.
+// buildDisplayBuffer строит строки отображения только для видимого окна.
+func (e *Editor) buildDisplayBuffer(n int) []DisplayRow {
+	e.offsetY = max(0, min(e.offsetY, e.buf.LineCount()-1))
 	var buf []DisplayRow
-	for li, line := range e.lines {
-		parts := e.wrapLine(line)
-		if len(parts) == 0 {
-			parts = []string{""}
-		}
-		for si, seg := range parts {
-			runes := []rune(seg)
-			widths := make([]int, len(runes))
-			for i, r := range runes {
-				widths[i] = runewidth.RuneWidth(r)
-			}
-			buf = append(buf, DisplayRow{
-				lineIndex: li,
-				segIndex:  si,
-				text:      seg,
-				widths:    widths,
-			})
+	for li := e.offsetY; li < e.buf.LineCount() && len(buf) < n; li++ {
+		rows := e.lineRows(li)
+		if li == e.offsetY {
+			e.offsetSeg = max(0, min(e.offsetSeg, len(rows)-1))
+			rows = rows[e.offsetSeg:]
 		}
+		buf = append(buf, rows...)
 	}
-	return buf
+	return buf[:min(n, len(buf))]
 }
 
 func (e *Editor) llmPromptWithPrevShow() {
@@ -278,57 +314,18 @@ func (e *Editor) llmPromptWithPrevShow() {
 	e.prompt = nil
 }
 
-// cursorDisplayPosition calculates the display position of the cursor.
-// cursorDisplayPosition вычисляет позицию отображения курсора.
-func (e *Editor) cursorDisplayPosition() (int, int, int) {
-	if e.cy < 0 {
-		e.cy = 0
-	}
-	if e.cy >= len(e.lines) {
-		if len(e.lines) > 0 {
-			e.cy = len(e.lines) - 1
-		} else {
-			e.cy = 0
-		}
-	}
-	if e.cx < 0 {
-		e.cx = 0
-	}
-
-	if len(e.lines) == 0 {
-		e.lines = []string{""}
-		e.cy = 0
-		e.cx = 0
-	}
-
-	if e.cy < len(e.lines) {
-		lineRunes := []rune(e.lines[e.cy])
-		if e.cx > len(lineRunes) {
-			e.cx = len(lineRunes)
-		}
-	} else {
-		e.cy = 0
-		e.cx = 0
-		if len(e.lines) == 0 {
-			e.lines = []string{""}
-		}
-	}
-
-	totalBefore := 0
-	for i := 0; i < e.cy; i++ {
-		totalBefore += len(e.wrapLine(e.lines[i]))
-	}
-	segs := e.wrapLine(e.lines[e.cy])
-	lineRunes := []rune(e.lines[e.cy])
-	if e.cx > len(lineRunes) {
-		e.cx = len(lineRunes)
-	}
+// segmentPosition returns the wrapped segment of line li that holds column
+// col and the cell offset of col in that segment.
+// segmentPosition возвращает сегмент переноса строки li с колонкой col и
+// смещение колонки в ячейках внутри сегмента.
+func (e *Editor) segmentPosition(li, col int) (int, int) {
+	segs := e.wrapLine(e.buf.Line(li))
 	segmentStartRune := 0
 	for segIndex, seg := range segs {
 		segRunes := []rune(seg)
 		segEndRune := segmentStartRune + len(segRunes)
-		if e.cx >= segmentStartRune && e.cx <= segEndRune {
-			offsetInSegRunes := e.cx - segmentStartRune
+		if col >= segmentStartRune && col <= segEndRune || segIndex == len(segs)-1 {
+			offsetInSegRunes := min(col-segmentStartRune, len(segRunes))
 			offsetInSegCells := 0
 			for i := 0; i < offsetInSegRunes; i++ {
 				r := segRunes[i]
@@ -338,60 +335,76 @@ func (e *Editor) cursorDisplayPosition() (int, int, int) {
 					offsetInSegCells += runewidth.RuneWidth(r)
 				}
 			}
-			displayRow := totalBefore + segIndex
-			return displayRow, segIndex, offsetInSegCells
+			return segIndex, offsetInSegCells
 		}
 		segmentStartRune = segEndRune
 	}
+	return 0, 0
+}
 
-	displayRow := totalBefore + len(segs) - 1
-	lastSegRunes := []rune(segs[len(segs)-1])
-	offsetInSegCells := 0
-	for _, r := range lastSegRunes {
-		if r == '\t' {
-			offsetInSegCells += 4 - (offsetInSegCells % 4)
-		} else {
-			offsetInSegCells += runewidth.RuneWidth(r)
+// displayRowOf returns the row of segment seg of line li counted from the
+// top of the window: negative above it and, for lines far below it, some
+// row past the bottom. Only the lines between the top and li are wrapped.
+// displayRowOf возвращает строку сегмента seg строки li относительно верха окна.
+func (e *Editor) displayRowOf(li, seg int) int {
+	if li < e.offsetY || li == e.offsetY && seg < e.offsetSeg {
+		return -1
+	}
+	row := -e.offsetSeg
+	for i := e.offsetY; i < li; i++ {
+		row += len(e.wrapLine(e.buf.Line(i)))
+		if row > e.contentHeight {
+			return row
 		}
 	}
-	offsetInSegCells += e.lineNumbersWidth
-	return displayRow, len(segs) - 1, offsetInSegCells
+	return row + seg
 }
 
-// ensureVisible ensures the cursor is visible on the screen.
-// ensureVisible обеспечивает видимость курсора на экране.
-func (e *Editor) ensureVisible() {
-	if len(e.lines) == 0 {
-		e.lines = []string{""}
-		e.cy = 0
-		e.cx = 0
-	}
-
+// cursorDisplayPosition calculates the display position of the cursor: its
+// row counted from the top of the window, its wrapped segment and its cell
+// in that segment.
+// cursorDisplayPosition вычисляет позицию отображения курсора.
+func (e *Editor) cursorDisplayPosition() (int, int, int) {
 	if e.cy < 0 {
 		e.cy = 0
 	}
-	if e.cy >= len(e.lines) {
-		e.cy = len(e.lines) - 1
+	if e.cy >= e.buf.LineCount() {
+		e.cy = e.buf.LineCount() - 1
 	}
 	if e.cx < 0 {
 		e.cx = 0
 	}
-	if e.cy < len(e.lines) {
-		lineRunes := []rune(e.lines[e.cy])
-		if e.cx > len(lineRunes) {
-			e.cx = len(lineRunes)
-		}
+	if n := e.buf.LineLen(e.cy); e.cx > n {
+		e.cx = n
 	}
+	segIndex, offsetInSegCells := e.segmentPosition(e.cy, e.cx)
+	return e.displayRowOf(e.cy, segIndex), segIndex, offsetInSegCells
+}
 
-	dispIdx, _, _ := e.cursorDisplayPosition()
-	visibleRows := e.contentHeight - 4
+// ensureVisible ensures the cursor is visible on the screen.
+// ensureVisible обеспечивает видимость курсора на экране.
+func (e *Editor) ensureVisible() {
+	dispIdx, seg, _ := e.cursorDisplayPosition()
+	visibleRows := e.contentHeight - 4 - e.tabBarHeight
 	if visibleRows < 1 {
 		visibleRows = 1
 	}
-	if dispIdx < e.offsetY {
-		e.offsetY = dispIdx
-	} else if dispIdx >= e.offsetY+visibleRows {
-		e.offsetY = dispIdx - visibleRows + 1
+	if dispIdx < 0 {
+		e.offsetY, e.offsetSeg = e.cy, seg
+	} else if dispIdx >= visibleRows {
+		li, s := e.cy, seg
+		for up := visibleRows - 1; up > 0; up-- {
+			if s > 0 {
+				s--
+				continue
+			}
+			if li == 0 {
+				break
+			}
+			li--
+			s = len(e.wrapLine(e.buf.Line(li))) - 1
+		}
+		e.offsetY, e.offsetSeg = li, s
 	}
 }
 
@@ -405,37 +418,10 @@ func (e *Editor) insertTextAtCursor(text string) {
 	if e.cy < 0 {
 		e.cy = 0
 	}
-	for e.cy >= len(e.lines) {
-		e.lines = append(e.lines, "")
-	}
-	lineRunes := []rune(e.lines[e.cy])
 	if e.cx < 0 {
 		e.cx = 0
 	}
-	if e.cx > len(lineRunes) {
-		e.cx = len(lineRunes)
-	}
-
-	if len(parts) == 1 {
-		left := string(lineRunes[:e.cx])
-		right := string(lineRunes[e.cx:])
-		e.lines[e.cy] = left + parts[0] + right
-		e.cx += len([]rune(parts[0]))
-	} else {
-		origCy := e.cy
-		left := string(lineRunes[:e.cx])
-		right := string(lineRunes[e.cx:])
-		e.lines[e.cy] = left + parts[0]
-		for i := 1; i < len(parts)-1; i++ {
-			insertLine := parts[i]
-			e.lines = append(e.lines[:e.cy+1], append([]string{insertLine}, e.lines[e.cy+1:]...)...)
-			e.cy++
-		}
-		last := parts[len(parts)-1] + right
-		e.lines = append(e.lines[:e.cy+1], append([]string{last}, e.lines[e.cy+1:]...)...)
-		e.cy = origCy + (len(parts) - 1)
-		e.cx = len([]rune(parts[len(parts)-1]))
-	}
+	e.cy, e.cx = e.insertText(e.cy, e.cx, text)
 
 	e.dirty = true
 	e.ensureVisible()
@@ -447,13 +433,14 @@ func (e *Editor) indentSelection() {
 	if !e.selecting {
 		return
 	}
-	e.pushUndo()
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
 	startLine, _, endLine, _ := e.getSelectionRange()
 	if startLine < 0 {
 		startLine = 0
 	}
-	if endLine >= len(e.lines) {
-		endLine = len(e.lines) - 1
+	if endLine >= e.buf.LineCount() {
+		endLine = e.buf.LineCount() - 1
 	}
 	if startLine > endLine {
 		startLine, endLine = endLine, startLine
@@ -461,7 +448,7 @@ func (e *Editor) indentSelection() {
 
 	indentText := "    "
 	for i := startLine; i <= endLine; i++ {
-		e.lines[i] = indentText + e.lines[i]
+		e.setLine(i, indentText+e.buf.Line(i))
 	}
 
 	e.dirty = true
@@ -473,14 +460,15 @@ func (e *Editor) unindentSelection() {
 	if !e.selecting {
 		return
 	}
-	e.pushUndo()
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
 
 	startLine, _, endLine, _ := e.getSelectionRange()
 	if startLine < 0 {
 		startLine = 0
 	}
-	if endLine >= len(e.lines) {
-		endLine = len(e.lines) - 1
+	if endLine >= e.buf.LineCount() {
+		endLine = e.buf.LineCount() - 1
 	}
 	if startLine > endLine {
 		startLine, endLine = endLine, startLine
@@ -490,18 +478,18 @@ func (e *Editor) unindentSelection() {
 	spaceIndent := strings.Repeat(" ", tabSize)
 
 	for i := startLine; i <= endLine; i++ {
-		line := e.lines[i]
+		line := e.buf.Line(i)
 		if strings.HasPrefix(line, spaceIndent) {
-			e.lines[i] = line[tabSize:]
+			e.setLine(i, line[tabSize:])
 		} else if strings.HasPrefix(line, "\t") {
-			e.lines[i] = line[1:]
+			e.setLine(i, line[1:])
 		} else if len(line) > 0 {
 			numSpaces := 0
 			for numSpaces < len(line) && line[numSpaces] == ' ' && numSpaces < tabSize {
 				numSpaces++
 			}
 			if numSpaces > 0 {
-				e.lines[i] = line[numSpaces:]
+				e.setLine(i, line[numSpaces:])
 			}
 		}
 	}
@@ -512,20 +500,19 @@ func (e *Editor) unindentSelection() {
 // deleteWordAfterCursor удаляет слово, которое начинается либо после курсора,
 // либо является словом, в котором находится курсор (если курсор внутри слова).
 func (e *Editor) deleteWordAfterCursor() {
-	if e.cy < 0 || e.cy >= len(e.lines) {
+	if e.cy < 0 || e.cy >= e.buf.LineCount() {
 		return
 	}
 	e.pushUndo()
 
-	line := e.lines[e.cy]
+	line := e.buf.Line(e.cy)
 	runes := []rune(line)
 	if e.cx < 0 {
 		e.cx = 0
 	}
 	if e.cx >= len(runes) {
-		if e.cy < len(e.lines)-1 {
-			e.lines[e.cy] = line + e.lines[e.cy+1]
-			e.lines = append(e.lines[:e.cy+1], e.lines[e.cy+2:]...)
+		if e.cy < e.buf.LineCount()-1 {
+			e.deleteRange(e.cy, len(runes), e.cy+1, 0)
 			e.dirty = true
 			e.ensureVisible()
 		}
@@ -542,7 +529,7 @@ func (e *Editor) deleteWordAfterCursor() {
 		for end < len(runes) && !unicode.IsSpace(runes[end]) {
 			end++
 		}
-		e.lines[e.cy] = string(append(runes[:start], runes[end:]...))
+		e.deleteRange(e.cy, start, e.cy, end)
 		e.cx = start
 		e.dirty = true
 		e.ensureVisible()
@@ -557,24 +544,23 @@ func (e *Editor) deleteWordAfterCursor() {
 		for i < len(runes) && !unicode.IsSpace(runes[i]) {
 			i++
 		}
-		e.lines[e.cy] = string(append(runes[:start], runes[i:]...))
+		e.deleteRange(e.cy, start, e.cy, i)
 		e.cx = start
 		e.dirty = true
 		e.ensureVisible()
 		return
 	}
 
-	if e.cy < len(e.lines)-1 {
-		e.lines[e.cy] = line + e.lines[e.cy+1]
-		e.lines = append(e.lines[:e.cy+1], e.lines[e.cy+2:]...)
-		e.cx = len([]rune(line))
+	if e.cy < e.buf.LineCount()-1 {
+		e.deleteRange(e.cy, len(runes), e.cy+1, 0)
+		e.cx = len(runes)
 		e.dirty = true
 		e.ensureVisible()
 	}
 }
 
-// getUsageText возвращает текст расширенной справки в виде строки.
 // getUsageText returns the extended help text as a string.
+// getUsageText возвращает текст расширенной справки в виде строки.
 func (e *Editor) getUsageText() string {
 	oldStdout := os.Stdout
 	r, w, _ := os.Pipe()
@@ -608,10 +594,11 @@ func (e *Editor) toggleCommentSelection() {
 	if lo > hi {
 		lo, hi = hi, lo
 	}
-	e.pushUndo()
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
 	allCommented := true
 	for i := lo; i <= hi; i++ {
-		line := e.lines[i]
+		line := e.buf.Line(i)
 		lead := 0
 		for lead < len(line) && (line[lead] == ' ' || line[lead] == '\t') {
 			lead++
@@ -624,18 +611,18 @@ func (e *Editor) toggleCommentSelection() {
 
 	if allCommented {
 		for i := lo; i <= hi; i++ {
-			l := e.lines[i]
+			l := e.buf.Line(i)
 			lead := 0
 			for lead < len(l) && (l[lead] == ' ' || l[lead] == '\t') {
 				lead++
 			}
 			if lead+len(prefix) <= len(l) && l[lead:lead+len(prefix)] == prefix {
-				e.lines[i] = l[:lead] + l[lead+len(prefix):]
+				e.setLine(i, l[:lead]+l[lead+len(prefix):])
 			}
 		}
 	} else {
 		for i := lo; i <= hi; i++ {
-			l := e.lines[i]
+			l := e.buf.Line(i)
 			lead := 0
 			for lead < len(l) && (l[lead] == ' ' || l[lead] == '\t') {
 				lead++
@@ -643,7 +630,7 @@ func (e *Editor) toggleCommentSelection() {
 			if lead+len(prefix) <= len(l) && l[lead:lead+len(prefix)] == prefix {
 				continue
 			}
-			e.lines[i] = l[:lead] + prefix + l[lead:]
+			e.setLine(i, l[:lead]+prefix+l[lead:])
 		}
 	}
 	e.dirty = true
@@ -653,22 +640,23 @@ func (e *Editor) toggleCommentSelection() {
 
 func (e *Editor) toggleCommentLine() {
 	lineIdx := e.cy
-	if lineIdx < 0 || lineIdx >= len(e.lines) {
+	if lineIdx < 0 || lineIdx >= e.buf.LineCount() {
 		return
 	}
-	line := e.lines[lineIdx]
+	line := e.buf.Line(lineIdx)
 	prefix, ok := getLineCommentPrefix(e.language)
 	if !ok || prefix == "" {
 		return
 	}
+	e.pushUndo()
 	lead := 0
 	for lead < len(line) && (line[lead] == ' ' || line[lead] == '\t') {
 		lead++
 	}
 	if len(line) >= lead+len(prefix) && line[lead:lead+len(prefix)] == prefix {
-		e.lines[lineIdx] = line[:lead] + line[lead+len(prefix):]
+		e.setLine(lineIdx, line[:lead]+line[lead+len(prefix):])
 	} else {
-		e.lines[lineIdx] = line[:lead] + prefix + line[lead:]
+		e.setLine(lineIdx, line[:lead]+prefix+line[lead:])
 	}
 	e.dirty = true
 	e.ensureVisible()
@@ -693,6 +681,7 @@ func NewExitManager(editor *Editor) *ExitManager {
 		editor:         editor,
 		canvasesToSave: make([]int, 0),
 		currentPrompt:  0,
+		discarded:      make(map[int]bool),
 	}
 }
 
@@ -716,9 +705,8 @@ func (e *Editor) openProjectFile(filename string) {
 // openOrCreateCanvasForFile находит существующий канвас или создает новый для файла
 func (e *Editor) openOrCreateCanvasForFile(fullPath string) {
 	for canvasNum, canvas := range e.canvases {
-		if canvas.filename == fullPath {
-			e.currentCanvas = canvasNum
-			e.syncCanvasToEditor()
+		if canvas.kind == CanvasFile && samePath(canvas.filename, fullPath) {
+			e.switchToCanvas(canvasNum)
 			e.statusMessage("Switched to canvas " + strconv.Itoa(canvasNum) + ": " + filepath.Base(fullPath))
 			return
 		}
@@ -745,24 +733,24 @@ func (e *Editor) openOrCreateCanvasForFile(fullPath string) {
 		return
 	}
 
-	content := string(data)
-	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content, format := decodeText(data)
 
 	canvas := &Canvas{
 		filename: fullPath,
-		lines:    strings.Split(content, "\n"),
+		buf:      NewTextBuffer(content),
+		format:   format,
 		cx:       0,
 		cy:       0,
 		offsetX:  0,
 		offsetY:  0,
 		dirty:    false,
 		language: detectLanguage(fullPath),
+		disk:     diskStateOf(fullPath, data),
 	}
+	canvas.restoreUndoHistory()
 
 	e.canvases[newCanvasNum] = canvas
-	e.currentCanvas = newCanvasNum
-	e.syncCanvasToEditor()
-	e.ensureVisible()
+	e.switchToCanvas(newCanvasNum)
 
 	e.statusMessage("Created canvas " + strconv.Itoa(newCanvasNum) + " for " + filepath.Base(fullPath))
 }
@@ -789,13 +777,16 @@ func (em *ExitManager) promptForCanvasSave(canvasNum int) {
 		func(input string) {
 			switch strings.ToLower(strings.TrimSpace(input)) {
 			case "y", "yes", "д", "да":
-				em.saveCanvas(canvasNum)
-				em.processNextCanvas()
+				em.saveCanvas(canvasNum, em.processNextCanvas)
 			case "n", "no", "н", "нет":
+				em.discarded[canvasNum] = true
 				em.processNextCanvas()
 			case "a", "all", "в", "все":
-				em.saveAllRemainingCanvases()
-				em.finishExit()
+				if em.saveAllRemainingCanvases() {
+					em.finishExit()
+				} else {
+					em.cancelExit()
+				}
 			case "c", "cancel", "о", "отмена":
 				em.cancelExit()
 			default:
@@ -804,8 +795,10 @@ func (em *ExitManager) promptForCanvasSave(canvasNum int) {
 		})
 }
 
-// saveCanvas сохраняет указанный канвас.
-func (em *ExitManager) saveCanvas(canvasNum int) {
+// saveCanvas saves canvas canvasNum and then calls next, also after the
+// "Save as" prompt.
+// saveCanvas сохраняет указанный канвас и затем вызывает next.
+func (em *ExitManager) saveCanvas(canvasNum int, next func()) {
 	oldCanvas := em.editor.currentCanvas
 	em.editor.currentCanvas = canvasNum
 	em.editor.syncCanvasToEditor()
@@ -821,20 +814,34 @@ func (em *ExitManager) saveCanvas(canvasNum int) {
 			}
 			em.editor.currentCanvas = oldCanvas
 			em.editor.syncCanvasToEditor()
+			next()
 		})
 	} else {
-		if err := em.editor.persist(); err == nil {
+		err := em.editor.persist()
+		if errors.Is(err, errChangedOnDisk) {
+			restore := func() {
+				em.editor.currentCanvas = oldCanvas
+				em.editor.syncCanvasToEditor()
+			}
+			em.editor.confirmOverwrite(func() { restore(); next() }, func() { restore(); em.cancelExit() })
+			return
+		}
+		if err == nil {
 			em.editor.syncEditorToCanvas()
 			em.editor.statusMessage(fmt.Sprintf("Canvas %d saved", canvasNum))
 		}
 		em.editor.currentCanvas = oldCanvas
 		em.editor.syncCanvasToEditor()
+		next()
 	}
 }
 
+// saveAllRemainingCanvases saves all remaining canvases. It reports false if
+// a file that changed on disk was left unsaved.
 // saveAllRemainingCanvases сохраняет все оставшиеся канвасы.
-func (em *ExitManager) saveAllRemainingCanvases() {
+func (em *ExitManager) saveAllRemainingCanvases() bool {
 	oldCanvas := em.editor.currentCanvas
+	ok := true
 
 	for i := em.currentPrompt; i < len(em.canvasesToSave); i++ {
 		canvasNum := em.canvasesToSave[i]
@@ -842,14 +849,18 @@ func (em *ExitManager) saveAllRemainingCanvases() {
 		em.editor.syncCanvasToEditor()
 
 		if em.editor.filename != "" {
-			if err := em.editor.persist(); err == nil {
+			err := em.editor.persist()
+			if err == nil {
 				em.editor.syncEditorToCanvas()
 				em.editor.statusMessage(fmt.Sprintf("Canvas %d saved", canvasNum))
+			} else if errors.Is(err, errChangedOnDisk) {
+				ok = false
 			}
 		}
 	}
 	em.editor.currentCanvas = oldCanvas
 	em.editor.syncCanvasToEditor()
+	return ok
 }
 
 // processNextCanvas обрабатывает следующий канвас, требующий сохранения.
@@ -862,14 +873,31 @@ func (em *ExitManager) processNextCanvas() {
 	}
 }
 
+// finishExit completes the exit. When closing canvases, it closes those
+// that are saved or were discarded.
 // finishExit завершает процесс выхода.
 func (em *ExitManager) finishExit() {
-	em.editor.quit = true
+	if !em.closeMode {
+		em.editor.quit = true
+		return
+	}
+	closed := 0
+	for _, num := range em.closing {
+		if c, ok := em.editor.canvases[num]; ok && (!c.hasUnsavedChanges() || em.discarded[num]) {
+			em.editor.removeCanvas(num)
+			closed++
+		}
+	}
+	em.editor.statusMessage(fmt.Sprintf("Closed %d canvas(es)", closed))
 }
 
 // cancelExit отменяет процесс выхода.
 func (em *ExitManager) cancelExit() {
 	em.editor.prompt = nil
+	if em.closeMode {
+		em.editor.statusMessage("Close cancelled")
+		return
+	}
 	em.editor.statusMessage("Exit cancelled")
 }
 
@@ -891,26 +919,32 @@ func (e *Editor) statusBar() (string, string, string) {
 	}
 
 	name := e.filename
-	if name == "" {
-		name = "[new file]"
+	if c, ok := e.canvases[e.currentCanvas]; ok && (name == "" || c.kind != CanvasFile) {
+		name = c.getDisplayName()
 	}
 	langInfo := ""
 	if e.language != LangUnknown {
 		langInfo = " [" + string(e.language) + "]"
 	}
-	totalLines := len(e.lines)
+	if c, ok := e.canvases[e.currentCanvas]; ok && c.kind == CanvasFile && e.filename != "" {
+		langInfo += " [" + e.format.String() + "]"
+	}
+	totalLines := e.buf.LineCount()
 
 	selectedTokens := 0
 	if e.selecting {
 		selectedTokens = e.countSelectedTokens()
 	}
-	center := fmt.Sprintf("%s%s  Ln %d/%d, Col %d%s", name, langInfo, e.cy+1, totalLines, e.cx+1)
+	var center string
 	if selectedTokens > 0 {
 		center = fmt.Sprintf("%s%s  Ln %d/%d, Col %d Toc %d", name, langInfo, e.cy+1, totalLines, e.cx+1,
 			selectedTokens)
 	} else {
 		center = fmt.Sprintf("%s%s  Ln %d/%d, Col %d", name, langInfo, e.cy+1, totalLines, e.cx+1)
 	}
+	if info := e.searchStatus(); info != "" {
+		center += "  [" + info + "]"
+	}
 	lineRunes := make([]rune, e.contentWidth)
 	for i := range lineRunes {
 		lineRunes[i] = ' '
@@ -959,40 +993,13 @@ func (e *Editor) pasteFromClipboard() {
 	text = strings.ReplaceAll(text, "\r\n", "\n")
 	text = strings.ReplaceAll(text, "\r", "\n")
 
-	pasteLines := strings.Split(text, "\n")
-	if len(pasteLines) == 0 {
+	if text == "" {
 		return
 	}
 	e.pushUndo()
-
-	currentLine := e.lines[e.cy]
-	lineRunes := []rune(currentLine)
-	cursorX := e.cx
-	if cursorX > len(lineRunes) {
-		cursorX = len(lineRunes)
-	}
-
-	leftPart := string(lineRunes[:cursorX])
-	rightPart := string(lineRunes[cursorX:])
-
-	if len(pasteLines) == 1 {
-		e.lines[e.cy] = leftPart + pasteLines[0] + rightPart
-		e.cx = cursorX + len([]rune(pasteLines[0]))
-	} else {
-		e.lines[e.cy] = leftPart + pasteLines[0]
-		insertIndex := e.cy + 1
-		for i := 1; i < len(pasteLines)-1; i++ {
-			e.lines = append(e.lines[:insertIndex], append([]string{pasteLines[i]}, e.lines[insertIndex:]...)...)
-			insertIndex++
-		}
-		lastPastedLine := pasteLines[len(pasteLines)-1]
-		e.lines = append(e.lines[:insertIndex], append([]string{lastPastedLine + rightPart}, e.lines[insertIndex:]...)...)
-		e.cy = insertIndex
-		e.cx = len([]rune(lastPastedLine))
-	}
+	e.cy, e.cx = e.insertText(e.cy, e.cx, text)
 
 	e.dirty = true
-	e.redoStack = nil
 	e.ensureVisible()
 }
 
@@ -1081,6 +1088,9 @@ func (e *Editor) handleTerminalInput(ev *tcell.EventKey) {
 // handlePromptInput handles input for the prompt.
 // handlePromptInput обрабатывает ввод для запроса.
 func (e *Editor) handlePromptInput(ev *tcell.EventKey) {
+	if e.prompt != nil && e.prompt.OnKey != nil && e.prompt.OnKey(ev) {
+		return
+	}
 	if ev.Key() == tcell.KeyCtrlV {
 		if text, err := clipboard.ReadAll(); err == nil {
 			text = strings.ReplaceAll(text, "\r\n", "\n")
@@ -1154,25 +1164,18 @@ func (e *Editor) statusMessage(msg string) {
 // cutLine cuts the current line and copies it to the clipboard.
 // cutLine вырезает текущую строку и копирует её в буфер обмена.
 func (e *Editor) cutLine() {
-	if e.cy >= 0 && e.cy < len(e.lines) {
+	if e.cy >= 0 && e.cy < e.buf.LineCount() {
 		e.pushUndo()
-		e.clipboard = e.lines[e.cy]
+		e.clipboard = e.buf.Line(e.cy)
 		if err := clipboard.WriteAll(e.clipboard); err != nil {
 			e.statusMessage("Copy error clipboard: " + err.Error())
 		}
-		e.lines = append(e.lines[:e.cy], e.lines[e.cy+1:]...)
-		if e.cy >= len(e.lines) && len(e.lines) > 0 {
-			e.cy = len(e.lines) - 1
+		e.deleteLines(e.cy, e.cy+1)
+		if e.cy >= e.buf.LineCount() {
+			e.cy = e.buf.LineCount() - 1
 		}
-		if len(e.lines) == 0 {
-			e.lines = []string{""}
-			e.cy = 0
-			e.cx = 0
-		} else {
-			lineRunes := []rune(e.lines[e.cy])
-			if e.cx > len(lineRunes) {
-				e.cx = len(lineRunes)
-			}
+		if n := e.buf.LineLen(e.cy); e.cx > n {
+			e.cx = n
 		}
 		e.dirty = true
 		e.ensureVisible()
@@ -1194,18 +1197,22 @@ func (e *Editor) openFile(path string) {
 		e.showError("Unable to open the file: " + err.Error())
 		return
 	}
-	content := string(data)
-	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content, format := decodeText(data)
 	e.filename = path
-	e.lines = strings.Split(content, "\n")
+	e.buf = NewTextBuffer(content)
+	e.format = format
 	e.language = detectLanguage(path)
 	e.cx, e.cy = 0, 0
-	e.offsetX, e.offsetY = 0, 0
+	e.offsetX, e.offsetY, e.offsetSeg = 0, 0, 0
 	e.dirty = false
-	e.undoStack = nil
-	e.redoStack = nil
+	e.history = loadUndoHistory(path, e.buf.String())
+	e.undoOpen = false
 	e.ensureVisible()
 	e.syncEditorToCanvas()
+	if c, ok := e.canvases[e.currentCanvas]; ok {
+		c.disk, c.conflictHash = diskStateOf(path, data), ""
+	}
+	e.noteRecentFile(path)
 }
 
 // promptShow shows a prompt to the user.
@@ -1243,14 +1250,29 @@ func (e *Editor) save() error {
 		return nil
 	}
 	err := e.persist()
+	if errors.Is(err, errChangedOnDisk) {
+		e.confirmOverwrite(nil, nil)
+		return nil
+	}
 	if err == nil {
 		e.syncEditorToCanvas()
 	}
 	return err
 }
 
-// persist writes the content to the file with GitHub project support
+// persist writes the content to the file with GitHub project support. It
+// refuses to overwrite a file that changed on disk since it was loaded.
 func (e *Editor) persist() error {
+	if e.changedOnDisk() {
+		e.showError(filepath.Base(e.filename) + " changed on disk since it was loaded; not saved")
+		return errChangedOnDisk
+	}
+	return e.persistAnyway()
+}
+
+// persistAnyway writes the content to the file even if it changed on disk.
+func (e *Editor) persistAnyway() error {
+	path := e.filename
 	if e.githubProject != nil && e.filename != "" {
 		absPath := e.filename
 		if !filepath.IsAbs(absPath) {
@@ -1266,21 +1288,26 @@ func (e *Editor) persist() error {
 			return fmt.Errorf("failed to create directory: %w", err)
 		}
 
-		content := strings.Join(e.lines, "\n")
-		err := os.WriteFile(absPath, []byte(content), 0644)
-		if err != nil {
-			e.showError("Unable to save the file: " + err.Error())
-			return err
-		}
-	} else {
-		content := strings.Join(e.lines, "\n")
-		err := os.WriteFile(e.filename, []byte(content), 0644)
-		if err != nil {
-			e.showError("Unable to save the file: " + err.Error())
-			return err
-		}
+		path = absPath
+	}
+
+	content := e.buf.String()
+	data, err := e.format.encode(content)
+	if err != nil {
+		e.showError("Unable to save the file: " + err.Error() + "; Alt-M can convert it to UTF-8")
+		return err
+	}
+	_, statErr := os.Stat(path)
+	if err := writeFileAtomic(path, data, e.backupMode); err != nil {
+		e.showError("Unable to save the file: " + err.Error())
+		return err
 	}
+	e.noteFileWritten(path, os.IsNotExist(statErr))
+	saveUndoHistory(path, content, e.history)
 
+	if c, ok := e.canvases[e.currentCanvas]; ok {
+		c.disk, c.conflictHash = diskStateOf(path, data), ""
+	}
 	e.dirty = false
 	return nil
 }
@@ -1289,21 +1316,18 @@ func (e *Editor) persist() error {
 // backspace удаляет символ перед курсором.
 func (e *Editor) backspace() {
 	if e.cx > 0 {
-		e.pushUndo()
-		lineRunes := []rune(e.lines[e.cy])
-		lineRunes = append(lineRunes[:e.cx-1], lineRunes[e.cx:]...)
-		e.lines[e.cy] = string(lineRunes)
+		r := []rune(e.buf.Line(e.cy))[e.cx-1]
+		e.beginTyping(typingDelete, r)
+		e.deleteRange(e.cy, e.cx-1, e.cy, e.cx)
 		e.cx--
+		e.endTyping()
 		e.dirty = true
 	} else if e.cy > 0 {
 		e.pushUndo()
-		prev := e.lines[e.cy-1]
-		cur := e.lines[e.cy]
-		merged := prev + cur
-		e.lines[e.cy-1] = merged
-		e.lines = append(e.lines[:e.cy], e.lines[e.cy+1:]...)
+		prevLen := e.buf.LineLen(e.cy - 1)
+		e.deleteRange(e.cy-1, prevLen, e.cy, 0)
 		e.cy--
-		e.cx = len([]rune(prev))
+		e.cx = prevLen
 		e.dirty = true
 	}
 }
@@ -1312,13 +1336,7 @@ func (e *Editor) backspace() {
 // newline вставляет новую строку в текущей позиции курсора.
 func (e *Editor) newline() {
 	e.pushUndo()
-	lineRunes := []rune(e.lines[e.cy])
-	left := string(lineRunes[:e.cx])
-	right := string(lineRunes[e.cx:])
-	e.lines[e.cy] = left
-	e.lines = append(e.lines[:e.cy+1], append([]string{right}, e.lines[e.cy+1:]...)...)
-	e.cy++
-	e.cx = 0
+	e.cy, e.cx = e.insertText(e.cy, e.cx, "\n")
 	e.dirty = true
 }
 
@@ -1343,7 +1361,7 @@ func (e *Editor) handleMultiLinePromptInput(ev *tcell.EventKey) {
 			}
 			return
 		}
-		if e.prompt != nil && e.prompt.Label == "Search" {
+		if e.prompt != nil && strings.HasPrefix(e.prompt.Label, "Search") {
 			if text, err := clipboard.ReadAll(); err == nil {
 				text = strings.ReplaceAll(text, "\r\n", "\n")
 				text = strings.ReplaceAll(text, "\r", "\n")
@@ -1440,8 +1458,34 @@ func (e *Editor) Run() error {
 		return err
 	}
 	defer s.Fini()
+	defer func() {
+		// Keep the unsaved canvases if the editor crashes; this runs before
+		// the screen is restored.
+		if r := recover(); r != nil {
+			e.writeSwaps()
+			panic(r)
+		}
+	}()
 	e.screen = s
 	e.refreshSize()
+
+	ticker := time.NewTicker(watchInterval)
+	done := make(chan struct{})
+	defer func() {
+		ticker.Stop()
+		close(done)
+	}()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s.PostEvent(tcell.NewEventInterrupt(nil))
+			case <-done:
+				return
+			}
+		}
+	}()
+
 	for !e.quit {
 		e.render()
 		ev := s.PollEvent()
@@ -1450,8 +1494,18 @@ func (e *Editor) Run() error {
 			e.handleKey(tev)
 		case *tcell.EventResize:
 			e.refreshSize()
+		case *tcell.EventInterrupt:
+			e.checkDiskChanges()
+			e.checkFileIndex()
+			if time.Since(e.lastSwap) >= swapInterval {
+				e.writeSwaps()
+				e.lastSwap = time.Now()
+			}
 		}
 	}
+	// A session that cannot be saved must not keep the editor from quitting.
+	e.saveSession()
+	e.removeSwaps()
 	return nil
 }
 
@@ -1462,6 +1516,10 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.handleTerminalInput(ev)
 		return
 	}
+	if e.listPopup != nil {
+		e.handleListPopupInput(ev)
+		return
+	}
 	if e.multiLinePrompt != nil {
 		e.handleMultiLinePromptInput(ev)
 		return
@@ -1470,6 +1528,12 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.handlePromptInput(ev)
 		return
 	}
+	if e.handleReplacePreviewKey(ev) {
+		return
+	}
+	if e.handleTreeKey(ev) {
+		return
+	}
 	shiftPressed := ev.Modifiers()&tcell.ModShift != 0
 
 	if ev.Rune() == '\t' || ev.Key() == tcell.KeyTab {
@@ -1497,6 +1561,10 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.insertRune('\t')
 		return
 	}
+	if ev.Key() == tcell.KeyRune && ev.Modifiers()&tcell.ModAlt != 0 {
+		e.handleAltKey(ev.Rune())
+		return
+	}
 	if ev.Key() == tcell.KeyCtrlB {
 		e.switchToNextCanvas()
 		e.ctrlAState = false
@@ -1539,7 +1607,7 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		if hasSelection {
 			sourceText = selectedText
 		} else {
-			sourceText = e.lines[e.cy]
+			sourceText = e.buf.Line(e.cy)
 		}
 		e.promptShow("Translate to language", func(input string) {
 			defaultLang := detectSystemLanguage()
@@ -1559,6 +1627,8 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 				e.statusMessage("Translation is empty")
 				return
 			}
+			e.beginUndoGroup()
+			defer e.endUndoGroup()
 			if hasSelection {
 				e.deleteSelection()
 			}
@@ -1619,13 +1689,13 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 			e.selectStartX = 0
 			e.selectStartY = 0
 			// e.startLineSelection()
-			e.cy = len(e.lines) - 1
+			e.cy = e.buf.LineCount() - 1
 			if e.cy < 0 {
 				e.cy = 0
 			}
 			lastLine := ""
-			if len(e.lines) > 0 {
-				lastLine = e.lines[e.cy]
+			if e.buf.LineCount() > 0 {
+				lastLine = e.buf.Line(e.cy)
 			}
 			e.cx = len([]rune(lastLine))
 			e.ensureVisible()
@@ -1651,31 +1721,15 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.ctrlLState = false
 		e.handleExitWithCanvasCheck()
 	case tcell.KeyCtrlF:
-		e.promptShowWithInitial("Search", e.lastSearch, func(input string) {
-			trimmed := strings.TrimSpace(input)
-			if trimmed == "" {
-				e.lastSearch = input
-				return
-			}
-			if strings.Contains(trimmed, " -> ") {
-				parts := strings.SplitN(trimmed, " -> ", 2)
-				if len(parts) == 2 {
-					old := parts[0]
-					newS := parts[1]
-					replaced := e.replaceAllOccurrences(old, newS)
-					e.statusMessage(fmt.Sprintf("Replaced %d occurrence(s) of %q with %q", replaced, old, newS))
-					e.prompt = nil
-					return
-				}
-			}
-
-			e.findAndJump(input)
-			if strings.TrimSpace(input) != "" {
-				e.lastSearch = input
-			}
-		})
+		e.showSearchPrompt()
 		e.ctrlAState = false
 		e.ctrlLState = false
+	case tcell.KeyF3:
+		if ev.Modifiers()&tcell.ModShift != 0 {
+			e.jumpToMatch(-1)
+		} else {
+			e.jumpToMatch(1)
+		}
 	case tcell.KeyCtrlL:
 		e.llmPromptWithPrevShow()
 	case tcell.KeyCtrlG:
@@ -1688,8 +1742,8 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 			if line < 0 {
 				line = 0
 			}
-			if line >= len(e.lines) {
-				line = len(e.lines) - 1
+			if line >= e.buf.LineCount() {
+				line = e.buf.LineCount() - 1
 			}
 			e.cy = line
 			e.cx = 0
@@ -1726,6 +1780,13 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.ctrlAState = false
 		e.ctrlLState = false
 	case tcell.KeyCtrlO:
+		if root := e.projectRoot(); root != "" {
+			e.showFileFinder(root)
+			e.ctrlAState = false
+			e.ctrlLState = false
+			e.endSelection()
+			return
+		}
 		e.promptShow("Open file (path)", func(input string) {
 			p := strings.TrimSpace(input)
 			if p != "" {
@@ -1753,7 +1814,7 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 				}
 			}
 		} else {
-			curLine := e.lines[e.cy]
+			curLine := e.buf.Line(e.cy)
 			if curLine != "" {
 				e.clipboard = curLine
 				if err := clipboard.WriteAll(curLine); err != nil {
@@ -1766,17 +1827,19 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.ctrlAState = false
 		e.ctrlLState = false
 	case tcell.KeyCtrlV:
+		e.beginUndoGroup()
 		if e.selecting {
 			e.deleteSelection()
 		}
 		e.pasteFromClipboard()
+		e.endUndoGroup()
 		e.ctrlAState = false
 		e.ctrlLState = false
 
 	case tcell.KeyUp:
 		if e.cy > 0 {
 			e.cy--
-			curRunes := []rune(e.lines[e.cy])
+			curRunes := []rune(e.buf.Line(e.cy))
 			if e.cx > len(curRunes) {
 				e.cx = len(curRunes)
 			}
@@ -1785,9 +1848,9 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.ctrlAState = false
 		e.ctrlLState = false
 	case tcell.KeyDown:
-		if e.cy < len(e.lines)-1 {
+		if e.cy < e.buf.LineCount()-1 {
 			e.cy++
-			curRunes := []rune(e.lines[e.cy])
+			curRunes := []rune(e.buf.Line(e.cy))
 			if e.cx > len(curRunes) {
 				e.cx = len(curRunes)
 			}
@@ -1810,7 +1873,7 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 				e.endSelection()
 			}
 			e.cy--
-			prevRunes := []rune(e.lines[e.cy])
+			prevRunes := []rune(e.buf.Line(e.cy))
 			e.cx = len(prevRunes)
 			e.ensureVisible()
 		} else if e.selecting {
@@ -1819,7 +1882,7 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		e.ctrlAState = false
 		e.ctrlLState = false
 	case tcell.KeyRight:
-		lineRunes := []rune(e.lines[e.cy])
+		lineRunes := []rune(e.buf.Line(e.cy))
 		lineLen := len(lineRunes)
 		if e.cx < lineLen {
 			if shiftPressed {
@@ -1828,7 +1891,7 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 				e.endSelection()
 			}
 			e.cx++
-		} else if e.cy < len(e.lines)-1 {
+		} else if e.cy < e.buf.LineCount()-1 {
 			if shiftPressed {
 				e.startSelection()
 			} else if e.selecting {
@@ -1857,7 +1920,7 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		} else if e.selecting {
 			e.endSelection()
 		}
-		lineRunes := []rune(e.lines[e.cy])
+		lineRunes := []rune(e.buf.Line(e.cy))
 		e.cx = len(lineRunes)
 		e.ctrlAState = false
 		e.ctrlLState = false
@@ -1872,9 +1935,10 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		if e.offsetY < 0 {
 			e.offsetY = 0
 		}
+		e.offsetSeg = 0
 		e.cy = e.offsetY
-		if e.cy > len(e.lines)-1 {
-			e.cy = len(e.lines) - 1
+		if e.cy > e.buf.LineCount()-1 {
+			e.cy = e.buf.LineCount() - 1
 		}
 		e.ctrlAState = false
 		e.ctrlLState = false
@@ -1886,9 +1950,10 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		}
 		step := e.height - 1
 		e.offsetY += step
-		if e.offsetY > len(e.lines)-1 {
-			e.offsetY = len(e.lines) - 1
+		if e.offsetY > e.buf.LineCount()-1 {
+			e.offsetY = e.buf.LineCount() - 1
 		}
+		e.offsetSeg = 0
 		e.cy = e.offsetY
 		e.ctrlAState = false
 		e.ctrlLState = false
@@ -1901,10 +1966,17 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 				cb(val)
 			}
 		}
+		if e.openResultAtCursor() {
+			e.ctrlAState = false
+			e.ctrlLState = false
+			return
+		}
+		e.beginUndoGroup()
 		if e.selecting {
 			e.deleteSelection()
 		}
 		e.newline()
+		e.endUndoGroup()
 		e.ctrlAState = false
 		e.ctrlLState = false
 	case tcell.KeyBackspace, tcell.KeyBackspace2:
@@ -1942,6 +2014,9 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 		r := ev.Rune()
 		if r != 0 && (ev.Modifiers()&tcell.ModAlt) == 0 {
 			if e.selecting {
+				// Typing over a selection and its first character undo together.
+				e.beginUndoGroup()
+				defer e.endUndoGroup()
 				e.deleteSelection()
 			}
 			switch r {
@@ -1967,6 +2042,55 @@ func (e *Editor) handleKey(ev *tcell.EventKey) {
 	e.ensureVisible()
 }
 
+// handleAltKey handles Alt+letter commands.
+// handleAltKey обрабатывает команды Alt+буква.
+func (e *Editor) handleAltKey(r rune) {
+	switch unicode.ToLower(r) {
+	case 'h', 'р':
+		e.showUndoHistory()
+	case 'f', 'а':
+		e.showProjectSearchPrompt()
+	case 'n', 'т':
+		e.jumpToMatch(1)
+	case 'p', 'з':
+		e.jumpToMatch(-1)
+	case 'b', 'и':
+		e.showCanvasPicker()
+	case 'g', 'п':
+		e.showGoToCanvasPrompt()
+	case 'l', 'д':
+		e.switchToPreviousCanvas()
+	case 'w', 'ц':
+		e.closeCurrentCanvas()
+	case 'q', 'й':
+		e.closeSavedCanvases()
+	case 't', 'е':
+		e.toggleTabBar()
+	case 'v', 'м':
+		e.splitPane(true)
+	case 's', 'ы':
+		e.splitPane(false)
+	case 'o', 'щ':
+		e.focusNextPane()
+	case 'x', 'ч':
+		e.closePane()
+	case 'e', 'у':
+		e.toggleFileTree()
+	case 'm', 'ь':
+		e.showFormatPrompt()
+	case 'k', 'л':
+		e.showEncodingPrompt()
+	case '=', '+':
+		e.resizePane(paneResizeStep)
+	case '-':
+		e.resizePane(-paneResizeStep)
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		if !e.switchToCanvas(int(r - '0')) {
+			e.statusMessage("No canvas " + string(r))
+		}
+	}
+}
+
 // getSelectedText возвращает текст из текущего выделения.
 // При lineSelecting — возвращает полные строки.
 func (e *Editor) getSelectedText() string {
@@ -1981,39 +2105,39 @@ func (e *Editor) getSelectedText() string {
 		if startLine < 0 {
 			startLine = 0
 		}
-		if endLine >= len(e.lines) {
-			endLine = len(e.lines) - 1
+		if endLine >= e.buf.LineCount() {
+			endLine = e.buf.LineCount() - 1
 		}
 		if startLine > endLine {
 			startLine, endLine = endLine, startLine
 		}
 		for i := startLine; i <= endLine; i++ {
-			if i < len(e.lines) {
-				selectedLines = append(selectedLines, e.lines[i])
+			if i < e.buf.LineCount() {
+				selectedLines = append(selectedLines, e.buf.Line(i))
 			}
 		}
 	} else {
 		if startLine == endLine {
-			if startLine < len(e.lines) {
-				lineRunes := []rune(e.lines[startLine])
+			if startLine < e.buf.LineCount() {
+				lineRunes := []rune(e.buf.Line(startLine))
 				if startCol < endCol && endCol <= len(lineRunes) {
 					selectedLines = append(selectedLines, string(lineRunes[startCol:endCol]))
 				}
 			}
 		} else {
-			if startLine < len(e.lines) {
-				firstLineRunes := []rune(e.lines[startLine])
+			if startLine < e.buf.LineCount() {
+				firstLineRunes := []rune(e.buf.Line(startLine))
 				if startCol < len(firstLineRunes) {
 					selectedLines = append(selectedLines, string(firstLineRunes[startCol:]))
 				}
 			}
 			for i := startLine + 1; i < endLine; i++ {
-				if i < len(e.lines) {
-					selectedLines = append(selectedLines, e.lines[i])
+				if i < e.buf.LineCount() {
+					selectedLines = append(selectedLines, e.buf.Line(i))
 				}
 			}
-			if endLine < len(e.lines) {
-				lastLineRunes := []rune(e.lines[endLine])
+			if endLine < e.buf.LineCount() {
+				lastLineRunes := []rune(e.buf.Line(endLine))
 				if endCol > 0 && endCol <= len(lastLineRunes) {
 					selectedLines = append(selectedLines, string(lastLineRunes[:endCol]))
 				}
@@ -2035,81 +2159,42 @@ func (e *Editor) deleteSelection() {
 	if startLine < 0 {
 		startLine = 0
 	}
-	if endLine >= len(e.lines) {
-		endLine = len(e.lines) - 1
+	if endLine >= e.buf.LineCount() {
+		endLine = e.buf.LineCount() - 1
 	}
 	if startLine > endLine {
 		startLine, endLine = endLine, startLine
 	}
 
 	if e.lineSelecting {
-		e.lines = append(e.lines[:startLine], e.lines[endLine+1:]...)
+		e.deleteLines(startLine, endLine+1)
 		e.cy = startLine
-		if e.cy >= len(e.lines) {
-			e.cy = len(e.lines) - 1
-		}
-		if e.cy < 0 {
-			e.cy = 0
-			e.cx = 0
-		} else {
-			e.cx = 0
+		if e.cy >= e.buf.LineCount() {
+			e.cy = e.buf.LineCount() - 1
 		}
+		e.cx = 0
 	} else {
-		if startLine == endLine {
-			if startLine >= 0 && startLine < len(e.lines) {
-				lineRunes := []rune(e.lines[startLine])
-				if startCol < 0 {
-					startCol = 0
-				}
-				if endCol > len(lineRunes) {
-					endCol = len(lineRunes)
-				}
-				if startCol < endCol {
-					e.lines[startLine] = string(append(lineRunes[:startCol], lineRunes[endCol:]...))
-				}
-				e.cx = startCol
-				e.cy = startLine
-			}
-		} else {
-			if startLine >= 0 && startLine < len(e.lines) && endLine >= 0 && endLine < len(e.lines) {
-				firstLineRunes := []rune(e.lines[startLine])
-				lastLineRunes := []rune(e.lines[endLine])
-				if startCol < 0 {
-					startCol = 0
-				}
-				if endCol > len(lastLineRunes) {
-					endCol = len(lastLineRunes)
-				}
-				if startCol <= len(firstLineRunes) && endCol <= len(lastLineRunes) {
-					merged := string(append(firstLineRunes[:startCol], lastLineRunes[endCol:]...))
-					e.lines = append(e.lines[:startLine], append([]string{merged}, e.lines[endLine+1:]...)...)
-				}
-				e.cy = startLine
-				e.cx = startCol
-			}
+		if startCol < 0 {
+			startCol = 0
 		}
+		e.deleteRange(startLine, startCol, endLine, endCol)
+		e.cy = startLine
+		e.cx = startCol
 	}
 
 	e.endSelection()
 	e.dirty = true
-	e.redoStack = nil
 	if e.cy < 0 {
 		e.cy = 0
 	}
-	if e.cy >= len(e.lines) {
-		e.cy = len(e.lines) - 1
-		if e.cy < 0 {
-			e.cy = 0
-		}
+	if e.cy >= e.buf.LineCount() {
+		e.cy = e.buf.LineCount() - 1
 	}
 	if e.cx < 0 {
 		e.cx = 0
 	}
-	if e.cy < len(e.lines) {
-		lineRunes := []rune(e.lines[e.cy])
-		if e.cx > len(lineRunes) {
-			e.cx = len(lineRunes)
-		}
+	if n := e.buf.LineLen(e.cy); e.cx > n {
+		e.cx = n
 	}
 }
 
@@ -2180,8 +2265,6 @@ func (e *Editor) render() {
 	// }
 
 	e.screen.Clear()
-	display := e.buildDisplayBuffer()
-	total := len(display)
 	topLine, bottomLine1, bottomLine2 := e.statusBar()
 	if e.isLLMModeActive() {
 		bottomLine1 = ""
@@ -2233,266 +2316,9 @@ func (e *Editor) render() {
 		}
 		e.screen.SetContent(x, 0, ch, nil, tcell.StyleDefault.Background(tcell.ColorBlack).Foreground(tcell.ColorWhite))
 	}
-	contentRows := e.contentHeight - 3
-	if contentRows < 0 {
-		contentRows = 0
-	}
-
-	e.renderLineNumbers(display, contentRows)
-
-	var selStartLine, selStartCol, selEndLine, selEndCol int
-	if e.selecting {
-		selStartLine, selStartCol, selEndLine, selEndCol = e.getSelectionRange()
-	}
-
-	const tabWidth = 4
-
-	for i := 0; i < contentRows; i++ {
-		di := e.offsetY + i
-		if di >= total {
-			for x := e.lineNumbersWidth; x < e.contentWidth; x++ {
-				e.screen.SetContent(x, i+1, ' ', nil, styleDefault)
-			}
-			continue
-		}
-		row := display[di]
-		originalLineText := e.lines[row.lineIndex]
-		tokens := e.highlightLine(originalLineText, row.lineIndex)
-		needHighlight := (row.lineIndex == e.cy)
-		styleSelection := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorLightGray)
-		styleSelectionCurrentLine := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorLightGray)
-
-		xPos := e.lineNumbersWidth
-		tokenStartRuneIdx := 0
-
-		for _, token := range tokens {
-			tokenRunes := []rune(token.Text)
-			tokenLenRunes := len(tokenRunes)
-			tokenEndRuneIdx := tokenStartRuneIdx + tokenLenRunes
-			style := token.Style
-
-			if e.selecting && row.lineIndex >= selStartLine && row.lineIndex <= selEndLine {
-
-				tokenStartCol := tokenStartRuneIdx
-				tokenEndCol := tokenEndRuneIdx
-
-				lineSelStartCol := 0
-				lineSelEndCol := len([]rune(e.lines[row.lineIndex]))
-
-				if row.lineIndex == selStartLine {
-					lineSelStartCol = selStartCol
-				}
-				if row.lineIndex == selEndLine {
-					lineSelEndCol = selEndCol
-				}
-
-				if tokenStartCol < lineSelEndCol && tokenEndCol > lineSelStartCol {
-					if needHighlight {
-						style = styleSelectionCurrentLine
-					} else {
-						style = styleSelection
-					}
-					// Более сложная логика (например, частичное выделение токена)
-					// требует рисования символа за символом с разными стилями.
-					// Для простоты пока применяется стиль ко всему токену,
-					// если он пересекается с выделением.
-				}
-			}
-
-			if needHighlight && !e.selecting {
-				style = style.Background(tcell.ColorBlack)
-			}
-
-			segRunes := []rune(row.text)
-			for runeOffsetInToken := 0; runeOffsetInToken < tokenLenRunes; runeOffsetInToken++ {
-				originalRuneIdx := tokenStartRuneIdx + runeOffsetInToken
-				segStartRune := 0
-				wrappedLines := e.wrapLine(originalLineText)
-				for s := 0; s < row.segIndex; s++ {
-					segStartRune += len([]rune(wrappedLines[s]))
-				}
-				segEndRune := segStartRune + len([]rune(row.text))
-				if originalRuneIdx >= segStartRune && originalRuneIdx < segEndRune {
-					runeIdxInSeg := originalRuneIdx - segStartRune
-					if runeIdxInSeg >= 0 && runeIdxInSeg < len(segRunes) {
-						r := segRunes[runeIdxInSeg]
-						if r == '\t' {
-							rw := tabWidth - (xPos % tabWidth)
-							if xPos+rw > e.contentWidth {
-								break
-							}
-							for cellOffset := 0; cellOffset < rw; cellOffset++ {
-								e.screen.SetContent(xPos+cellOffset, i+1, ' ', nil, style)
-							}
-							xPos += rw
-						} else {
-							rw := 1
-							if runeIdxInSeg < len(row.widths) {
-								rw = row.widths[runeIdxInSeg]
-							} else {
-								rw = runewidth.RuneWidth(r)
-							}
-							if xPos+rw > e.contentWidth {
-								break
-							}
-							for cellOffset := 0; cellOffset < rw; cellOffset++ {
-								drawRune := r
-								if cellOffset > 0 {
-									drawRune = ' '
-								}
-								e.screen.SetContent(xPos+cellOffset, i+1, drawRune, nil, style)
-							}
-							xPos += rw
-						}
-					}
-				}
-				if xPos >= e.contentWidth {
-					break
-				}
-			}
-			tokenStartRuneIdx = tokenEndRuneIdx
-			if xPos >= e.contentWidth {
-				break
-			}
-		}
-
-		for x := xPos; x < e.contentWidth; x++ {
-			style := styleDefault
-			if e.selecting && row.lineIndex >= selStartLine && row.lineIndex <= selEndLine {
-				lineSelStartCol := 0
-				if row.lineIndex == selStartLine {
-					lineSelStartCol = selStartCol
-				}
-				if xPos >= lineSelStartCol && (row.lineIndex < selEndLine || xPos < selEndCol) {
-					if needHighlight {
-						style = styleSelectionCurrentLine
-					} else {
-						style = styleSelection
-					}
-				}
-			}
-			if needHighlight && !e.selecting {
-				style = styleDefault.Background(tcell.ColorBlack)
-			}
-			e.screen.SetContent(x, i+1, ' ', nil, style)
-		}
-	}
-
-	if e.bracketMatcher != nil {
-		matchingPair := e.bracketMatcher.getBracketAtCursor()
-		if matchingPair != nil {
-			openDisplayRow := 0
-			openSegIndex := 0
-			openCursorInSeg := 0
-
-			closeDisplayRow := 0
-			closeSegIndex := 0
-			closeCursorInSeg := 0
-			totalBefore := 0
-			for i := 0; i < matchingPair.OpenLine; i++ {
-				totalBefore += len(e.wrapLine(e.lines[i]))
-			}
-			segs := e.wrapLine(e.lines[matchingPair.OpenLine])
-			segmentStartRune := 0
-			for segIndex, seg := range segs {
-				segRunes := []rune(seg)
-				segEndRune := segmentStartRune + len(segRunes)
-				if matchingPair.OpenCol >= segmentStartRune && matchingPair.OpenCol <= segEndRune {
-					offsetInSegRunes := matchingPair.OpenCol - segmentStartRune
-					offsetInSegCells := 0
-					for i := 0; i < offsetInSegRunes; i++ {
-						r := segRunes[i]
-						if r == '\t' {
-							offsetInSegCells += 4 - (offsetInSegCells % 4)
-						} else {
-							offsetInSegCells += runewidth.RuneWidth(r)
-						}
-					}
-					openDisplayRow = totalBefore + segIndex
-					openSegIndex = segIndex
-					openCursorInSeg = offsetInSegCells
-					break
-				}
-				segmentStartRune = segEndRune
-			}
-
-			totalBefore = 0
-			for i := 0; i < matchingPair.CloseLine; i++ {
-				totalBefore += len(e.wrapLine(e.lines[i]))
-			}
-			segs = e.wrapLine(e.lines[matchingPair.CloseLine])
-			segmentStartRune = 0
-			for segIndex, seg := range segs {
-				segRunes := []rune(seg)
-				segEndRune := segmentStartRune + len(segRunes)
-				if matchingPair.CloseCol >= segmentStartRune && matchingPair.CloseCol <= segEndRune {
-					offsetInSegRunes := matchingPair.CloseCol - segmentStartRune
-					offsetInSegCells := 0
-					for i := 0; i < offsetInSegRunes; i++ {
-						r := segRunes[i]
-						if r == '\t' {
-							offsetInSegCells += 4 - (offsetInSegCells % 4)
-						} else {
-							offsetInSegCells += runewidth.RuneWidth(r)
-						}
-					}
-					closeDisplayRow = totalBefore + segIndex
-					closeSegIndex = segIndex
-					closeCursorInSeg = offsetInSegCells
-					break
-				}
-				segmentStartRune = segEndRune
-			}
-			openY := openDisplayRow - e.offsetY + 1
-			closeY := closeDisplayRow - e.offsetY + 1
-
-			if openY >= 1 && openY < e.contentHeight-3 {
-				for i := 0; i < contentRows; i++ {
-					di := e.offsetY + i
-					if di == openDisplayRow {
-						row := display[di]
-						if openSegIndex == row.segIndex {
-							bracketStyle := e.bracketMatcher.getBracketHighlightStyle()
-							if matchingPair.OpenLine < len(e.lines) {
-								lineRunes := []rune(e.lines[matchingPair.OpenLine])
-								if matchingPair.OpenCol < len(lineRunes) {
-									e.screen.SetContent(openCursorInSeg, openY, lineRunes[matchingPair.OpenCol], nil, bracketStyle)
-								}
-							}
-						}
-						break
-					}
-				}
-			}
-
-			if closeY >= 1 && closeY < e.contentHeight-3 {
-				for i := 0; i < contentRows; i++ {
-					di := e.offsetY + i
-					if di == closeDisplayRow {
-						row := display[di]
-						if closeSegIndex == row.segIndex {
-							bracketStyle := e.bracketMatcher.getBracketHighlightStyle()
-							if matchingPair.CloseLine < len(e.lines) {
-								lineRunes := []rune(e.lines[matchingPair.CloseLine])
-								if matchingPair.CloseCol < len(lineRunes) {
-									e.screen.SetContent(closeCursorInSeg, closeY, lineRunes[matchingPair.CloseCol], nil, bracketStyle)
-								}
-							}
-						}
-						break
-					}
-				}
-			}
-		}
-	}
-
-	curDisplayRow, _, cursorInSeg := e.cursorDisplayPosition()
-	cursorY := curDisplayRow - e.offsetY + 1
-	if cursorY >= 1 && cursorY < e.contentHeight-3 {
-		e.screen.ShowCursor(cursorInSeg, cursorY)
-	} else {
-		e.screen.HideCursor()
-	}
+	e.drawTabBar()
+	e.drawPanes()
+	e.drawFileTree()
 	if e.prompt != nil && e.contentHeight >= 3 {
 		promptLine := e.contentHeight - 3
 		plain := e.prompt.Label + ": " + e.prompt.Value
@@ -2637,7 +2463,7 @@ func (e *Editor) render() {
 			e.screen.SetContent(i, e.contentHeight-2, ' ', nil, tcell.StyleDefault.Background(tcell.ColorBlack).Foreground(tcell.ColorWhite))
 		}
 	}
-	e.drawStructurePanel(display, contentRows)
+	e.drawListPopup()
 	if !e.canvasWarningTime.IsZero() && time.Since(e.canvasWarningTime) < 3*time.Second {
 		warningMsg := "Maximum number of canvases: " + strconv.Itoa(MaxCanvases)
 		for i := 0; i < e.contentWidth; i++ {
@@ -2693,6 +2519,189 @@ func (e *Editor) render() {
 	e.screen.Show()
 }
 
+// drawTextArea draws the text of the current canvas with line numbers,
+// bracket highlighting, the cursor and the structure panel.
+// drawTextArea рисует текст текущего канваса с номерами строк, подсветкой
+// скобок, курсором и панелью структуры.
+func (e *Editor) drawTextArea() {
+	top := e.textTop()
+	contentRows := e.contentHeight - 3 - e.tabBarHeight
+	if contentRows < 0 {
+		contentRows = 0
+	}
+	display := e.buildDisplayBuffer(contentRows)
+	total := len(display)
+
+	e.renderLineNumbers(display, contentRows)
+
+	var selStartLine, selStartCol, selEndLine, selEndCol int
+	if e.selecting {
+		selStartLine, selStartCol, selEndLine, selEndCol = e.getSelectionRange()
+	}
+
+	const tabWidth = 4
+
+	for i := 0; i < contentRows; i++ {
+		di := i
+		if di >= total {
+			for x := e.lineNumbersWidth; x < e.contentWidth; x++ {
+				e.screen.SetContent(x, i+top, ' ', nil, styleDefault)
+			}
+			continue
+		}
+		row := display[di]
+		originalLineText := e.buf.Line(row.lineIndex)
+		tokens := e.highlightLine(originalLineText, row.lineIndex)
+		needHighlight := (row.lineIndex == e.cy)
+		styleSelection := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorLightGray)
+		styleSelectionCurrentLine := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorLightGray)
+
+		xPos := e.lineNumbersWidth
+		tokenStartRuneIdx := 0
+
+		for _, token := range tokens {
+			tokenRunes := []rune(token.Text)
+			tokenLenRunes := len(tokenRunes)
+			tokenEndRuneIdx := tokenStartRuneIdx + tokenLenRunes
+			style := token.Style
+
+			if e.selecting && row.lineIndex >= selStartLine && row.lineIndex <= selEndLine {
+
+				tokenStartCol := tokenStartRuneIdx
+				tokenEndCol := tokenEndRuneIdx
+
+				lineSelStartCol := 0
+				lineSelEndCol := e.buf.LineLen(row.lineIndex)
+
+				if row.lineIndex == selStartLine {
+					lineSelStartCol = selStartCol
+				}
+				if row.lineIndex == selEndLine {
+					lineSelEndCol = selEndCol
+				}
+
+				if tokenStartCol < lineSelEndCol && tokenEndCol > lineSelStartCol {
+					if needHighlight {
+						style = styleSelectionCurrentLine
+					} else {
+						style = styleSelection
+					}
+					// Более сложная логика (например, частичное выделение токена)
+					// требует рисования символа за символом с разными стилями.
+					// Для простоты пока применяется стиль ко всему токену,
+					// если он пересекается с выделением.
+				}
+			}
+
+			if needHighlight && !e.selecting {
+				style = style.Background(tcell.ColorBlack)
+			}
+
+			segRunes := []rune(row.text)
+			for runeOffsetInToken := 0; runeOffsetInToken < tokenLenRunes; runeOffsetInToken++ {
+				originalRuneIdx := tokenStartRuneIdx + runeOffsetInToken
+				segStartRune := row.start
+				segEndRune := segStartRune + len([]rune(row.text))
+				if originalRuneIdx >= segStartRune && originalRuneIdx < segEndRune {
+					runeIdxInSeg := originalRuneIdx - segStartRune
+					if runeIdxInSeg >= 0 && runeIdxInSeg < len(segRunes) {
+						r := segRunes[runeIdxInSeg]
+						cellStyle := e.matchStyleAt(row.lineIndex, originalRuneIdx, style)
+						if r == '\t' {
+							rw := tabWidth - (xPos % tabWidth)
+							if xPos+rw > e.contentWidth {
+								break
+							}
+							for cellOffset := 0; cellOffset < rw; cellOffset++ {
+								e.screen.SetContent(xPos+cellOffset, i+top, ' ', nil, cellStyle)
+							}
+							xPos += rw
+						} else {
+							rw := 1
+							if runeIdxInSeg < len(row.widths) {
+								rw = row.widths[runeIdxInSeg]
+							} else {
+								rw = runewidth.RuneWidth(r)
+							}
+							if xPos+rw > e.contentWidth {
+								break
+							}
+							for cellOffset := 0; cellOffset < rw; cellOffset++ {
+								drawRune := r
+								if cellOffset > 0 {
+									drawRune = ' '
+								}
+								e.screen.SetContent(xPos+cellOffset, i+top, drawRune, nil, cellStyle)
+							}
+							xPos += rw
+						}
+					}
+				}
+				if xPos >= e.contentWidth {
+					break
+				}
+			}
+			tokenStartRuneIdx = tokenEndRuneIdx
+			if xPos >= e.contentWidth {
+				break
+			}
+		}
+
+		for x := xPos; x < e.contentWidth; x++ {
+			style := styleDefault
+			if e.selecting && row.lineIndex >= selStartLine && row.lineIndex <= selEndLine {
+				lineSelStartCol := 0
+				if row.lineIndex == selStartLine {
+					lineSelStartCol = selStartCol
+				}
+				if xPos >= lineSelStartCol && (row.lineIndex < selEndLine || xPos < selEndCol) {
+					if needHighlight {
+						style = styleSelectionCurrentLine
+					} else {
+						style = styleSelection
+					}
+				}
+			}
+			if needHighlight && !e.selecting {
+				style = styleDefault.Background(tcell.ColorBlack)
+			}
+			e.screen.SetContent(x, i+top, ' ', nil, style)
+		}
+	}
+
+	if e.bracketMatcher != nil {
+		matchingPair := e.bracketMatcher.getBracketAtCursor()
+		if matchingPair != nil {
+			bracketStyle := e.bracketMatcher.getBracketHighlightStyle()
+			for _, pos := range [][2]int{
+				{matchingPair.OpenLine, matchingPair.OpenCol},
+				{matchingPair.CloseLine, matchingPair.CloseCol},
+			} {
+				if pos[0] >= e.buf.LineCount() {
+					continue
+				}
+				lineRunes := []rune(e.buf.Line(pos[0]))
+				if pos[1] >= len(lineRunes) {
+					continue
+				}
+				seg, cell := e.segmentPosition(pos[0], pos[1])
+				if row := e.displayRowOf(pos[0], seg); row >= 0 && row < contentRows && row+top < e.contentHeight-3 {
+					e.screen.SetContent(cell, row+top, lineRunes[pos[1]], nil, bracketStyle)
+				}
+			}
+		}
+	}
+
+	curDisplayRow, _, cursorInSeg := e.cursorDisplayPosition()
+	cursorY := curDisplayRow + top
+	if curDisplayRow >= 0 && cursorY < e.contentHeight-3 {
+		e.screen.ShowCursor(cursorInSeg, cursorY)
+	} else {
+		e.screen.HideCursor()
+	}
+	e.drawStructurePanel(display, contentRows)
+}
+
 func (e *Editor) startSelection() {
 	if !e.selecting {
 		e.selecting = true
@@ -2739,8 +2748,8 @@ func (e *Editor) getSelectionRange() (int, int, int, int) {
 
 		startCol := 0
 		endCol := 0
-		if endLine < len(e.lines) {
-			endCol = len([]rune(e.lines[endLine]))
+		if endLine < e.buf.LineCount() {
+			endCol = e.buf.LineLen(endLine)
 		}
 
 		return startLine, startCol, endLine, endCol
@@ -2762,14 +2771,14 @@ func (e *Editor) getSelectionRange() (int, int, int, int) {
 // buildStructureForLine — строит упрощённое представление строки как срез panelCell длиной width.
 func (e *Editor) buildStructureForLine(lineIdx int, width int) []panelCell {
 	res := make([]panelCell, width)
-	if width <= 0 || lineIdx < 0 || lineIdx >= len(e.lines) {
+	if width <= 0 || lineIdx < 0 || lineIdx >= e.buf.LineCount() {
 		for i := range res {
 			res[i] = panelCell{Ch: ' ', Style: styleDefault}
 		}
 		return res
 	}
 
-	line := e.lines[lineIdx]
+	line := e.buf.Line(lineIdx)
 	tokens := e.highlightLine(line, lineIdx)
 	tokenChars := make([]int, 0, len(tokens))
 	tokenStyles := make([]tcell.Style, 0, len(tokens))
@@ -2859,33 +2868,34 @@ func (e *Editor) buildStructureForLine(lineIdx int, width int) []panelCell {
 	return res
 }
 
-// drawStructurePanel — рисует правую панель как мини-карту всего буфера display.
+// drawStructurePanel — рисует правую панель как мини-карту всего текста;
+// display — видимые строки окна.
 func (e *Editor) drawStructurePanel(display []DisplayRow, contentRows int) {
 	if !e.showStructurePanel || e.structurePanelWidth <= 0 {
 		return
 	}
+	top := e.textTop()
 	panelStartX := e.contentWidth - e.structurePanelWidth
 	if panelStartX < 0 {
 		return
 	}
 	sepX := panelStartX - 1
 	if sepX >= 0 {
-		for y := 1; y <= contentRows; y++ {
+		for y := top; y < top+contentRows; y++ {
 			e.screen.SetContent(sepX, y, '│', nil, tcell.StyleDefault.Foreground(tcell.ColorGray))
 		}
 	}
 
-	totalDisplay := len(display)
-	if totalDisplay == 0 {
+	totalLines := e.buf.LineCount()
+	if len(display) == 0 {
 		for i := 0; i < contentRows; i++ {
 			for x := 0; x < e.structurePanelWidth; x++ {
-				e.screen.SetContent(panelStartX+x, i+1, ' ', nil, styleDefault)
+				e.screen.SetContent(panelStartX+x, i+top, ' ', nil, styleDefault)
 			}
 		}
 		return
 	}
-	curDisplayRow, _, _ := e.cursorDisplayPosition()
-	cursorPanelRow := int(math.Floor(float64(curDisplayRow) * float64(contentRows) / float64(totalDisplay)))
+	cursorPanelRow := int(math.Floor(float64(e.cy) * float64(contentRows) / float64(totalLines)))
 	if cursorPanelRow < 0 {
 		cursorPanelRow = 0
 	}
@@ -2894,9 +2904,9 @@ func (e *Editor) drawStructurePanel(display []DisplayRow, contentRows int) {
 	}
 
 	viewportStart := e.offsetY
-	viewportEnd := e.offsetY + contentRows - 1
-	viewportPanelStart := int(math.Floor(float64(viewportStart) * float64(contentRows) / float64(totalDisplay)))
-	viewportPanelEnd := int(math.Floor(float64(viewportEnd) * float64(contentRows) / float64(totalDisplay)))
+	viewportEnd := display[len(display)-1].lineIndex
+	viewportPanelStart := int(math.Floor(float64(viewportStart) * float64(contentRows) / float64(totalLines)))
+	viewportPanelEnd := int(math.Floor(float64(viewportEnd) * float64(contentRows) / float64(totalLines)))
 	if viewportPanelStart < 0 {
 		viewportPanelStart = 0
 	}
@@ -2908,20 +2918,19 @@ func (e *Editor) drawStructurePanel(display []DisplayRow, contentRows int) {
 	}
 
 	for panelRow := 0; panelRow < contentRows; panelRow++ {
-		mappedDi := int(math.Floor(float64(panelRow) * float64(totalDisplay) / float64(contentRows)))
-		if mappedDi < 0 {
-			mappedDi = 0
+		lineIdx := int(math.Floor(float64(panelRow) * float64(totalLines) / float64(contentRows)))
+		if lineIdx < 0 {
+			lineIdx = 0
 		}
-		if mappedDi >= totalDisplay {
-			mappedDi = totalDisplay - 1
+		if lineIdx >= totalLines {
+			lineIdx = totalLines - 1
 		}
 
-		lineIdx := display[mappedDi].lineIndex
 		cells := e.buildStructureForLine(lineIdx, e.structurePanelWidth)
 		invertCol := -1
 		if panelRow == cursorPanelRow {
-			if e.cy >= 0 && e.cy < len(e.lines) {
-				lineRunes := []rune(e.lines[e.cy])
+			if e.cy >= 0 && e.cy < e.buf.LineCount() {
+				lineRunes := []rune(e.buf.Line(e.cy))
 				totalChars := len(lineRunes)
 				if totalChars > 0 {
 					ratio := float64(e.cx) / float64(totalChars)
@@ -2944,9 +2953,9 @@ func (e *Editor) drawStructurePanel(display []DisplayRow, contentRows int) {
 			}
 			if x == invertCol && panelRow == cursorPanelRow {
 				inv := tcell.StyleDefault.Background(tcell.ColorWhite).Foreground(tcell.ColorBlack)
-				e.screen.SetContent(panelStartX+x, panelRow+1, ch, nil, inv)
+				e.screen.SetContent(panelStartX+x, panelRow+top, ch, nil, inv)
 			} else {
-				e.screen.SetContent(panelStartX+x, panelRow+1, ch, nil, st)
+				e.screen.SetContent(panelStartX+x, panelRow+top, ch, nil, st)
 			}
 		}
 	}
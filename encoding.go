@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// charset is the encoding of a file. Text in the buffer is always UTF-8;
+// the charset is used when the file is read and written.
+// charset — кодировка файла; в буфере текст всегда в UTF-8.
+type charset int
+
+const (
+	charsetUTF8 charset = iota
+	charsetCP1251
+	charsetKOI8R
+)
+
+func (cs charset) String() string {
+	switch cs {
+	case charsetCP1251:
+		return "Windows-1251"
+	case charsetKOI8R:
+		return "KOI8-R"
+	}
+	return "UTF-8"
+}
+
+// cp1251Table maps the bytes 0x80-0xFF of Windows-1251 to runes. The unused
+// byte 0x98 maps to U+0098 so that it survives a round trip.
+var cp1251Table = [128]rune{
+	0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+	0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x0098, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+	0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7,
+	0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+	0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7,
+	0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+	0x0410, 0x0411, 0x0412, 0x0413, 0x0414, 0x0415, 0x0416, 0x0417,
+	0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E, 0x041F,
+	0x0420, 0x0421, 0x0422, 0x0423, 0x0424, 0x0425, 0x0426, 0x0427,
+	0x0428, 0x0429, 0x042A, 0x042B, 0x042C, 0x042D, 0x042E, 0x042F,
+	0x0430, 0x0431, 0x0432, 0x0433, 0x0434, 0x0435, 0x0436, 0x0437,
+	0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E, 0x043F,
+	0x0440, 0x0441, 0x0442, 0x0443, 0x0444, 0x0445, 0x0446, 0x0447,
+	0x0448, 0x0449, 0x044A, 0x044B, 0x044C, 0x044D, 0x044E, 0x044F,
+}
+
+// koi8rTable maps the bytes 0x80-0xFF of KOI8-R to runes.
+var koi8rTable = [128]rune{
+	0x2500, 0x2502, 0x250C, 0x2510, 0x2514, 0x2518, 0x251C, 0x2524,
+	0x252C, 0x2534, 0x253C, 0x2580, 0x2584, 0x2588, 0x258C, 0x2590,
+	0x2591, 0x2592, 0x2593, 0x2320, 0x25A0, 0x2219, 0x221A, 0x2248,
+	0x2264, 0x2265, 0x00A0, 0x2321, 0x00B0, 0x00B2, 0x00B7, 0x00F7,
+	0x2550, 0x2551, 0x2552, 0x0451, 0x2553, 0x2554, 0x2555, 0x2556,
+	0x2557, 0x2558, 0x2559, 0x255A, 0x255B, 0x255C, 0x255D, 0x255E,
+	0x255F, 0x2560, 0x2561, 0x0401, 0x2562, 0x2563, 0x2564, 0x2565,
+	0x2566, 0x2567, 0x2568, 0x2569, 0x256A, 0x256B, 0x256C, 0x00A9,
+	0x044E, 0x0430, 0x0431, 0x0446, 0x0434, 0x0435, 0x0444, 0x0433,
+	0x0445, 0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E,
+	0x043F, 0x044F, 0x0440, 0x0441, 0x0442, 0x0443, 0x0436, 0x0432,
+	0x044C, 0x044B, 0x0437, 0x0448, 0x044D, 0x0449, 0x0447, 0x044A,
+	0x042E, 0x0410, 0x0411, 0x0426, 0x0414, 0x0415, 0x0424, 0x0413,
+	0x0425, 0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E,
+	0x041F, 0x042F, 0x0420, 0x0421, 0x0422, 0x0423, 0x0416, 0x0412,
+	0x042C, 0x042B, 0x0417, 0x0428, 0x042D, 0x0429, 0x0427, 0x042A,
+}
+
+// table returns the upper half of a single-byte charset, nil for UTF-8.
+func (cs charset) table() *[128]rune {
+	switch cs {
+	case charsetCP1251:
+		return &cp1251Table
+	case charsetKOI8R:
+		return &koi8rTable
+	}
+	return nil
+}
+
+// frequentLetters are the most common lowercase Russian letters; text read
+// in the wrong single-byte charset has few of them.
+const frequentLetters = "оеаинтсрвлкмдпу"
+
+// detectCharset guesses the encoding of data. Valid UTF-8 is taken as UTF-8;
+// otherwise the single-byte charset whose decoding has more common Russian
+// letters wins, Windows-1251 on a tie.
+// detectCharset определяет кодировку: UTF-8, Windows-1251 или KOI8-R.
+func detectCharset(data []byte) charset {
+	if utf8.Valid(data) {
+		return charsetUTF8
+	}
+	score := func(cs charset) int {
+		n := 0
+		for _, b := range data {
+			if b >= 0x80 && strings.ContainsRune(frequentLetters, cs.table()[b-0x80]) {
+				n++
+			}
+		}
+		return n
+	}
+	if score(charsetKOI8R) > score(charsetCP1251) {
+		return charsetKOI8R
+	}
+	return charsetCP1251
+}
+
+// decode returns data in charset cs as UTF-8 text.
+func (cs charset) decode(data []byte) string {
+	t := cs.table()
+	if t == nil {
+		return string(data)
+	}
+	var sb strings.Builder
+	sb.Grow(len(data))
+	for _, b := range data {
+		if b < 0x80 {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteRune(t[b-0x80])
+		}
+	}
+	return sb.String()
+}
+
+// encode returns text in charset cs. It fails on the first character the
+// charset has no byte for.
+func (cs charset) encode(text string) ([]byte, error) {
+	t := cs.table()
+	if t == nil {
+		return []byte(text), nil
+	}
+	bytes := make(map[rune]byte, len(t))
+	for i, r := range t {
+		bytes[r] = byte(0x80 + i)
+	}
+	out := make([]byte, 0, len(text))
+	line, col := 1, 1
+	for _, r := range text {
+		switch b, ok := bytes[r]; {
+		case r < 0x80:
+			out = append(out, byte(r))
+		case ok:
+			out = append(out, b)
+		default:
+			return nil, fmt.Errorf("%q at line %d, column %d cannot be written in %s", r, line, col, cs)
+		}
+		col++
+		if r == '\n' {
+			line, col = line+1, 1
+		}
+	}
+	return out, nil
+}
+
+// showEncodingPrompt reads the file of the current canvas again in an
+// encoding the user picks, for a file whose encoding was guessed wrong. The
+// file is saved in that encoding too. Reading it again is one undoable edit.
+// showEncodingPrompt перечитывает файл в выбранной кодировке.
+func (e *Editor) showEncodingPrompt() {
+	if c, ok := e.canvases[e.currentCanvas]; !ok || c.kind != CanvasFile || e.filename == "" {
+		e.statusMessage("Only canvases of files have an encoding")
+		return
+	}
+	if e.dirty {
+		e.showError("Save or undo the changes before reading the file in another encoding")
+		return
+	}
+	label := "Read " + filepath.Base(e.filename) + " (" + e.format.charset.String() + ") as: (u)tf-8 (w)indows-1251 (k)oi8-r"
+	e.promptShow(label, func(input string) {
+		var cs charset
+		switch strings.ToLower(strings.TrimSpace(input)) {
+		case "u", "г":
+			cs = charsetUTF8
+		case "w", "ц":
+			cs = charsetCP1251
+		case "k", "л":
+			cs = charsetKOI8R
+		default:
+			return
+		}
+		data, err := os.ReadFile(e.filename)
+		if err != nil {
+			e.showError("Unable to read the file: " + err.Error())
+			return
+		}
+		e.reloadCanvas(e.currentCanvas, data, cs)
+		e.statusMessage("Read " + filepath.Base(e.filename) + " as " + cs.String())
+	})
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// minTreeWidth is the narrowest file tree; below twice that much text room
+// the tree is not drawn.
+const minTreeWidth = 16
+
+// treeNode is a file or directory of the file tree. The children of a
+// directory are read when it is first expanded.
+type treeNode struct {
+	path     string
+	name     string
+	dir      bool
+	expanded bool
+	loaded   bool
+	depth    int
+	parent   *treeNode
+	children []*treeNode
+}
+
+// FileTree is the project sidebar: the root directory, the rows currently
+// visible and the selected row.
+// FileTree — боковая панель с деревом файлов проекта.
+type FileTree struct {
+	root     *treeNode
+	matcher  *projectMatcher
+	rows     []*treeNode
+	selected int
+	offset   int
+}
+
+// load reads the children of directory n, directories first, each group
+// sorted by name. Entries ignored by m are left out like in project walks.
+func (n *treeNode) load(m *projectMatcher) {
+	n.loaded = true
+	n.children = nil
+	entries, err := os.ReadDir(n.path)
+	if err != nil {
+		return
+	}
+	for _, en := range entries {
+		path := filepath.Join(n.path, en.Name())
+		if rel, err := filepath.Rel(m.root, path); err != nil || m.ignored(rel, en.IsDir()) {
+			continue
+		}
+		n.children = append(n.children, &treeNode{
+			path:   path,
+			name:   en.Name(),
+			dir:    en.IsDir(),
+			depth:  n.depth + 1,
+			parent: n,
+		})
+	}
+	sort.SliceStable(n.children, func(i, j int) bool {
+		a, b := n.children[i], n.children[j]
+		if a.dir != b.dir {
+			return a.dir
+		}
+		return strings.ToLower(a.name) < strings.ToLower(b.name)
+	})
+}
+
+// flatten rebuilds the visible rows from the expanded directories.
+func (t *FileTree) flatten() {
+	t.rows = t.rows[:0]
+	var walk func(n *treeNode)
+	walk = func(n *treeNode) {
+		for _, c := range n.children {
+			t.rows = append(t.rows, c)
+			if c.dir && c.expanded {
+				walk(c)
+			}
+		}
+	}
+	walk(t.root)
+	if t.selected >= len(t.rows) {
+		t.selected = len(t.rows) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+}
+
+// reload rereads the loaded directories from disk, keeping them expanded,
+// and selects path if it is visible.
+func (t *FileTree) reload(path string) {
+	expanded := make(map[string]bool)
+	var collect func(n *treeNode)
+	collect = func(n *treeNode) {
+		for _, c := range n.children {
+			if c.expanded {
+				expanded[c.path] = true
+				collect(c)
+			}
+		}
+	}
+	collect(t.root)
+
+	t.matcher = newProjectMatcher(t.root.path)
+	var restore func(n *treeNode)
+	restore = func(n *treeNode) {
+		n.load(t.matcher)
+		for _, c := range n.children {
+			if c.dir && expanded[c.path] {
+				c.expanded = true
+				restore(c)
+			}
+		}
+	}
+	restore(t.root)
+	t.flatten()
+	t.selectPath(path)
+}
+
+// selectPath selects the row of path, expanding the directories above it.
+func (t *FileTree) selectPath(path string) {
+	if path == "" {
+		return
+	}
+	rel, err := filepath.Rel(t.root.path, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	n := t.root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if !n.loaded {
+			n.load(t.matcher)
+		}
+		n.expanded = true
+		var next *treeNode
+		for _, c := range n.children {
+			if c.name == part {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		n = next
+	}
+	t.flatten()
+	for i, r := range t.rows {
+		if r == n {
+			t.selected = i
+			return
+		}
+	}
+}
+
+// current returns the selected node, or nil if the tree is empty.
+func (t *FileTree) current() *treeNode {
+	if t.selected < len(t.rows) {
+		return t.rows[t.selected]
+	}
+	return nil
+}
+
+// treeWidth returns the width of the file tree, or 0 if it is hidden or the
+// screen is too narrow for it.
+func (e *Editor) treeWidth() int {
+	if !e.showFileTree || e.fileTree == nil || e.contentWidth < 3*minTreeWidth {
+		return 0
+	}
+	return max(minTreeWidth, e.contentWidth/4)
+}
+
+// toggleFileTree shows the file tree and moves the focus to it; if the tree
+// already has the focus, it is hidden.
+// toggleFileTree показывает дерево файлов с фокусом или скрывает его.
+func (e *Editor) toggleFileTree() {
+	if e.showFileTree && e.treeFocus {
+		e.showFileTree, e.treeFocus = false, false
+		return
+	}
+	root := e.projectRoot()
+	if root == "" {
+		e.showError("The file tree needs a project directory")
+		return
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	if e.fileTree == nil || e.fileTree.root.path != root {
+		t := &FileTree{
+			root:    &treeNode{path: root, name: filepath.Base(root), dir: true, expanded: true},
+			matcher: newProjectMatcher(root),
+		}
+		t.root.load(t.matcher)
+		t.flatten()
+		e.fileTree = t
+	}
+	if e.filename != "" {
+		e.fileTree.selectPath(e.filename)
+	}
+	e.endSelection()
+	e.showFileTree, e.treeFocus = true, true
+}
+
+// handleTreeKey handles keys while the file tree has the focus. Alt keys and
+// the commands that do not edit the text are passed on. It reports whether
+// ev was consumed.
+// handleTreeKey обрабатывает клавиши, пока фокус в дереве файлов.
+func (e *Editor) handleTreeKey(ev *tcell.EventKey) bool {
+	if !e.treeFocus || !e.showFileTree {
+		return false
+	}
+	t := e.fileTree
+	rows := e.contentHeight - 3 - e.tabBarHeight
+	switch ev.Key() {
+	case tcell.KeyUp:
+		t.selected--
+	case tcell.KeyDown:
+		t.selected++
+	case tcell.KeyPgUp:
+		t.selected -= rows
+	case tcell.KeyPgDn:
+		t.selected += rows
+	case tcell.KeyHome:
+		t.selected = 0
+	case tcell.KeyEnd:
+		t.selected = len(t.rows) - 1
+	case tcell.KeyEnter:
+		e.openTreeNode()
+	case tcell.KeyRight:
+		if n := t.current(); n != nil && n.dir && !n.expanded {
+			e.openTreeNode()
+		}
+	case tcell.KeyLeft:
+		if n := t.current(); n != nil {
+			if n.dir && n.expanded {
+				n.expanded = false
+				t.flatten()
+			} else if n.parent != t.root {
+				t.selectPath(n.parent.path)
+			}
+		}
+	case tcell.KeyEscape:
+		e.treeFocus = false
+	case tcell.KeyDelete:
+		e.deleteTreeNode()
+	case tcell.KeyRune:
+		if ev.Modifiers()&tcell.ModAlt != 0 {
+			return false
+		}
+		switch ev.Rune() {
+		case 'n', 'a', 'т', 'ф':
+			e.createTreeNode()
+		case 'r', 'к':
+			e.renameTreeNode()
+		case 'd', 'в':
+			e.deleteTreeNode()
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2, tcell.KeyTab,
+		tcell.KeyCtrlX, tcell.KeyCtrlV, tcell.KeyCtrlK, tcell.KeyCtrlU, tcell.KeyCtrlY, tcell.KeyCtrlW,
+		tcell.KeyCtrlZ, tcell.KeyCtrlE:
+	default:
+		return false
+	}
+	if t.selected >= len(t.rows) {
+		t.selected = len(t.rows) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+	return true
+}
+
+// openTreeNode opens the selected file in a canvas and moves the focus to
+// the text, or expands or collapses the selected directory.
+func (e *Editor) openTreeNode() {
+	t := e.fileTree
+	n := t.current()
+	if n == nil {
+		return
+	}
+	if n.dir {
+		n.expanded = !n.expanded
+		if n.expanded && !n.loaded {
+			n.load(t.matcher)
+		}
+		t.flatten()
+		return
+	}
+	e.openOrCreateCanvasForFile(n.path)
+	if samePath(e.filename, n.path) {
+		e.treeFocus = false
+	}
+}
+
+// treeTargetDir returns the directory a new entry is created in: the
+// selected directory, or the directory of the selected file.
+func (e *Editor) treeTargetDir() string {
+	n := e.fileTree.current()
+	switch {
+	case n == nil:
+		return e.fileTree.root.path
+	case n.dir:
+		return n.path
+	default:
+		return n.parent.path
+	}
+}
+
+// createTreeNode asks for a name and creates a file, or a directory if the
+// name ends with "/". A new file is opened in a canvas.
+// createTreeNode создаёт файл или каталог (имя с "/" на конце).
+func (e *Editor) createTreeNode() {
+	dir := e.treeTargetDir()
+	rel, _ := filepath.Rel(e.fileTree.root.path, dir)
+	label := "New file in " + rel + " (end with / for a directory)"
+	e.promptShow(label, func(input string) {
+		name := strings.TrimSpace(input)
+		if name == "" || name == "/" {
+			return
+		}
+		isDir := strings.HasSuffix(name, "/")
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if _, err := os.Stat(path); err == nil {
+			e.showError("Already exists: " + name)
+			return
+		}
+		var err error
+		if isDir {
+			err = os.MkdirAll(path, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err == nil {
+				err = f.Close()
+			}
+		}
+		if err != nil {
+			e.showError("Unable to create " + name + ": " + err.Error())
+			return
+		}
+		e.fileTree.reload(path)
+		if isDir {
+			e.statusMessage("Created directory " + name)
+			return
+		}
+		e.openOrCreateCanvasForFile(path)
+		e.treeFocus = false
+		e.statusMessage("Created " + name)
+	})
+}
+
+// canvasesUnder returns the file canvases whose file is path or lies under
+// it, in number order.
+func (e *Editor) canvasesUnder(path string) []int {
+	var nums []int
+	for num, c := range e.canvases {
+		if c.kind != CanvasFile || c.filename == "" {
+			continue
+		}
+		abs, err := filepath.Abs(c.filename)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(path, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// renameTreeNode asks for a new name of the selected entry and renames it.
+// Canvases showing the entry, or files inside a renamed directory, follow
+// the new path.
+// renameTreeNode переименовывает файл или каталог; открытые канвасы следуют за ним.
+func (e *Editor) renameTreeNode() {
+	n := e.fileTree.current()
+	if n == nil {
+		return
+	}
+	e.promptShowWithInitial("Rename "+n.name+" to", n.name, func(input string) {
+		name := strings.TrimSpace(input)
+		if name == "" || name == n.name {
+			return
+		}
+		path := filepath.Join(filepath.Dir(n.path), filepath.FromSlash(name))
+		if _, err := os.Stat(path); err == nil {
+			e.showError("Already exists: " + name)
+			return
+		}
+		if err := os.Rename(n.path, path); err != nil {
+			e.showError("Unable to rename: " + err.Error())
+			return
+		}
+		e.syncEditorToCanvas()
+		for _, num := range e.canvasesUnder(n.path) {
+			c := e.canvases[num]
+			abs, _ := filepath.Abs(c.filename)
+			rel, _ := filepath.Rel(n.path, abs)
+			c.filename = filepath.Join(path, rel)
+			c.language = detectLanguage(c.filename)
+			if num == e.currentCanvas {
+				e.filename, e.language = c.filename, c.language
+			}
+		}
+		e.fileTree.reload(path)
+		e.statusMessage("Renamed " + n.name + " to " + name)
+	})
+}
+
+// deleteTreeNode deletes the selected entry after a confirmation and closes
+// the canvases of the deleted files, unsaved changes included.
+// deleteTreeNode удаляет файл или каталог и закрывает их канвасы.
+func (e *Editor) deleteTreeNode() {
+	n := e.fileTree.current()
+	if n == nil {
+		return
+	}
+	e.syncEditorToCanvas()
+	nums := e.canvasesUnder(n.path)
+	what := n.name
+	if n.dir {
+		what = "directory " + n.name + " with all its files"
+	}
+	label := "Delete " + what + "?"
+	for _, num := range nums {
+		if e.canvases[num].hasUnsavedChanges() {
+			label = "Delete " + what + " and discard unsaved changes?"
+			break
+		}
+	}
+	e.promptShow(label+" (y/n)", func(input string) {
+		if answer := strings.ToLower(strings.TrimSpace(input)); answer != "y" && answer != "н" {
+			e.statusMessage("Delete cancelled")
+			return
+		}
+		var err error
+		if n.dir {
+			err = os.RemoveAll(n.path)
+		} else {
+			err = os.Remove(n.path)
+		}
+		if err != nil {
+			e.showError("Unable to delete: " + err.Error())
+			e.fileTree.reload("")
+			return
+		}
+		e.syncEditorToCanvas()
+		for _, num := range nums {
+			e.removeCanvas(num)
+		}
+		e.fileTree.reload("")
+		e.statusMessage("Deleted " + n.name)
+	})
+}
+
+// drawFileTree draws the file tree left of the text area: expandable
+// directories, files with "*" when their canvas has unsaved changes and the
+// selected row, highlighted while the tree has the focus.
+// drawFileTree рисует дерево файлов слева от текста.
+func (e *Editor) drawFileTree() {
+	width := e.treeWidth()
+	if width == 0 {
+		return
+	}
+	t := e.fileTree
+	top, rows := e.textTop(), e.contentHeight-3-e.tabBarHeight
+	if t.selected < t.offset {
+		t.offset = t.selected
+	}
+	if t.selected >= t.offset+rows {
+		t.offset = t.selected - rows + 1
+	}
+
+	e.syncEditorToCanvas()
+	dirty := make(map[string]bool)
+	for _, num := range e.canvasesUnder(t.root.path) {
+		if c := e.canvases[num]; c.hasUnsavedChanges() {
+			if abs, err := filepath.Abs(c.filename); err == nil {
+				dirty[abs] = true
+			}
+		}
+	}
+
+	base := tcell.StyleDefault
+	sep := tcell.StyleDefault.Foreground(tcell.ColorGray)
+	for y := 0; y < rows; y++ {
+		style := base
+		text := ""
+		if i := t.offset + y; i < len(t.rows) {
+			n := t.rows[i]
+			text = strings.Repeat("  ", n.depth-1)
+			switch {
+			case n.dir && n.expanded:
+				text += "▾ " + n.name + "/"
+			case n.dir:
+				text += "▸ " + n.name + "/"
+			default:
+				text += "  " + n.name
+				if dirty[n.path] {
+					text += "*"
+				}
+			}
+			if n.dir {
+				style = style.Foreground(tcell.ColorBlue)
+			}
+			if i == t.selected {
+				if e.treeFocus {
+					style = tcell.StyleDefault.Background(tcell.ColorWhite).Foreground(tcell.ColorBlack)
+				} else {
+					style = style.Reverse(true)
+				}
+			}
+		}
+		x := 0
+		for _, ch := range text {
+			w := runewidth.RuneWidth(ch)
+			if x+w > width {
+				break
+			}
+			e.screen.SetContent(x, top+y, ch, nil, style)
+			x += w
+		}
+		for ; x < width; x++ {
+			e.screen.SetContent(x, top+y, ' ', nil, style)
+		}
+		e.screen.SetContent(width, top+y, '│', nil, sep)
+	}
+	if e.treeFocus {
+		e.screen.HideCursor()
+	}
+}
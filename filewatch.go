@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchInterval is how often open files are checked for changes on disk.
+const watchInterval = 2 * time.Second
+
+// errChangedOnDisk is returned by persist when the file changed on disk since
+// the canvas was loaded or saved.
+var errChangedOnDisk = errors.New("the file has changed on disk")
+
+// diskState is what a canvas knows about its file as last read or written.
+// A zero state means the file is not watched.
+type diskState struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// diskStateOf returns the state of the file at path whose content is data.
+func diskStateOf(path string, data []byte) diskState {
+	st := diskState{hash: contentHash(string(data)), size: int64(len(data))}
+	if info, err := os.Stat(path); err == nil {
+		st.modTime, st.size = info.ModTime(), info.Size()
+	}
+	return st
+}
+
+// readIfChanged returns the content of path if it differs from st. A file
+// whose time and size are unchanged is not read.
+func readIfChanged(path string, st diskState) ([]byte, bool) {
+	if st.hash == "" {
+		return nil, false
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.ModTime().Equal(st.modTime) && info.Size() == st.size {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || contentHash(string(data)) == st.hash {
+		return nil, false
+	}
+	return data, true
+}
+
+// changedOnDisk reports whether the file of the current canvas changed on
+// disk since the canvas last read or wrote it.
+func (e *Editor) changedOnDisk() bool {
+	c, ok := e.canvases[e.currentCanvas]
+	if !ok || !samePath(c.filename, e.filename) {
+		return false
+	}
+	_, changed := readIfChanged(e.filename, c.disk)
+	return changed
+}
+
+// checkDiskChanges looks for open files that changed on disk. Canvases
+// without unsaved changes are reloaded; for the others the user is asked,
+// once per version of the file on disk. While an interactive replace or an
+// undo group is open the check waits for the next tick, so a reload cannot
+// split the edit or move the text under the replace.
+// checkDiskChanges проверяет, не изменились ли открытые файлы на диске.
+func (e *Editor) checkDiskChanges() {
+	if e.replaceSession != nil || e.undoGroup > 0 {
+		return
+	}
+	e.syncEditorToCanvas()
+	nums := make([]int, 0, len(e.canvases))
+	for num := range e.canvases {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	var reloaded []string
+	for _, num := range nums {
+		c := e.canvases[num]
+		if c.kind != CanvasFile || c.buf == nil || c.filename == "" {
+			continue
+		}
+		data, changed := readIfChanged(c.filename, c.disk)
+		if !changed {
+			continue
+		}
+		hash := contentHash(string(data))
+		if c.conflictHash == hash {
+			continue
+		}
+		if !c.dirty {
+			e.reloadCanvas(num, data, c.reloadCharset(data))
+			reloaded = append(reloaded, filepath.Base(c.filename))
+			continue
+		}
+		c.conflictHash = hash
+		e.diskConflicts = append(e.diskConflicts, num)
+	}
+	if len(reloaded) > 0 {
+		e.statusMessage("Reloaded after a change on disk: " + strings.Join(reloaded, ", "))
+	}
+	if e.prompt == nil && e.listPopup == nil && e.multiLinePrompt == nil && e.terminalPrompt == nil {
+		e.promptNextConflict()
+	}
+}
+
+// reloadCharset returns the charset to read data, the new content of the file
+// of c, in: the one the file had unless data is no longer valid in it.
+func (c *Canvas) reloadCharset(data []byte) charset {
+	if c.format.charset == charsetUTF8 {
+		return detectCharset(data)
+	}
+	return c.format.charset
+}
+
+// reloadCanvas replaces the text of canvas num with data, the new content of
+// its file read in charset cs, as one undoable edit, and marks the canvas as
+// saved.
+func (e *Editor) reloadCanvas(num int, data []byte, cs charset) {
+	cur := e.currentCanvas
+	e.syncEditorToCanvas()
+	cx, cy := e.cx, e.cy
+	e.currentCanvas = num
+	e.syncCanvasToEditor()
+	last := e.buf.LineCount() - 1
+	e.beginUndoGroup()
+	text, format := decodeTextAs(data, cs)
+	e.replaceRange(0, 0, last, e.buf.LineLen(last), text)
+	e.endUndoGroup()
+	e.cy, e.cx = e.clampPos(e.cy, e.cx)
+	e.dirty = false
+	e.format = format
+	e.syncEditorToCanvas()
+	c := e.canvases[num]
+	c.disk = diskStateOf(c.filename, data)
+	c.conflictHash = ""
+	e.currentCanvas = cur
+	e.syncCanvasToEditor()
+	if cur == num {
+		e.cy, e.cx = e.clampPos(cy, cx)
+	} else {
+		e.cx, e.cy = cx, cy
+	}
+}
+
+// promptNextConflict asks about the first canvas with unsaved changes whose
+// file changed on disk: reload it (Ctrl-Z brings the changes back), keep the
+// changes, so the next save overwrites the file, or show the differences.
+func (e *Editor) promptNextConflict() {
+	for len(e.diskConflicts) > 0 {
+		num := e.diskConflicts[0]
+		c, ok := e.canvases[num]
+		if !ok || c.conflictHash == "" {
+			e.diskConflicts = e.diskConflicts[1:]
+			continue
+		}
+		label := filepath.Base(c.filename) + " changed on disk. (r)eload (k)eep mine (d)iff"
+		e.promptShow(label, func(input string) {
+			data, err := os.ReadFile(c.filename)
+			if err != nil {
+				e.diskConflicts = e.diskConflicts[1:]
+				e.showError("Unable to read the file: " + err.Error())
+				return
+			}
+			switch strings.ToLower(strings.TrimSpace(input)) {
+			case "r", "к":
+				e.diskConflicts = e.diskConflicts[1:]
+				e.reloadCanvas(num, data, c.reloadCharset(data))
+				e.statusMessage("Reloaded " + filepath.Base(c.filename) + "; Ctrl-Z brings your changes back")
+			case "k", "л":
+				e.diskConflicts = e.diskConflicts[1:]
+				c.disk = diskStateOf(c.filename, data)
+				c.conflictHash = ""
+			case "d", "в":
+				e.syncEditorToCanvas()
+				lines := []string{
+					"--- " + c.filename + " (on disk)",
+					"+++ " + c.getDisplayName() + " (canvas " + strconv.Itoa(num) + ")",
+				}
+				disk, _ := decodeTextAs(data, c.reloadCharset(data))
+				lines = append(lines, lineDiff(strings.Split(disk, "\n"), c.buf.Lines(), 2)...)
+				e.showGeneratedCanvas(CanvasDiff, lines)
+			}
+			e.promptNextConflict()
+		})
+		return
+	}
+}
+
+// confirmOverwrite asks whether to save the current canvas over a file that
+// changed on disk. saved runs after the file is written, cancelled if it is
+// not; either may be nil.
+// confirmOverwrite спрашивает, перезаписать ли изменившийся на диске файл.
+func (e *Editor) confirmOverwrite(saved, cancelled func()) {
+	e.promptShow(filepath.Base(e.filename)+" changed on disk since it was loaded. Overwrite it? (y/n)", func(input string) {
+		switch strings.ToLower(strings.TrimSpace(input)) {
+		case "y", "yes", "д", "да":
+			if e.persistAnyway() == nil {
+				e.syncEditorToCanvas()
+				e.statusMessage("Saved " + filepath.Base(e.filename))
+				if saved != nil {
+					saved()
+				}
+				return
+			}
+		default:
+			e.statusMessage("Not saved")
+		}
+		if cancelled != nil {
+			cancelled()
+		}
+	})
+}
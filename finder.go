@@ -0,0 +1,275 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxFinderResults caps the number of files listed by the file finder.
+const maxFinderResults = 200
+
+// maxRecentFiles is how many recently used files are remembered.
+const maxRecentFiles = 50
+
+// finderFile is a project file prepared for fuzzy matching.
+type finderFile struct {
+	path  string
+	lower []rune
+	base  int
+}
+
+// noteRecentFile moves path to the front of the recently used files.
+// noteRecentFile переносит path в начало списка недавних файлов.
+func (e *Editor) noteRecentFile(path string) {
+	if path == "" {
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	for i, p := range e.recentFiles {
+		if p == path {
+			copy(e.recentFiles[1:i+1], e.recentFiles[:i])
+			e.recentFiles[0] = path
+			return
+		}
+	}
+	e.recentFiles = append([]string{path}, e.recentFiles...)
+	if len(e.recentFiles) > maxRecentFiles {
+		e.recentFiles = e.recentFiles[:maxRecentFiles]
+	}
+}
+
+// listProjectFiles returns the paths of all files under root relative to it,
+// leaving out the ignored ones.
+// listProjectFiles возвращает пути всех файлов проекта относительно root.
+func listProjectFiles(root string) []string {
+	var files []string
+	newProjectMatcher(root).walk(func(rel string, info os.FileInfo) {
+		files = append(files, rel)
+	})
+	sort.Strings(files)
+	return files
+}
+
+// fileIndex is the list of project files the finder matches against. It is
+// built when the finder first opens and kept until a file is created or
+// removed: the watcher tick compares the modification times of the
+// directories holding files with the ones seen when it was built.
+// fileIndex — список файлов проекта для поиска файлов; строится один раз и
+// обновляется при изменении каталогов.
+type fileIndex struct {
+	root  string
+	files []finderFile
+	dirs  map[string]time.Time
+	stale bool
+}
+
+// newFileIndex walks root and indexes its files and the directories above
+// them.
+func newFileIndex(root string) *fileIndex {
+	idx := &fileIndex{root: root, dirs: make(map[string]time.Time)}
+	base := root
+	if abs, err := filepath.Abs(root); err == nil {
+		base = abs
+	}
+	for _, p := range listProjectFiles(root) {
+		idx.files = append(idx.files, finderFile{
+			path:  p,
+			lower: []rune(strings.ToLower(p)),
+			base:  len([]rune(p)) - len([]rune(filepath.Base(p))),
+		})
+		for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+			abs := filepath.Join(base, dir)
+			if _, ok := idx.dirs[abs]; ok {
+				break
+			}
+			idx.dirs[abs] = time.Time{}
+			if dir == "." {
+				break
+			}
+		}
+	}
+	idx.dirs[base] = time.Time{}
+	for dir := range idx.dirs {
+		idx.noteDir(dir)
+	}
+	return idx
+}
+
+// noteDir records the current modification time of dir.
+func (idx *fileIndex) noteDir(dir string) {
+	if info, err := os.Stat(dir); err == nil {
+		idx.dirs[dir] = info.ModTime()
+	}
+}
+
+// projectFileIndex returns the finder files of root, walking the project
+// only on first use, for another root or after the index went stale.
+// projectFileIndex возвращает индекс файлов проекта, обходя его только при
+// необходимости.
+func (e *Editor) projectFileIndex(root string) []finderFile {
+	if idx := e.fileIndex; idx == nil || idx.root != root || idx.stale {
+		e.fileIndex = newFileIndex(root)
+	}
+	return e.fileIndex.files
+}
+
+// checkFileIndex marks the file index stale when a directory holding indexed
+// files has changed since it was built. It runs on the watcher tick.
+// checkFileIndex помечает индекс устаревшим, если каталог изменился.
+func (e *Editor) checkFileIndex() {
+	idx := e.fileIndex
+	if idx == nil || idx.stale {
+		return
+	}
+	for dir, mod := range idx.dirs {
+		if info, err := os.Stat(dir); err != nil || !info.ModTime().Equal(mod) {
+			idx.stale = true
+			return
+		}
+	}
+}
+
+// noteFileWritten keeps the file index in step with a save of path. A new
+// file or a backup makes the index stale; overwriting an indexed file only
+// changes the time of its directory, which is recorded again.
+func (e *Editor) noteFileWritten(path string, created bool) {
+	idx := e.fileIndex
+	if idx == nil || idx.stale {
+		return
+	}
+	if created || e.backupMode != BackupNone {
+		idx.stale = true
+		return
+	}
+	if abs, err := filepath.Abs(filepath.Dir(path)); err == nil {
+		if _, ok := idx.dirs[abs]; ok {
+			idx.noteDir(abs)
+		}
+	}
+}
+
+// isPathSeparatorRune reports whether r separates words in a file path.
+func isPathSeparatorRune(r rune) bool {
+	return r == '/' || r == '\\' || r == '_' || r == '-' || r == '.' || r == ' '
+}
+
+// fuzzyScore matches query against s as a subsequence, starting no earlier
+// than from, and scores it: runes that follow each other, start a word or lie
+// in the file name (at or after base) count more. Both are lower case.
+func fuzzyScore(query, s []rune, from, base int) (int, bool) {
+	score, qi, prev := 0, 0, -2
+	for i := from; i < len(s) && qi < len(query); i++ {
+		if s[i] != query[qi] {
+			continue
+		}
+		score++
+		if i == prev+1 {
+			score += 5
+		}
+		if i == 0 || isPathSeparatorRune(s[i-1]) {
+			score += 8
+		}
+		if i >= base {
+			score += 2
+		}
+		prev = i
+		qi++
+	}
+	if qi < len(query) {
+		return 0, false
+	}
+	return score - len(s)/16, true
+}
+
+// matchFile scores f for query, preferring a match inside the file name.
+func matchFile(query []rune, f *finderFile) (int, bool) {
+	best, ok := fuzzyScore(query, f.lower, 0, f.base)
+	if !ok {
+		return 0, false
+	}
+	if s, ok := fuzzyScore(query, f.lower, f.base, f.base); ok && s > best {
+		best = s
+	}
+	return best, true
+}
+
+// showFileFinder opens a popup listing the files under root that fuzzily
+// match the typed text, best matches and recently used files first. The
+// file list comes from the project file index; each keystroke that extends
+// the text only rescans the files that matched before. If nothing matches,
+// Enter opens the typed path as before.
+// showFileFinder открывает нечёткий поиск файлов проекта.
+func (e *Editor) showFileFinder(root string) {
+	files := e.projectFileIndex(root)
+	recent := make(map[string]int)
+	for i, p := range e.recentFiles {
+		if rel, err := filepath.Rel(root, p); err == nil && !strings.HasPrefix(rel, "..") {
+			recent[rel] = maxRecentFiles - i
+		}
+	}
+
+	type scored struct {
+		idx   int
+		score int
+	}
+	all := make([]int, len(files))
+	for i := range files {
+		all[i] = i
+	}
+	candidates := all
+	var shown []string
+	last, typed := "", ""
+
+	filter := func(query string) []string {
+		typed = strings.TrimSpace(query)
+		q := []rune(strings.ToLower(typed))
+		pool := all
+		if last != "" && strings.HasPrefix(string(q), last) {
+			pool = candidates
+		}
+		var hits []scored
+		for _, i := range pool {
+			s := recent[files[i].path]
+			if len(q) > 0 {
+				m, ok := matchFile(q, &files[i])
+				if !ok {
+					continue
+				}
+				s = m + s/5
+			}
+			hits = append(hits, scored{idx: i, score: s})
+		}
+		last = string(q)
+		candidates = make([]int, 0, len(hits))
+		for _, h := range hits {
+			candidates = append(candidates, h.idx)
+		}
+		sort.SliceStable(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+
+		shown = shown[:0]
+		for _, h := range hits {
+			if len(shown) == maxFinderResults {
+				break
+			}
+			shown = append(shown, files[h.idx].path)
+		}
+		items := append([]string(nil), shown...)
+		if len(items) == 0 && len(q) > 0 {
+			items = append(items, "Open \""+typed+"\"")
+		}
+		return items
+	}
+
+	e.showFilterPopup("Open file (type to filter, Enter: open, Esc: close)", filter, func(i int) {
+		if i >= len(shown) {
+			e.openProjectFile(typed)
+			return
+		}
+		e.openOrCreateCanvasForFile(filepath.Join(root, shown[i]))
+	})
+}
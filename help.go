@@ -38,6 +38,13 @@ func printUsageRU() {
 	fmt.Println("Flags:")
 	fmt.Println("  -h, --help         Показать эту справку и использование.")
 	fmt.Println("  -v, --version      Показать версию программы.")
+	fmt.Println("  -undo-limit N      Лимит памяти истории отмены на канвас, МБ (по умолчанию 16).")
+	fmt.Println("  -session NAME      Именованная сессия. Без пути сессия восстанавливается,")
+	fmt.Println("                     при выходе сохраняется (по умолчанию - сессия текущего каталога).")
+	fmt.Println("  -backup MODE       Резервная копия при сохранении: none (по умолчанию), tilde (file~)")
+	fmt.Println("                     или time (file.YYYYMMDD-HHMMSS~).")
+	fmt.Println("  -rules FILE        Файл правил включения/исключения файлов проекта")
+	fmt.Println("                     (по умолчанию .editor.json в каталоге проекта).")
 	fmt.Println()
 	fmt.Println("Особенности:")
 	fmt.Println("  - Текстовый редактор с поддержкой многострочного редактирования, курсорной навигации,")
@@ -50,16 +57,34 @@ func printUsageRU() {
 	fmt.Println("  Ctrl-R  Запускает код программы, при ошибке в коде - ")
 	fmt.Println("          Поддерживаемые языки: c, cpp, assembly, fortran, go, \n          python, ruby, kotlin, swift, html, lisp")
 	fmt.Println("  Ctrl-S  Сохранить файл")
-	fmt.Println("  Ctrl-O  Открыть файл")
+	fmt.Println("  Ctrl-O  Открыть файл (в проекте — нечёткий поиск по файлам)")
 	fmt.Println("  Ctrl-N  Новый файл")
 	fmt.Println("  Ctrl-Q  Выход из редактора")
 	fmt.Println("  Ctrl-F  Поиск текста. Для замены текста используй символ -> .\n          Пример: Print -> Printf")
+	fmt.Println("          Курсор переходит к совпадению по мере ввода; Backspace возвращает\n          к предыдущему совпадению, Esc — к исходной позиции.")
+	fmt.Println("          В поле поиска: Alt-R регулярные выражения ($1, ${name} в замене),\n          Alt-C без учёта регистра, Alt-W слово целиком,\n          Alt-I подтверждать каждую замену, Alt-S заменять только в выделении")
 	fmt.Println("  Ctrl-G  Перейти к строке")
 	fmt.Println("  Ctrl-Z  Отменить")
 	fmt.Println("  Ctrl-E  Вернуть отменённое")
+	fmt.Println("  Alt-H   История отмены: все состояния, включая отменённые ветви")
+	fmt.Println("  Alt-N, F3        Следующее совпадение последнего поиска")
+	fmt.Println("  Alt-P, Shift-F3  Предыдущее совпадение последнего поиска")
+	fmt.Println("  Alt-F   Поиск по всему проекту (канвас результатов, Enter открывает совпадение)")
+	fmt.Println("          \"old -> new\" — предпросмотр замены по проекту: Пробел отмечает строку, Enter применяет, Ctrl-Z отменяет во всех файлах")
 	fmt.Println("  Ctrl-X  Убрать текущую строку")
 	fmt.Println("  Ctrl-A  Выделить все")
 	fmt.Println("  Ctrl-B  Сдвиг канваса (листание файлов)")
+	fmt.Println("  Alt-B   Список канвасов с фильтром")
+	fmt.Println("  Alt-G   Перейти к канвасу по номеру (Alt-1…Alt-9 — сразу к канвасу 1–9)")
+	fmt.Println("  Alt-L   Вернуться к предыдущему канвасу")
+	fmt.Println("  Alt-W   Закрыть канвас (с вопросом о сохранении)")
+	fmt.Println("  Alt-Q   Закрыть все сохранённые канвасы")
+	fmt.Println("  Alt-T   Показать или скрыть строку вкладок канвасов")
+	fmt.Println("  Alt-V   Разделить окно по вертикали (панели рядом), Alt-S — по горизонтали")
+	fmt.Println("  Alt-O   Следующая панель, Alt-X закрыть панель, Alt-= / Alt-- изменить размер")
+	fmt.Println("  Alt-E   Дерево файлов проекта: Enter открыть, n создать, r переименовать, d удалить, Esc к тексту")
+	fmt.Println("  Alt-M   Формат файла: UTF-8, окончания строк LF/CRLF, BOM, перевод строки в конце")
+	fmt.Println("  Alt-K   Перечитать файл в кодировке UTF-8, Windows-1251 или KOI8-R")
 	fmt.Println("  Ctrl-C  Копировать в буфер обмена / Дополнительная клавиша для\n          отправки буфера обмена, как данных для LLM")
 	fmt.Println("  Ctrl-V  Вставить буфер обмена")
 	fmt.Println("  Ctrl-T  Терминал ОС (печать ответа в canvas)")
@@ -100,6 +125,13 @@ func printUsageEN() {
 	fmt.Println("Flags:")
 	fmt.Println("  -h, --help         Show this help and usage.")
 	fmt.Println("  -v, --version      Show program version.")
+	fmt.Println("  -undo-limit N      Undo history memory limit per canvas, MB (default 16).")
+	fmt.Println("  -session NAME      Named session. Restored when no path is given, saved on exit")
+	fmt.Println("                     (default: the session of the working directory).")
+	fmt.Println("  -backup MODE       Backup kept on save: none (default), tilde (file~)")
+	fmt.Println("                     or time (file.YYYYMMDD-HHMMSS~).")
+	fmt.Println("  -rules FILE        Project include/exclude rules file")
+	fmt.Println("                     (default: .editor.json in the project directory).")
 	fmt.Println()
 	fmt.Println("Features:")
 	fmt.Println("  - Text editor with support for multiline editing, cursor navigation,")
@@ -112,16 +144,34 @@ func printUsageEN() {
 	fmt.Println("  Ctrl-R  Run code, and on error - recommendations to fix")
 	fmt.Println("  Supported languages: c, cpp, assembly, fortran, go, \n          python, ruby, kotlin, swift, html, lisp.")
 	fmt.Println("  Ctrl-S  Save file")
-	fmt.Println("  Ctrl-O  Open file")
+	fmt.Println("  Ctrl-O  Open file (fuzzy file finder in project mode)")
 	fmt.Println("  Ctrl-N  New file")
 	fmt.Println("  Ctrl-Q  Quit editor")
 	fmt.Println("  Ctrl-F  Find text. To replace the text, use the symbol -> .\n          Example: Print -> Printf.")
+	fmt.Println("          The cursor follows the match as you type; Backspace returns to\n          the previous match, Esc to the starting position.")
+	fmt.Println("          In the search prompt: Alt-R regular expressions ($1, ${name} in the replacement),\n          Alt-C ignore case, Alt-W whole word,\n          Alt-I confirm each replacement, Alt-S replace only in the selection")
 	fmt.Println("  Ctrl-G  Go to line")
 	fmt.Println("  Ctrl-Z  Undo")
 	fmt.Println("  Ctrl-E  Redo")
+	fmt.Println("  Alt-H   Undo history: every state, including undone branches")
+	fmt.Println("  Alt-N, F3        Next match of the last search")
+	fmt.Println("  Alt-P, Shift-F3  Previous match of the last search")
+	fmt.Println("  Alt-F   Search the whole project (results canvas, Enter opens a match)")
+	fmt.Println("          \"old -> new\" previews a project replace: Space toggles, Enter applies, Ctrl-Z undoes it in every file")
 	fmt.Println("  Ctrl-X  Remove current line")
 	fmt.Println("  Ctrl-A  Select all")
 	fmt.Println("  Ctrl-B  Shift of the canvas (scrolling files)")
+	fmt.Println("  Alt-B   Canvas list with filter")
+	fmt.Println("  Alt-G   Go to canvas by number (Alt-1…Alt-9 jump to canvas 1-9)")
+	fmt.Println("  Alt-L   Back to the previous canvas")
+	fmt.Println("  Alt-W   Close the canvas (asks to save changes)")
+	fmt.Println("  Alt-Q   Close all saved canvases")
+	fmt.Println("  Alt-T   Show or hide the canvas tab bar")
+	fmt.Println("  Alt-V   Split the window side by side, Alt-S one above the other")
+	fmt.Println("  Alt-O   Next pane, Alt-X close the pane, Alt-= / Alt-- resize it")
+	fmt.Println("  Alt-E   Project file tree: Enter opens, n creates, r renames, d deletes, Esc back to the text")
+	fmt.Println("  Alt-M   File format: UTF-8, LF/CRLF line endings, BOM, newline at the end")
+	fmt.Println("  Alt-K   Read the file again as UTF-8, Windows-1251 or KOI8-R")
 	fmt.Println("  Ctrl-C  Copy to clipboard / An extra key for sending\n            the clipboard contents as data to the LLM")
 	fmt.Println("  Ctrl-V  Paste clipboard")
 	fmt.Println("  Ctrl-T  OS terminal (print LLM answer on canvas)")
@@ -159,16 +209,33 @@ func printUsageRUMini() {
 	fmt.Println("     Ctrl-L  Ввести указание для LLM или генерировать код (по коментарию вверху) если указание пустое")
 	fmt.Println("     Ctrl-R  Запускает код программы, при ошибке в коде - рекомендации по их исправлению")
 	fmt.Println("     Ctrl-S  Сохранить файл")
-	fmt.Println("     Ctrl-O  Открыть файл")
+	fmt.Println("     Ctrl-O  Открыть файл (в проекте — нечёткий поиск по файлам)")
 	fmt.Println("     Ctrl-N  Новый файл")
 	fmt.Println("     Ctrl-Q  Выход из редактора")
 	fmt.Println("     Ctrl-F  Поиск текста. Для замены текста используй символ -> . Пример: Print -> Printf")
+	fmt.Println("               В поле поиска: Alt-R регулярные выражения ($1, ${name} в замене),\n               Alt-C без учёта регистра, Alt-W слово целиком,\n               Alt-I подтверждать каждую замену, Alt-S заменять только в выделении")
 	fmt.Println("     Ctrl-G  Перейти к строке")
 	fmt.Println("     Ctrl-Z  Отменить")
 	fmt.Println("     Ctrl-E  Вернуть отменённое")
+	fmt.Println("     Alt-H   История отмены: все состояния, включая отменённые ветви")
+	fmt.Println("     Alt-N, F3        Следующее совпадение последнего поиска")
+	fmt.Println("     Alt-P, Shift-F3  Предыдущее совпадение последнего поиска")
+	fmt.Println("     Alt-F   Поиск по всему проекту (канвас результатов, Enter открывает совпадение)")
+	fmt.Println("             \"old -> new\" — предпросмотр замены по проекту: Пробел отмечает строку, Enter применяет, Ctrl-Z отменяет во всех файлах")
 	fmt.Println("     Ctrl-X  Убрать текущую строку")
 	fmt.Println("     Ctrl-A  Выделить все")
 	fmt.Println("     Ctrl-B  Сдвиг канваса (листание файлов)")
+	fmt.Println("     Alt-B   Список канвасов с фильтром")
+	fmt.Println("     Alt-G   Перейти к канвасу по номеру (Alt-1…Alt-9 — сразу к канвасу 1–9)")
+	fmt.Println("     Alt-L   Вернуться к предыдущему канвасу")
+	fmt.Println("     Alt-W   Закрыть канвас (с вопросом о сохранении)")
+	fmt.Println("     Alt-Q   Закрыть все сохранённые канвасы")
+	fmt.Println("     Alt-T   Показать или скрыть строку вкладок канвасов")
+	fmt.Println("     Alt-V   Разделить окно по вертикали (панели рядом), Alt-S — по горизонтали")
+	fmt.Println("     Alt-O   Следующая панель, Alt-X закрыть панель, Alt-= / Alt-- изменить размер")
+	fmt.Println("     Alt-E   Дерево файлов проекта: Enter открыть, n создать, r переименовать, d удалить, Esc к тексту")
+	fmt.Println("     Alt-M   Формат файла: UTF-8, окончания строк LF/CRLF, BOM, перевод строки в конце")
+	fmt.Println("     Alt-K   Перечитать файл в кодировке UTF-8, Windows-1251 или KOI8-R")
 	fmt.Println("     Ctrl-C  Копировать в буфер обмена / Дополнительная клавиша для\n          отправки буфера обмена, как данных для LLM")
 	fmt.Println("     Ctrl-V  Вставить буфер обмена")
 	fmt.Println("     Ctrl-T  Терминал ОС (печать ответа в canvas)")
@@ -185,16 +252,33 @@ func printUsageENMini() {
 	fmt.Println("  Ctrl-L  Enter prompt for LLM or generate code if prompt is empty")
 	fmt.Println("  Ctrl-R  Run code, and on error - recommendations to fix")
 	fmt.Println("  Ctrl-S  Save file")
-	fmt.Println("  Ctrl-O  Open file")
+	fmt.Println("  Ctrl-O  Open file (fuzzy file finder in project mode)")
 	fmt.Println("  Ctrl-N  New file")
 	fmt.Println("  Ctrl-Q  Quit editor")
 	fmt.Println("  Ctrl-F  Find text. To replace the text, use the symbol -> . Example: Print -> Printf.")
+	fmt.Println("          In the search prompt: Alt-R regular expressions ($1, ${name} in the replacement),\n          Alt-C ignore case, Alt-W whole word,\n          Alt-I confirm each replacement, Alt-S replace only in the selection")
 	fmt.Println("  Ctrl-G  Go to line")
 	fmt.Println("  Ctrl-Z  Undo")
 	fmt.Println("  Ctrl-E  Redo")
+	fmt.Println("  Alt-H   Undo history: every state, including undone branches")
+	fmt.Println("  Alt-N, F3        Next match of the last search")
+	fmt.Println("  Alt-P, Shift-F3  Previous match of the last search")
+	fmt.Println("  Alt-F   Search the whole project (results canvas, Enter opens a match)")
+	fmt.Println("          \"old -> new\" previews a project replace: Space toggles, Enter applies, Ctrl-Z undoes it in every file")
 	fmt.Println("  Ctrl-X  Remove current line")
 	fmt.Println("  Ctrl-A  Select all")
 	fmt.Println("  Ctrl-B  Select by line (from cursor)")
+	fmt.Println("  Alt-B   Canvas list with filter")
+	fmt.Println("  Alt-G   Go to canvas by number (Alt-1…Alt-9 jump to canvas 1-9)")
+	fmt.Println("  Alt-L   Back to the previous canvas")
+	fmt.Println("  Alt-W   Close the canvas (asks to save changes)")
+	fmt.Println("  Alt-Q   Close all saved canvases")
+	fmt.Println("  Alt-T   Show or hide the canvas tab bar")
+	fmt.Println("  Alt-V   Split the window side by side, Alt-S one above the other")
+	fmt.Println("  Alt-O   Next pane, Alt-X close the pane, Alt-= / Alt-- resize it")
+	fmt.Println("  Alt-E   Project file tree: Enter opens, n creates, r renames, d deletes, Esc back to the text")
+	fmt.Println("  Alt-M   File format: UTF-8, LF/CRLF line endings, BOM, newline at the end")
+	fmt.Println("  Alt-K   Read the file again as UTF-8, Windows-1251 or KOI8-R")
 	fmt.Println("  Ctrl-C  Copy to clipboard / An extra key for sending\n            the clipboard contents as data to the LLM")
 	fmt.Println("  Ctrl-V  Paste clipboard")
 	fmt.Println("  Ctrl-T  OS terminal (print LLM answer on canvas)")
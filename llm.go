@@ -35,7 +35,7 @@ func (e *Editor) llmQuery(instruction string) {
 
 	payload := instruction
 	if e.selectAllBeforeLLM {
-		allText := strings.Join(e.lines, "\n")
+		allText := e.buf.String()
 		if strings.TrimSpace(allText) != "" {
 			payload = payload + "\nExisting text:\n" + allText
 		}
@@ -64,7 +64,7 @@ func (e *Editor) llmQueryWithClipboard(instruction string) {
 	}
 
 	if e.selectAllBeforeLLM {
-		allText := strings.Join(e.lines, "\n")
+		allText := e.buf.String()
 		if strings.TrimSpace(allText) != "" {
 			payload = payload + "\nExisting text:\n" + allText
 		}
@@ -97,9 +97,9 @@ func (e *Editor) sendPayloadToLLM(payload string) error {
 // sendCommentToLLM sends a comment to the LLM.
 // sendCommentToLLM отправляет комментарий в LLM.
 func (e *Editor) sendCommentToLLM() {
-	linesAboveCursor := e.lines[:e.cy]
 	commentLines := []string{}
-	for _, line := range linesAboveCursor {
+	for i := 0; i < e.cy; i++ {
+		line := e.buf.Line(i)
 		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "/*") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, ";") {
 			commentLines = append(commentLines, line)
 		}
@@ -108,7 +108,7 @@ func (e *Editor) sendCommentToLLM() {
 	if len(commentLines) > 0 {
 		firstComment = commentLines[0]
 	}
-	codeContent := strings.Join(e.lines, "\n")
+	codeContent := e.buf.String()
 	instruction := "Write code based on this description, but do not write a lengthy explanation; the existing code does not need to be repeated, only in accordance with the instruction; if necessary, only include brief comments before the code:\n"
 	if firstComment != "" {
 		instruction += firstComment + "\n"
@@ -173,37 +173,21 @@ func (e *Editor) insertLLMResponse(resp string) {
 	if e.cy < 0 {
 		e.cy = 0
 	}
-	for e.cy >= len(e.lines) {
-		e.lines = append(e.lines, "")
+	if e.cy >= e.buf.LineCount() {
+		e.cy = e.buf.LineCount() - 1
 	}
-	lineRunes := []rune(e.lines[e.cy])
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	lineRunes := []rune(e.buf.Line(e.cy))
 	if e.cx > len(lineRunes) {
 		e.cx = len(lineRunes)
 	}
 	left := string(lineRunes[:e.cx])
-	right := ""
-	if e.cx < len(lineRunes) {
-		right = string(lineRunes[e.cx:])
-	}
-	e.lines[e.cy] = left + respLines[0] + right
-	insertIndex := e.cy + 1
-	for i := 1; i < len(respLines); i++ {
-		e.lines = append(e.lines[:insertIndex], append([]string{respLines[i]}, e.lines[insertIndex:]...)...)
-		insertIndex++
-	}
-	lastLineIndex := e.cy
-	if len(respLines) > 1 {
-		lastLineIndex = e.cy + len(respLines) - 1
-	}
-	if lastLineIndex >= len(e.lines) {
-		for lastLineIndex >= len(e.lines) {
-			e.lines = append(e.lines, "")
-		}
-	}
-	e.cy = lastLineIndex
-	if e.cy >= 0 && e.cy < len(e.lines) {
-		e.cx = len([]rune(e.lines[e.cy]))
-	}
+	right := string(lineRunes[e.cx:])
+	e.setLine(e.cy, left+respLines[0]+right)
+	e.insertLines(e.cy+1, respLines[1:])
+	e.cy += len(respLines) - 1
+	e.cx = e.buf.LineLen(e.cy)
 	e.dirty = true
 	e.ensureVisible()
 }
@@ -933,9 +917,13 @@ func processStreamInput(instruction, streamData, inputFiles string) string {
 			payload.WriteString("INPUT FILES CONTENT:\n")
 			payload.WriteString("====================\n\n")
 
-			for filename, content := range files {
+			for filename, path := range files {
+				content, err := os.ReadFile(path)
+				if err != nil {
+					continue
+				}
 				payload.WriteString(fmt.Sprintf("--- FILE: %s ---\n", filename))
-				payload.WriteString(content)
+				payload.Write(content)
 				payload.WriteString("\n\n")
 			}
 		}
@@ -944,6 +932,9 @@ func processStreamInput(instruction, streamData, inputFiles string) string {
 	return payload.String()
 }
 
+// readInputFiles returns the files at inputPath (a file or a directory)
+// keyed by the name given to the LLM and holding the path to read them from;
+// each file is read when it is written to the payload.
 // readInputFiles читает файлы из указанного пути (файл или директория)
 func readInputFiles(inputPath string) (map[string]string, error) {
 	files := make(map[string]string)
@@ -954,13 +945,9 @@ func readInputFiles(inputPath string) (map[string]string, error) {
 	}
 
 	if info.IsDir() {
-		return readProjectFiles(inputPath)
+		return projectFilePaths(inputPath)
 	} else {
-		content, err := os.ReadFile(inputPath)
-		if err != nil {
-			return nil, err
-		}
-		files[filepath.Base(inputPath)] = string(content)
+		files[filepath.Base(inputPath)] = inputPath
 	}
 
 	return files, nil
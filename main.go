@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -24,10 +23,11 @@ const Version = "0.9.13"
 type Editor struct {
 	screen              tcell.Screen
 	filename            string
-	lines               []string
+	buf                 TextBuffer
 	cx, cy              int
 	offsetX             int
 	offsetY             int
+	offsetSeg           int
 	dirty               bool
 	clipboard           string
 	prompt              *Prompt
@@ -41,6 +41,7 @@ type Editor struct {
 	contentWidth        int
 	contentHeight       int
 	language            Language
+	format              textFormat
 	selectAllBeforeLLM  bool
 	ctrlAState          bool
 	ctrlLState          bool
@@ -53,9 +54,36 @@ type Editor struct {
 	errorMessage        string
 	errorShowTime       time.Time
 	lastSearch          string
+	searchOpts          SearchOptions
+	searchCache         searchCache
+	bufVersion          int
+	sessionPath         string
+	backupMode          BackupMode
+	pendingSwaps        []pendingSwap
+	lastSwap            time.Time
+	diskConflicts       []int
+	replaceSession      *replaceSession
+	projectReplace      *projectReplace
+	recentFiles         []string
+	fileIndex           *fileIndex
+	prevCanvas          int
+	showTabBar          bool
+	tabBarHeight        int
+	tabScroll           int
+	panes               *paneNode
+	activePane          *paneNode
+	fileTree            *FileTree
+	showFileTree        bool
+	treeFocus           bool
 	llmPrefill          string
-	undoStack           []EditorState
-	redoStack           []EditorState
+	history             *UndoTree
+	listPopup           *ListPopup
+	undoOpen            bool
+	undoLimit           int
+	undoGroup           int
+	undoGroupRedo       *undoNode
+	undoGroupDirty      bool
+	typing              typingRun
 	bracketMatcher      *BracketMatcher
 	contextMode         bool
 	incompleteLine      bool
@@ -71,10 +99,10 @@ type Editor struct {
 
 // ProjectContext представляет контекст всего проекта для отправки в LLM
 type ProjectContext struct {
-	ProjectStructure string            `json:"project_structure"`
-	Files            map[string]string `json:"files"`
-	CurrentFile      string            `json:"current_file"`
-	Instruction      string            `json:"instruction"`
+	ProjectStructure string             `json:"project_structure"`
+	Files            map[string]*Canvas `json:"-"` // read when the payload is written
+	CurrentFile      string             `json:"current_file"`
+	Instruction      string             `json:"instruction"`
 }
 
 // detectLanguage detects the language based on the file extension.
@@ -114,7 +142,7 @@ func detectLanguage(filename string) Language {
 func NewEditor(path string, provider string, model string) *Editor {
 	e := &Editor{
 		filename:      path,
-		lines:         []string{""},
+		buf:           NewTextBuffer(""),
 		dirty:         false,
 		quit:          false,
 		language:      LangUnknown,
@@ -123,7 +151,7 @@ func NewEditor(path string, provider string, model string) *Editor {
 	}
 	canvas := &Canvas{
 		filename: path,
-		lines:    []string{""},
+		buf:      NewTextBuffer(""),
 		cx:       0,
 		cy:       0,
 		offsetX:  0,
@@ -134,12 +162,12 @@ func NewEditor(path string, provider string, model string) *Editor {
 	if path != "" {
 		data, err := os.ReadFile(path)
 		if err == nil {
-			content := string(data)
-			content = strings.ReplaceAll(content, "\r\n", "\n")
-			canvas.lines = strings.Split(content, "\n")
+			content, format := decodeText(data)
+			canvas.buf = NewTextBuffer(content)
+			canvas.format = format
 			canvas.language = detectLanguage(path)
-		} else {
-			canvas.lines = []string{""}
+			canvas.disk = diskStateOf(path, data)
+			canvas.restoreUndoHistory()
 		}
 	}
 
@@ -155,111 +183,28 @@ func NewEditor(path string, provider string, model string) *Editor {
 	e.llmModel = model
 	e.canvasWidth = 0
 	e.llmLastPrompt = ""
-	if path != "" {
-		data, err := os.ReadFile(path)
-		if err == nil {
-			content := string(data)
-			content = strings.ReplaceAll(content, "\r\n", "\n")
-			e.lines = strings.Split(content, "\n")
-			e.language = detectLanguage(path)
-		} else {
-			e.lines = []string{""}
-		}
-	}
 	e.cx, e.cy = 0, 0
 	e.offsetX, e.offsetY = 0, 0
 	e.bracketMatcher = NewBracketMatcher(e)
+	e.offerSwapRecovery(func(p string) bool { return path != "" && samePath(p, path) })
 	return e
 }
 
-// readProjectFiles reads all supported files from a directory
-// readProjectFiles читает все поддерживаемые файлы из директории
-func readProjectFiles(dirPath string) (map[string]string, error) {
-	files := make(map[string]string)
-
-	// Supported file extensions for programming languages
-	supportedExts := map[string]bool{
-		".c": true, ".h": true,
-		".cpp": true, ".cc": true, ".cxx": true, ".hpp": true, ".hh": true,
-		".s": true, ".asm": true,
-		".f": true, ".for": true, ".f90": true, ".f95": true, ".f03": true,
-		".go": true,
-		".py": true,
-		".rb": true,
-		".kt": true, ".kts": true,
-		".swift": true,
-		".html":  true, ".htm": true,
-		".lisp": true, ".lsp": true, ".cl": true, ".el": true,
-	}
-
-	projectFiles := map[string]bool{
-		"README.md": true, "README": true, "README.txt": true,
-		"LICENSE": true, "LICENSE.txt": true, "COPYING": true,
-		"CREDITS.md": true, "CREDITS": true, "CREDITS.txt": true,
-		"Makefile": true, "makefile": true,
-		"Dockerfile": true,
-		".gitignore": true,
-		"go.mod":     true, "go.sum": true,
-		"package.json": true, "package-lock.json": true,
-		"requirements.txt": true, "Pipfile": true,
-		"Cargo.toml": true, "Cargo.lock": true,
-		"pom.xml": true, "build.gradle": true, "build.gradle.kts": true,
-		"CMakeLists.txt": true,
-		".env":           true, ".env.example": true,
-		"docker-compose.yml": true, "docker-compose.yaml": true,
-	}
-
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			if strings.HasPrefix(info.Name(), ".") && info.Name() != "." && info.Name() != ".." {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		filename := info.Name()
-		ext := strings.ToLower(filepath.Ext(filename))
-
-		if supportedExts[ext] {
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			relPath, _ := filepath.Rel(dirPath, path)
-			files[relPath] = string(content)
-			return nil
-		}
-
-		if projectFiles[filename] || projectFiles[strings.ToLower(filename)] {
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			relPath, _ := filepath.Rel(dirPath, path)
-			files[relPath] = string(content)
-			return nil
-		}
-
-		if filename == "Makefile" || filename == "makefile" || filename == "Dockerfile" {
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			relPath, _ := filepath.Rel(dirPath, path)
-			files[relPath] = string(content)
-		}
-
-		return nil
-	})
-
+// projectFilePaths returns the supported files of a directory, keyed by
+// their path relative to it and holding the path to read them from. The
+// files themselves are not read.
+// projectFilePaths возвращает пути поддерживаемых файлов директории, не
+// читая сами файлы.
+func projectFilePaths(dirPath string) (map[string]string, error) {
+	paths, err := listProjectIndex(dirPath)
 	if err != nil {
 		return nil, err
 	}
 
+	files := make(map[string]string, len(paths))
+	for _, relPath := range paths {
+		files[relPath] = filepath.Join(dirPath, relPath)
+	}
 	return files, nil
 }
 
@@ -268,7 +213,7 @@ func readProjectFiles(dirPath string) (map[string]string, error) {
 func NewEditorWithProject(dirPath string, provider string, model string) *Editor {
 	e := &Editor{
 		filename:      dirPath,
-		lines:         []string{""},
+		buf:           NewTextBuffer(""),
 		dirty:         false,
 		quit:          false,
 		language:      LangUnknown,
@@ -278,7 +223,7 @@ func NewEditorWithProject(dirPath string, provider string, model string) *Editor
 
 	canvas := &Canvas{
 		filename: dirPath,
-		lines:    []string{""},
+		buf:      NewTextBuffer(""),
 		cx:       0,
 		cy:       0,
 		offsetX:  0,
@@ -287,11 +232,11 @@ func NewEditorWithProject(dirPath string, provider string, model string) *Editor
 		language: LangUnknown,
 	}
 
-	projectFiles, err := readProjectFiles(dirPath)
+	projectFiles, err := listProjectIndex(dirPath)
 	if err != nil {
-		canvas.lines = []string{"Error reading project: " + err.Error(), ""}
+		canvas.buf = NewTextBufferFromLines([]string{"Error reading project: " + err.Error(), ""})
 	} else {
-		canvas.lines = createProjectOverview(projectFiles)
+		canvas.buf = NewTextBufferFromLines(createProjectOverview(projectFiles))
 	}
 
 	e.canvases[1] = canvas
@@ -312,43 +257,44 @@ func NewEditorWithProject(dirPath string, provider string, model string) *Editor
 	e.bracketMatcher = NewBracketMatcher(e)
 
 	e.createCanvasesForProjectFiles(projectFiles, dirPath)
+	e.offerSwapRecovery(func(p string) bool {
+		rel, err := filepath.Rel(dirPath, p)
+		return err == nil && !strings.HasPrefix(rel, "..")
+	})
 
 	return e
 }
 
 // createProjectOverview creates a formatted overview of project files
 // createProjectOverview создает форматированный обзор файлов проекта
-func createProjectOverview(files map[string]string) []string {
+func createProjectOverview(filenames []string) []string {
 	lines := []string{
 		"PROJECT OVERVIEW",
 		"================",
 		"",
-		"Files found: " + strconv.Itoa(len(files)),
+		"Files found: " + strconv.Itoa(len(filenames)),
 		"",
 	}
-
-	// Sort filenames for consistent display
-	var filenames []string
-	for filename := range files {
-		filenames = append(filenames, filename)
+	if extra := len(filenames) - (MaxCanvases - 1); extra > 0 {
+		lines = append(lines,
+			fmt.Sprintf("Canvases hold the first %d files; open the other %d with Ctrl+O.", MaxCanvases-1, extra),
+			"")
 	}
-	sort.Strings(filenames)
 
 	sourceFiles := []string{}
 	configFiles := []string{}
 	docFiles := []string{}
 
 	for _, filename := range filenames {
-		ext := strings.ToLower(filepath.Ext(filename))
 		lowerName := strings.ToLower(filename)
 
 		switch {
-		case isSourceFile(ext):
+		case isSourceFile(filename):
 			sourceFiles = append(sourceFiles, filename)
 		case isConfigFile(filename) || strings.Contains(lowerName, "config") ||
 			strings.Contains(lowerName, "makefile") || strings.Contains(lowerName, "docker"):
 			configFiles = append(configFiles, filename)
-		case strings.Contains(lowerName, "readme") || strings.Contains(lowerName, "license") ||
+		case isDocFile(filename) || strings.Contains(lowerName, "readme") || strings.Contains(lowerName, "license") ||
 			strings.Contains(lowerName, "copying"):
 			docFiles = append(docFiles, filename)
 		default:
@@ -390,61 +336,23 @@ func createProjectOverview(files map[string]string) []string {
 	return lines
 }
 
-// isSourceFile checks if file extension indicates a source code file
-// isSourceFile проверяет, указывает ли расширение файла на файл исходного кода
-func isSourceFile(ext string) bool {
-	sourceExts := []string{".c", ".h", ".cpp", ".cc", ".cxx", ".hpp", ".hh", ".s", ".asm",
-		".f", ".for", ".f90", ".f95", ".f03", ".go", ".py", ".rb",
-		".kt", ".kts", ".swift", ".html", ".htm", ".lisp", ".lsp", ".cl", ".el"}
-	for _, e := range sourceExts {
-		if ext == e {
-			return true
-		}
-	}
-	return false
-}
-
-// isConfigFile checks if filename indicates a configuration file
-// isConfigFile проверяет, указывает ли имя файла на файл конфигурации
-func isConfigFile(filename string) bool {
-	configFiles := []string{"Makefile", "makefile", "Dockerfile", ".gitignore", "go.mod",
-		"go.sum", "package.json", "package-lock.json", "requirements.txt",
-		"Pipfile", "Cargo.toml", "Cargo.lock", "pom.xml", "build.gradle",
-		"build.gradle.kts", "CMakeLists.txt", ".env", ".env.example",
-		"docker-compose.yml", "docker-compose.yaml"}
-	for _, f := range configFiles {
-		if strings.EqualFold(filename, f) {
-			return true
-		}
-	}
-	return false
-}
-
-// createCanvasesForProjectFiles creates canvases for each project file
-// createCanvasesForProjectFiles создает канвасы для каждого файла проекта
-func (e *Editor) createCanvasesForProjectFiles(files map[string]string, basePath string) {
+// createCanvasesForProjectFiles creates a canvas for each project file in
+// sorted order. The files are read when their canvas is first viewed.
+// createCanvasesForProjectFiles создает канвасы для файлов проекта; файлы
+// читаются при первом показе канваса.
+func (e *Editor) createCanvasesForProjectFiles(files []string, basePath string) {
 	canvasNum := 2 // Start from 2 since 1 is for overview
 
-	for filename, content := range files {
+	for _, filename := range files {
 		if canvasNum > MaxCanvases {
 			break
 		}
 
 		fullPath := filepath.Join(basePath, filename)
-		language := detectLanguage(fullPath)
-
-		canvas := &Canvas{
+		e.canvases[canvasNum] = &Canvas{
 			filename: fullPath,
-			lines:    strings.Split(content, "\n"),
-			cx:       0,
-			cy:       0,
-			offsetX:  0,
-			offsetY:  0,
-			dirty:    false,
-			language: language,
+			language: detectLanguage(fullPath),
 		}
-
-		e.canvases[canvasNum] = canvas
 		canvasNum++
 	}
 }
@@ -466,7 +374,7 @@ func (e *Editor) handleExitWithCanvasCheck() {
 // buildProjectContext собирает контекст всего проекта
 func (e *Editor) buildProjectContext(instruction string) *ProjectContext {
 	context := &ProjectContext{
-		Files:       make(map[string]string),
+		Files:       make(map[string]*Canvas),
 		Instruction: instruction,
 		CurrentFile: e.filename,
 	}
@@ -495,8 +403,7 @@ func (e *Editor) buildProjectContext(instruction string) *ProjectContext {
 			}
 
 			structure = append(structure, fmt.Sprintf("Canvas %d: %s", canvasNum, filename))
-			content := strings.Join(canvas.lines, "\n")
-			context.Files[filename] = content
+			context.Files[filename] = canvas
 		}
 	}
 	context.ProjectStructure = strings.Join(structure, "\n")
@@ -507,7 +414,7 @@ func (e *Editor) buildProjectContext(instruction string) *ProjectContext {
 // buildGitHubProjectContext собирает контекст GitHub проекта
 func (e *Editor) buildGitHubProjectContext(instruction string) *ProjectContext {
 	context := &ProjectContext{
-		Files:       make(map[string]string),
+		Files:       make(map[string]*Canvas),
 		Instruction: instruction,
 		CurrentFile: e.filename,
 	}
@@ -529,8 +436,7 @@ func (e *Editor) buildGitHubProjectContext(instruction string) *ProjectContext {
 			}
 
 			structure = append(structure, fmt.Sprintf("Canvas %d: %s", canvasNum, relPath))
-			content := strings.Join(canvas.lines, "\n")
-			context.Files[relPath] = content
+			context.Files[relPath] = canvas
 		}
 	}
 
@@ -560,9 +466,9 @@ func (e *Editor) formatProjectContextForLLM(context *ProjectContext) string {
 	sb.WriteString("PROJECT FILES CONTENT:\n")
 	sb.WriteString("======================\n\n")
 
-	for filename, content := range context.Files {
+	for filename, canvas := range context.Files {
 		sb.WriteString(fmt.Sprintf("--- FILE: %s ---\n", filename))
-		sb.WriteString(content)
+		sb.WriteString(canvas.text())
 		sb.WriteString("\n\n")
 	}
 
@@ -618,6 +524,8 @@ func main() {
 	flag.StringVar(&provider, "provider", provider, "LLMS provider")
 	flag.StringVar(&model, "model", model, "LLMS model")
 	flag.StringVar(&keyFromArg, "key", keyFromArg, "LLM API key для URL-based провайдеров")
+	var undoLimitMB int
+	flag.IntVar(&undoLimitMB, "undo-limit", DefaultUndoLimit>>20, "Undo history memory limit per canvas, MB")
 	var showVersion bool
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 	flag.BoolVar(&showVersion, "v", false, "Show version (short)")
@@ -631,6 +539,12 @@ func main() {
 	flag.BoolVar(&useClipboardData, "d", false, "Use clipboard data as input in stream mode (short)")
 	flag.StringVar(&inputFiles, "input", "", "Use file or directory content as input in stream mode")
 	flag.StringVar(&inputFiles, "i", "", "Use file or directory content as input in stream mode (short)")
+	var rulesFile string
+	flag.StringVar(&rulesFile, "rules", "", "File with the project include/exclude rules (default: .editor.json in the project)")
+	var sessionName string
+	flag.StringVar(&sessionName, "session", "", "Name of the session to restore and save")
+	var backupFlag string
+	flag.StringVar(&backupFlag, "backup", "none", "Backup kept on save: none, tilde (file~) or time (file.YYYYMMDD-HHMMSS~)")
 
 	flag.Usage = printUsageExtended
 	flag.Parse()
@@ -659,6 +573,11 @@ func main() {
 		}
 		return
 	}
+	backupMode, err := parseBackupMode(backupFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Backup:", err)
+		os.Exit(1)
+	}
 	args := flag.Args()
 	switch {
 	case len(args) >= 3:
@@ -696,6 +615,17 @@ func main() {
 		path = args[0]
 	default:
 	}
+	rulesRoot := ""
+	if !isGitHubURL(path) {
+		rulesRoot = "."
+		if info, err := os.Stat(path); path != "" && err == nil && info.IsDir() {
+			rulesRoot = path
+		}
+	}
+	if err := loadProjectRules(rulesFile, rulesRoot); err != nil {
+		fmt.Fprintln(os.Stderr, "Rules:", err)
+		os.Exit(1)
+	}
 	if isGitHubURL(path) {
 		if len(args) >= 5 {
 			githubToken = args[4]
@@ -709,6 +639,8 @@ func main() {
 			os.Exit(1)
 		}
 		editor.llmKey = keyFromArg
+		editor.undoLimit = undoLimitMB << 20
+		editor.backupMode = backupMode
 
 		if err := editor.Run(); err != nil {
 			fmt.Fprintln(os.Stderr, "Editor startup error:", err)
@@ -722,10 +654,18 @@ func main() {
 	if path == "" && flag.NArg() > 0 && len(args) == 0 {
 		path = flag.Arg(0)
 	}
+	sessionPath, err := sessionFilePath(sessionName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Session:", err)
+		os.Exit(1)
+	}
 	if path != "" {
 		if info, err := os.Stat(path); err == nil && info.IsDir() {
 			editor := NewEditorWithProject(path, provider, model)
 			editor.llmKey = keyFromArg
+			editor.undoLimit = undoLimitMB << 20
+			editor.backupMode = backupMode
+			editor.sessionPath = sessionPath
 			if editor == nil {
 				return
 			}
@@ -736,8 +676,17 @@ func main() {
 			return
 		}
 	}
-	editor := NewEditor(path, provider, model)
+	var editor *Editor
+	if path == "" {
+		editor = restoreSession(sessionPath, provider, model)
+	}
+	if editor == nil {
+		editor = NewEditor(path, provider, model)
+	}
 	editor.llmKey = keyFromArg
+	editor.undoLimit = undoLimitMB << 20
+	editor.backupMode = backupMode
+	editor.sessionPath = sessionPath
 	if editor == nil {
 		return
 	}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// minPaneWidth and minPaneHeight are the smallest pane sizes a split may create.
+const (
+	minPaneWidth  = 10
+	minPaneHeight = 3
+)
+
+// paneResizeStep is how much of its parent area a pane grows or shrinks by.
+const paneResizeStep = 0.1
+
+// Pane is one view of a split layout: the canvas it shows and its own cursor
+// and scroll position. The state of the active pane lives in the editor.
+// Pane — вид разделённого окна: канвас и собственные курсор и прокрутка.
+type Pane struct {
+	canvas    int
+	cx, cy    int
+	offsetX   int
+	offsetY   int
+	offsetSeg int
+}
+
+// paneNode is a node of the split layout. A leaf shows a pane; an inner node
+// divides its area between first and second, side by side when vertical and
+// one above the other otherwise. ratio is the share of first.
+type paneNode struct {
+	pane     *Pane
+	vertical bool
+	ratio    float64
+	first    *paneNode
+	second   *paneNode
+	parent   *paneNode
+}
+
+// paneRect is a screen area in cells.
+type paneRect struct {
+	x, y, w, h int
+}
+
+// viewScreen draws into one pane: coordinates of the text area are moved
+// into the pane's rectangle and clipped to it, and only the active pane
+// places the cursor.
+type viewScreen struct {
+	tcell.Screen
+	rect   paneRect
+	top    int
+	active bool
+}
+
+// SetContent draws a cell of the text area inside the pane.
+func (v *viewScreen) SetContent(x, y int, primary rune, combining []rune, style tcell.Style) {
+	y -= v.top
+	if x < 0 || y < 0 || x >= v.rect.w || y >= v.rect.h {
+		return
+	}
+	v.Screen.SetContent(v.rect.x+x, v.rect.y+y, primary, combining, style)
+}
+
+// ShowCursor places the cursor if the pane is active.
+func (v *viewScreen) ShowCursor(x, y int) {
+	if v.active {
+		v.Screen.ShowCursor(v.rect.x+x, v.rect.y+y-v.top)
+	}
+}
+
+// HideCursor hides the cursor if the pane is active.
+func (v *viewScreen) HideCursor() {
+	if v.active {
+		v.Screen.HideCursor()
+	}
+}
+
+// leaves returns the leaves under n from left to right and top to bottom.
+func (n *paneNode) leaves() []*paneNode {
+	if n.pane != nil {
+		return []*paneNode{n}
+	}
+	return append(n.first.leaves(), n.second.leaves()...)
+}
+
+// splitSize returns the size of the first part when total cells are divided
+// at ratio, leaving one cell for the separator.
+func splitSize(total int, ratio float64) int {
+	a := int(float64(total-1) * ratio)
+	if a > total-2 {
+		a = total - 2
+	}
+	if a < 1 {
+		a = 1
+	}
+	return a
+}
+
+// layout stores the area of every leaf under n, which covers r, in out.
+func (n *paneNode) layout(r paneRect, out map[*paneNode]paneRect) {
+	if n.pane != nil {
+		out[n] = r
+		return
+	}
+	if n.vertical {
+		a := splitSize(r.w, n.ratio)
+		n.first.layout(paneRect{r.x, r.y, a, r.h}, out)
+		n.second.layout(paneRect{r.x + a + 1, r.y, r.w - a - 1, r.h}, out)
+		return
+	}
+	a := splitSize(r.h, n.ratio)
+	n.first.layout(paneRect{r.x, r.y, r.w, a}, out)
+	n.second.layout(paneRect{r.x, r.y + a + 1, r.w, r.h - a - 1}, out)
+}
+
+// textRect returns the screen area of the text, between the bars and right
+// of the file tree.
+func (e *Editor) textRect() paneRect {
+	x := e.treeWidth()
+	if x > 0 {
+		x++
+	}
+	return paneRect{x, e.textTop(), e.contentWidth - x, e.contentHeight - 3 - e.tabBarHeight}
+}
+
+// paneRects returns the screen area of every pane.
+func (e *Editor) paneRects() map[*paneNode]paneRect {
+	rects := make(map[*paneNode]paneRect)
+	e.panes.layout(e.textRect(), rects)
+	return rects
+}
+
+// saveActivePane stores the editor's view of the current canvas in the active pane.
+func (e *Editor) saveActivePane() {
+	p := e.activePane.pane
+	p.canvas = e.currentCanvas
+	p.cx, p.cy = e.cx, e.cy
+	p.offsetX, p.offsetY, p.offsetSeg = e.offsetX, e.offsetY, e.offsetSeg
+}
+
+// loadPane makes the canvas of p current with the cursor and scroll of p.
+// A pane whose canvas was closed shows the current canvas instead.
+func (e *Editor) loadPane(p *Pane) {
+	if _, ok := e.canvases[p.canvas]; !ok {
+		p.canvas = e.currentCanvas
+	}
+	e.currentCanvas = p.canvas
+	e.syncCanvasToEditor()
+	e.cy, e.cx = e.clampPos(p.cy, p.cx)
+	e.offsetX, e.offsetY, e.offsetSeg = p.offsetX, p.offsetY, p.offsetSeg
+}
+
+// splitPane divides the active pane in two, side by side when vertical and
+// one above the other otherwise. Both show the current canvas; the new pane
+// gets the focus.
+// splitPane делит активную панель на две, по вертикали или по горизонтали.
+func (e *Editor) splitPane(vertical bool) {
+	if e.panes == nil {
+		e.panes = &paneNode{pane: &Pane{}}
+		e.activePane = e.panes
+	}
+	r := e.paneRects()[e.activePane]
+	if vertical && r.w < 2*minPaneWidth+1 || !vertical && r.h < 2*minPaneHeight+1 {
+		if e.panes.pane != nil {
+			e.panes, e.activePane = nil, nil
+		}
+		e.showError("The pane is too small to split")
+		return
+	}
+	e.syncEditorToCanvas()
+	e.saveActivePane()
+	n := e.activePane
+	first := &paneNode{pane: n.pane, parent: n}
+	clone := *n.pane
+	second := &paneNode{pane: &clone, parent: n}
+	n.pane, n.vertical, n.ratio = nil, vertical, 0.5
+	n.first, n.second = first, second
+	e.activePane = second
+	e.statusMessage("Split the pane")
+}
+
+// focusPane makes n the active pane.
+func (e *Editor) focusPane(n *paneNode) {
+	if n == e.activePane {
+		return
+	}
+	e.endSelection()
+	e.syncEditorToCanvas()
+	e.saveActivePane()
+	e.activePane = n
+	e.loadPane(n.pane)
+	e.ensureVisible()
+}
+
+// focusNextPane moves the focus to the next pane, wrapping around.
+// focusNextPane переводит фокус на следующую панель.
+func (e *Editor) focusNextPane() {
+	if e.panes == nil {
+		e.statusMessage("The window is not split")
+		return
+	}
+	leaves := e.panes.leaves()
+	for i, n := range leaves {
+		if n == e.activePane {
+			e.focusPane(leaves[(i+1)%len(leaves)])
+			return
+		}
+	}
+}
+
+// closePane removes the active pane; its sibling takes over the area and the
+// focus. The canvas stays open.
+// closePane закрывает активную панель, канвас остаётся открытым.
+func (e *Editor) closePane() {
+	if e.panes == nil {
+		e.statusMessage("The window is not split")
+		return
+	}
+	parent := e.activePane.parent
+	sibling := parent.first
+	if sibling == e.activePane {
+		sibling = parent.second
+	}
+	e.syncEditorToCanvas()
+	parent.pane, parent.vertical, parent.ratio = sibling.pane, sibling.vertical, sibling.ratio
+	parent.first, parent.second = sibling.first, sibling.second
+	if parent.pane == nil {
+		parent.first.parent, parent.second.parent = parent, parent
+	}
+	next := parent.leaves()[0]
+	e.activePane = next
+	e.endSelection()
+	e.loadPane(next.pane)
+	if e.panes.pane != nil {
+		e.panes, e.activePane = nil, nil
+	}
+	e.ensureVisible()
+	e.statusMessage("Closed the pane")
+}
+
+// resizePane grows (delta > 0) or shrinks the active pane within its split.
+// resizePane увеличивает или уменьшает активную панель.
+func (e *Editor) resizePane(delta float64) {
+	if e.panes == nil {
+		e.statusMessage("The window is not split")
+		return
+	}
+	parent := e.activePane.parent
+	if e.activePane != parent.first {
+		delta = -delta
+	}
+	parent.ratio += delta
+	if parent.ratio < paneResizeStep {
+		parent.ratio = paneResizeStep
+	}
+	if parent.ratio > 1-paneResizeStep {
+		parent.ratio = 1 - paneResizeStep
+	}
+}
+
+// drawPanes draws the text area: the current canvas alone, or every pane of
+// the split layout with separators between them.
+// drawPanes рисует область текста: один канвас или все панели разделённого окна.
+func (e *Editor) drawPanes() {
+	full := e.textRect()
+	if e.panes == nil {
+		if full.x == 0 {
+			e.drawTextArea()
+			return
+		}
+		e.drawView(full, true, func() {
+			e.ensureVisible()
+			e.drawTextArea()
+		})
+		return
+	}
+	rects := e.paneRects()
+	e.drawSeparators(e.panes, full)
+	for _, n := range e.panes.leaves() {
+		n := n
+		e.drawView(rects[n], n == e.activePane, func() {
+			if n == e.activePane {
+				e.ensureVisible()
+				e.drawTextArea()
+			} else {
+				e.drawInactivePane(n.pane)
+			}
+		})
+	}
+}
+
+// drawView runs draw with the screen and the layout sizes narrowed to r.
+func (e *Editor) drawView(r paneRect, active bool, draw func()) {
+	real := e.screen
+	w, h, panel := e.contentWidth, e.contentHeight, e.structurePanelWidth
+	e.screen = &viewScreen{Screen: real, rect: r, top: e.textTop(), active: active}
+	e.layoutSize(r.w, r.h+3+e.tabBarHeight)
+	draw()
+	e.screen = real
+	e.structurePanelWidth = panel
+	e.layoutSize(w, h)
+}
+
+// drawInactivePane draws pane p and restores the active pane's state.
+func (e *Editor) drawInactivePane(p *Pane) {
+	e.syncEditorToCanvas()
+	cur := e.currentCanvas
+	cx, cy, offsetX, offsetY, offsetSeg := e.cx, e.cy, e.offsetX, e.offsetY, e.offsetSeg
+	selecting, undoOpen, typing, rs := e.selecting, e.undoOpen, e.typing, e.replaceSession
+
+	e.loadPane(p)
+	e.layoutSize(e.contentWidth, e.contentHeight)
+	e.selecting, e.replaceSession = false, nil
+	e.ensureVisible()
+	e.drawTextArea()
+	p.cx, p.cy, p.offsetX, p.offsetY, p.offsetSeg = e.cx, e.cy, e.offsetX, e.offsetY, e.offsetSeg
+
+	e.currentCanvas = cur
+	e.syncCanvasToEditor()
+	e.cx, e.cy, e.offsetX, e.offsetY, e.offsetSeg = cx, cy, offsetX, offsetY, offsetSeg
+	e.selecting, e.undoOpen, e.typing, e.replaceSession = selecting, undoOpen, typing, rs
+}
+
+// drawSeparators draws the lines between the panes under n, which covers r.
+// A horizontal line carries the name of the canvas in the pane above it.
+func (e *Editor) drawSeparators(n *paneNode, r paneRect) {
+	if n.pane != nil {
+		return
+	}
+	style := tcell.StyleDefault.Foreground(tcell.ColorGray)
+	if n.vertical {
+		a := splitSize(r.w, n.ratio)
+		for y := r.y; y < r.y+r.h; y++ {
+			e.screen.SetContent(r.x+a, y, '│', nil, style)
+		}
+		e.drawSeparators(n.first, paneRect{r.x, r.y, a, r.h})
+		e.drawSeparators(n.second, paneRect{r.x + a + 1, r.y, r.w - a - 1, r.h})
+		return
+	}
+	a := splitSize(r.h, n.ratio)
+	label := ""
+	if n.first.pane != nil {
+		canvas := n.first.pane.canvas
+		if n.first == e.activePane {
+			canvas = e.currentCanvas
+		}
+		if c, ok := e.canvases[canvas]; ok {
+			label = "─" + tabLabel(canvas, c)
+		}
+	}
+	x := r.x
+	for _, ch := range label {
+		if x >= r.x+r.w {
+			break
+		}
+		e.screen.SetContent(x, r.y+a, ch, nil, style)
+		x += runewidth.RuneWidth(ch)
+	}
+	for ; x < r.x+r.w; x++ {
+		e.screen.SetContent(x, r.y+a, '─', nil, style)
+	}
+	e.drawSeparators(n.first, paneRect{r.x, r.y, r.w, a})
+	e.drawSeparators(n.second, paneRect{r.x, r.y + a + 1, r.w, r.h - a - 1})
+}
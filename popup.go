@@ -0,0 +1,213 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// ListPopup is a modal list drawn over the text area; Enter passes the
+// index of the selected item to Callback. When Filter is set, typed text is
+// collected in Query and Filter recomputes Items after every change.
+// ListPopup — модальный список поверх текста; Enter передаёт индекс
+// выбранного элемента в Callback. Если задан Filter, набранный текст
+// попадает в Query, и Filter пересчитывает Items.
+type ListPopup struct {
+	Title    string
+	Items    []string
+	Selected int
+	Offset   int
+	Callback func(int)
+	Query    string
+	Filter   func(query string) []string
+}
+
+// showListPopup opens a list popup with the item selected preselected.
+// showListPopup открывает всплывающий список.
+func (e *Editor) showListPopup(title string, items []string, selected int, cb func(int)) {
+	if selected < 0 || selected >= len(items) {
+		selected = 0
+	}
+	e.listPopup = &ListPopup{
+		Title:    title,
+		Items:    items,
+		Selected: selected,
+		Callback: cb,
+	}
+	e.prompt = nil
+	e.multiLinePrompt = nil
+	e.scrollPopupToSelected()
+}
+
+// showFilterPopup opens a list popup whose items are produced by filter
+// from the text typed so far.
+// showFilterPopup открывает всплывающий список с фильтром по набранному тексту.
+func (e *Editor) showFilterPopup(title string, filter func(string) []string, cb func(int)) {
+	e.showListPopup(title, filter(""), 0, cb)
+	e.listPopup.Filter = filter
+}
+
+// popupRows returns how many items fit into the popup.
+func (e *Editor) popupRows() int {
+	rows := e.contentHeight - 7 - e.tabBarHeight
+	p := e.listPopup
+	if p != nil && p.Filter != nil {
+		rows--
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	if p != nil && p.Filter == nil && len(p.Items) < rows {
+		rows = len(p.Items)
+	}
+	return rows
+}
+
+// handleListPopupInput handles keys while a list popup is open.
+// handleListPopupInput обрабатывает клавиши во всплывающем списке.
+func (e *Editor) handleListPopupInput(ev *tcell.EventKey) {
+	p := e.listPopup
+	rows := e.popupRows()
+	switch ev.Key() {
+	case tcell.KeyEsc:
+		e.listPopup = nil
+		return
+	case tcell.KeyEnter:
+		e.listPopup = nil
+		if p.Callback != nil && p.Selected >= 0 && p.Selected < len(p.Items) {
+			p.Callback(p.Selected)
+		}
+		return
+	case tcell.KeyUp:
+		p.Selected--
+	case tcell.KeyDown:
+		p.Selected++
+	case tcell.KeyPgUp:
+		p.Selected -= rows
+	case tcell.KeyPgDn:
+		p.Selected += rows
+	case tcell.KeyHome:
+		p.Selected = 0
+	case tcell.KeyEnd:
+		p.Selected = len(p.Items) - 1
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if r := []rune(p.Query); p.Filter != nil && len(r) > 0 {
+			e.setPopupQuery(string(r[:len(r)-1]))
+		}
+		return
+	case tcell.KeyRune:
+		if p.Filter != nil && ev.Modifiers()&tcell.ModAlt == 0 {
+			e.setPopupQuery(p.Query + string(ev.Rune()))
+		}
+		return
+	}
+	e.scrollPopupToSelected()
+}
+
+// scrollPopupToSelected clamps the selection of the open popup to its items
+// and scrolls the popup so that the selected item is visible.
+// scrollPopupToSelected прокручивает список так, чтобы выбранный элемент был виден.
+func (e *Editor) scrollPopupToSelected() {
+	p := e.listPopup
+	rows := e.popupRows()
+	if p.Selected >= len(p.Items) {
+		p.Selected = len(p.Items) - 1
+	}
+	if p.Selected < 0 {
+		p.Selected = 0
+	}
+	if p.Selected < p.Offset {
+		p.Offset = p.Selected
+	} else if p.Selected >= p.Offset+rows {
+		p.Offset = p.Selected - rows + 1
+	}
+}
+
+// setPopupQuery refilters the open popup for query and selects the first item.
+func (e *Editor) setPopupQuery(query string) {
+	p := e.listPopup
+	p.Query = query
+	p.Items = p.Filter(query)
+	p.Selected = 0
+	p.Offset = 0
+}
+
+// drawListPopup draws the open list popup centred over the text area.
+// drawListPopup рисует всплывающий список по центру текстовой области.
+func (e *Editor) drawListPopup() {
+	p := e.listPopup
+	if p == nil {
+		return
+	}
+	rows := e.popupRows()
+	width := runewidth.StringWidth(p.Title) + 4
+	for _, it := range p.Items {
+		if w := runewidth.StringWidth(it) + 4; w > width {
+			width = w
+		}
+	}
+	if p.Filter != nil && width < 60 {
+		width = 60
+	}
+	if width > e.contentWidth-4 {
+		width = e.contentWidth - 4
+	}
+	if width < 10 {
+		width = 10
+	}
+	left := (e.contentWidth - width) / 2
+	top := e.textTop() + 1
+
+	frame := tcell.StyleDefault.Background(tcell.ColorDarkBlue).Foreground(tcell.ColorWhite)
+	normal := tcell.StyleDefault.Background(tcell.ColorBlack).Foreground(tcell.ColorWhite)
+	selected := tcell.StyleDefault.Background(tcell.ColorWhite).Foreground(tcell.ColorBlack)
+
+	e.drawPopupLine(left, top, width, " "+p.Title, frame)
+	if p.Filter != nil {
+		top++
+		e.drawPopupLine(left, top, width, " > "+p.Query, selected)
+	}
+	for i := 0; i < rows; i++ {
+		idx := p.Offset + i
+		style := normal
+		text := ""
+		if idx < len(p.Items) {
+			text = " " + p.Items[idx]
+			if idx == p.Selected {
+				style = selected
+			}
+		}
+		e.drawPopupLine(left, top+1+i, width, text, style)
+	}
+	footer := ""
+	if len(p.Items) == 0 {
+		footer = " (empty)"
+	} else if len(p.Items) > rows {
+		footer = " " + strconv.Itoa(p.Selected+1) + "/" + strconv.Itoa(len(p.Items))
+	}
+	e.drawPopupLine(left, top+1+rows, width, footer, frame)
+	e.screen.HideCursor()
+}
+
+// drawPopupLine draws text padded to width cells at (x, y).
+func (e *Editor) drawPopupLine(x, y, width int, text string, style tcell.Style) {
+	pos := 0
+	for _, r := range text {
+		rw := runewidth.RuneWidth(r)
+		if rw == 0 {
+			continue
+		}
+		if pos+rw > width {
+			break
+		}
+		e.screen.SetContent(x+pos, y, r, nil, style)
+		for c := 1; c < rw; c++ {
+			e.screen.SetContent(x+pos+c, y, ' ', nil, style)
+		}
+		pos += rw
+	}
+	for ; pos < width; pos++ {
+		e.screen.SetContent(x+pos, y, ' ', nil, style)
+	}
+}
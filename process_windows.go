@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// processQueryLimitedInformation is PROCESS_QUERY_LIMITED_INFORMATION,
+	// enough to read the exit code of another user's process.
+	processQueryLimitedInformation = 0x1000
+	// stillActive is the exit code of a process that has not exited.
+	stillActive = 259
+)
+
+// processAlive reports whether a process with this pid is running. Windows
+// has no signal 0, so the exit code of the process is asked for instead.
+// processAlive сообщает, работает ли процесс с этим pid.
+func processAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		// A process we may not open still exists.
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// projectIgnoreFile is the project-local ignore file. It uses the .gitignore
+// syntax; a "!pattern" line also adds matching files the rules below leave out.
+const projectIgnoreFile = ".editorignore"
+
+// projectRulesFile is the project-local file with include and exclude rules.
+const projectRulesFile = ".editor.json"
+
+// ProjectRules decides which files make up a project: the include globs,
+// matched against the file name, and the exclude patterns in .gitignore
+// syntax. The include globs are grouped the way the project overview lists
+// the files.
+// ProjectRules определяет, какие файлы входят в проект.
+type ProjectRules struct {
+	Source  []string
+	Config  []string
+	Docs    []string
+	Exclude []string
+}
+
+// defaultProjectRules are the rules of a project without a rules file.
+var defaultProjectRules = ProjectRules{
+	Source: []string{
+		"*.c", "*.h", "*.cpp", "*.cc", "*.cxx", "*.hpp", "*.hh", "*.s", "*.asm",
+		"*.f", "*.for", "*.f90", "*.f95", "*.f03",
+		"*.go", "*.py", "*.rb", "*.kt", "*.kts", "*.swift", "*.html", "*.htm",
+		"*.lisp", "*.lsp", "*.cl", "*.el",
+		"*.ts", "*.rs", "*.java", "*.proto",
+	},
+	Config: []string{
+		"Makefile", "makefile", "Dockerfile", ".gitignore", projectIgnoreFile, projectRulesFile,
+		"go.mod", "go.sum", "package.json", "package-lock.json", "requirements.txt",
+		"Pipfile", "Cargo.toml", "Cargo.lock", "pom.xml", "build.gradle",
+		"build.gradle.kts", "CMakeLists.txt", ".env", ".env.example",
+		"docker-compose.yml", "docker-compose.yaml", "*.yaml", "*.yml",
+	},
+	Docs: []string{
+		"README.md", "README", "README.txt", "LICENSE", "LICENSE.txt", "COPYING",
+		"CREDITS.md", "CREDITS", "CREDITS.txt",
+	},
+	Exclude: []string{"node_modules/"},
+}
+
+// projectRules are the rules used for every project: the file index, the
+// overview, the LLM project context and the project walks.
+var projectRules = defaultProjectRules
+
+// projectRulesConfig is the content of a rules file. Its lists are added to
+// the default ones; with ReplaceDefaults a list that is given replaces the
+// default one instead.
+// projectRulesConfig — содержимое файла правил проекта.
+type projectRulesConfig struct {
+	Source          []string `json:"source"`
+	Config          []string `json:"config"`
+	Docs            []string `json:"docs"`
+	Exclude         []string `json:"exclude"`
+	ReplaceDefaults bool     `json:"replace_defaults"`
+}
+
+// loadProjectRules makes the rules in file, or in the rules file of the
+// project at root if file is empty, the project rules. Without a rules file
+// the defaults stay.
+// loadProjectRules загружает правила проекта из файла.
+func loadProjectRules(file, root string) error {
+	if file == "" {
+		if root == "" {
+			return nil
+		}
+		file = filepath.Join(root, projectRulesFile)
+		if _, err := os.Stat(file); err != nil {
+			return nil
+		}
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var cfg projectRulesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	merge := func(def, list []string) []string {
+		if cfg.ReplaceDefaults && list != nil {
+			return list
+		}
+		return append(append([]string(nil), def...), list...)
+	}
+	projectRules = ProjectRules{
+		Source:  merge(defaultProjectRules.Source, cfg.Source),
+		Config:  merge(defaultProjectRules.Config, cfg.Config),
+		Docs:    merge(defaultProjectRules.Docs, cfg.Docs),
+		Exclude: merge(defaultProjectRules.Exclude, cfg.Exclude),
+	}
+	return nil
+}
+
+// matchesAny reports whether the file name matches one of globs, as written
+// or in lower case.
+func matchesAny(globs []string, name string) bool {
+	lower := strings.ToLower(name)
+	for _, g := range globs {
+		if ok, _ := filepath.Match(g, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(g, lower); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isSourceFile checks if a file name indicates a source code file
+// isSourceFile проверяет, указывает ли имя файла на файл исходного кода
+func isSourceFile(filename string) bool {
+	return matchesAny(projectRules.Source, filepath.Base(filename))
+}
+
+// isConfigFile checks if filename indicates a configuration file
+// isConfigFile проверяет, указывает ли имя файла на файл конфигурации
+func isConfigFile(filename string) bool {
+	return matchesAny(projectRules.Config, filepath.Base(filename))
+}
+
+// isDocFile checks if filename indicates a documentation file
+// isDocFile проверяет, указывает ли имя файла на файл документации
+func isDocFile(filename string) bool {
+	return matchesAny(projectRules.Docs, filepath.Base(filename))
+}
+
+// ignoreRule is one line of an ignore file.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// projectMatcher applies the exclude patterns, .gitignore and the project
+// ignore file of every directory to paths relative to the project root.
+// Ignore files are read on first use.
+// projectMatcher применяет исключения, .gitignore и файл игнорирования проекта.
+type projectMatcher struct {
+	root    string
+	exclude []ignoreRule
+	dirs    map[string][]ignoreRule
+}
+
+// newProjectMatcher returns the matcher of the project at root.
+func newProjectMatcher(root string) *projectMatcher {
+	return &projectMatcher{
+		root:    root,
+		exclude: parseIgnoreRules(projectRules.Exclude),
+		dirs:    make(map[string][]ignoreRule),
+	}
+}
+
+// globRegexp translates a .gitignore glob into a regular expression body.
+func globRegexp(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(p[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := p[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// parseIgnoreRules compiles lines in .gitignore syntax. A pattern with a
+// slash other than a trailing one is anchored to its directory; any other
+// pattern matches at every level below it.
+func parseIgnoreRules(lines []string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		expr := "^" + globRegexp(line) + "$"
+		if !anchored {
+			expr = "^(?:.*/)?" + globRegexp(line) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// rulesFor returns the rules of the ignore files in dir, a slash-separated
+// path relative to the root.
+func (m *projectMatcher) rulesFor(dir string) []ignoreRule {
+	if rules, ok := m.dirs[dir]; ok {
+		return rules
+	}
+	var lines []string
+	for _, name := range []string{".gitignore", projectIgnoreFile} {
+		data, err := os.ReadFile(filepath.Join(m.root, filepath.FromSlash(dir), name))
+		if err == nil {
+			lines = append(lines, strings.Split(string(data), "\n")...)
+		}
+	}
+	rules := parseIgnoreRules(lines)
+	m.dirs[dir] = rules
+	return rules
+}
+
+// match reports whether the path rel is ignored and whether the last rule
+// that matched it was a "!" one. Hidden directories are ignored unless a
+// rule brings them back. The directories above rel are not checked; walks
+// skip ignored directories instead.
+func (m *projectMatcher) match(rel string, dir bool) (ignored, negated bool) {
+	rel = filepath.ToSlash(rel)
+	ignored = dir && skipProjectDir(path.Base(rel))
+	apply := func(rules []ignoreRule, sub string) {
+		for _, r := range rules {
+			if r.dirOnly && !dir || !r.re.MatchString(sub) {
+				continue
+			}
+			ignored, negated = !r.negate, r.negate
+		}
+	}
+	apply(m.exclude, rel)
+	apply(m.rulesFor(""), rel)
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' {
+			apply(m.rulesFor(rel[:i]), rel[i+1:])
+		}
+	}
+	return ignored, negated
+}
+
+// ignored reports whether the path rel is left out of the project.
+func (m *projectMatcher) ignored(rel string, dir bool) bool {
+	ignored, _ := m.match(rel, dir)
+	return ignored
+}
+
+// included reports whether the file rel belongs to the project index: it is
+// not ignored and either matches the include globs or is named by a "!" rule.
+func (m *projectMatcher) included(rel string) bool {
+	ignored, negated := m.match(rel, false)
+	if ignored {
+		return false
+	}
+	name := filepath.Base(rel)
+	return negated || isSourceFile(name) || isConfigFile(name) || isDocFile(name)
+}
+
+// walk calls fn for every file under the root that is not ignored, with its
+// path relative to the root. Ignored directories are not entered. Only an
+// error reading the root itself is returned.
+// walk обходит файлы проекта, пропуская игнорируемые.
+func (m *projectMatcher) walk(fn func(rel string, info os.FileInfo)) error {
+	return filepath.Walk(m.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == m.root {
+				return err
+			}
+			return nil
+		}
+		if p == m.root {
+			return nil
+		}
+		rel, err := filepath.Rel(m.root, p)
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if m.ignored(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !m.ignored(rel, false) {
+			fn(rel, info)
+		}
+		return nil
+	})
+}
+
+// listProjectIndex returns the sorted paths, relative to dirPath, of the
+// files of a project. No file is read.
+// listProjectIndex возвращает отсортированные пути файлов проекта, не читая их.
+func listProjectIndex(dirPath string) ([]string, error) {
+	m := newProjectMatcher(dirPath)
+	var files []string
+	err := m.walk(func(rel string, info os.FileInfo) {
+		if m.included(rel) {
+			files = append(files, rel)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
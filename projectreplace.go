@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// projectReplaceEntry is one line of a file canvas offered for replacement.
+type projectReplaceEntry struct {
+	canvas  int
+	line    int
+	old     string
+	new     string
+	row     int
+	checked bool
+}
+
+// projectReplaceStep is the undo step a project replace left in one canvas.
+type projectReplaceStep struct {
+	canvas  int
+	history *UndoTree
+	node    *undoNode
+}
+
+// projectReplace is the state of the replace preview canvas: the entries it
+// lists and, once applied, the undo steps that make up the change.
+// projectReplace — состояние канваса предпросмотра замены по проекту.
+type projectReplace struct {
+	query   string
+	repl    string
+	entries []projectReplaceEntry
+	steps   []projectReplaceStep
+	undone  bool
+}
+
+// showProjectReplacePreview collects every line of the file canvases that a
+// replace of old with repl would change and lists them in the replace
+// preview canvas. Project files with matches that have no canvas, such as
+// those past the canvas limit, are listed at the end as not replaced.
+// Nothing is changed until the preview is applied.
+// showProjectReplacePreview показывает строки, которые изменит замена по проекту.
+func (e *Editor) showProjectReplacePreview(root, old, repl string) {
+	s, err := NewSearcher(old, e.searchOpts)
+	if err != nil {
+		e.showError("Invalid pattern: " + err.Error())
+		return
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	e.syncEditorToCanvas()
+
+	type file struct {
+		name   string
+		canvas int
+	}
+	var files []file
+	open := make(map[string]bool)
+	for num, c := range e.canvases {
+		if c.kind != CanvasFile || c.filename == "" || c.isProjectOverview() {
+			continue
+		}
+		name := c.filename
+		if abs, err := filepath.Abs(name); err == nil {
+			open[abs] = true
+			if rel, err := filepath.Rel(root, abs); err == nil && !strings.HasPrefix(rel, "..") {
+				name = rel
+			}
+		}
+		files = append(files, file{name: name, canvas: num})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	pr := &projectReplace{query: old, repl: repl}
+	lines := []string{"", "Space toggles the entry or file under the cursor, Enter applies the checked entries.", ""}
+	changed := 0
+	for _, f := range files {
+		// A canvas not viewed yet is scanned from disk and loaded only when
+		// it has a match to replace.
+		c := e.canvases[f.canvas]
+		var text []string
+		if c.buf != nil {
+			text = c.buf.Lines()
+		} else {
+			text = strings.Split(c.text(), "\n")
+		}
+		header := false
+		for y, line := range text {
+			replaced, n := s.ReplaceLine(line, repl, 0, len(line))
+			if n == 0 {
+				continue
+			}
+			if !header {
+				c.load()
+				lines = append(lines, f.name)
+				header = true
+				changed++
+			}
+			pr.entries = append(pr.entries, projectReplaceEntry{
+				canvas:  f.canvas,
+				line:    y,
+				old:     line,
+				new:     replaced,
+				row:     len(lines),
+				checked: true,
+			})
+			lines = append(lines, fmt.Sprintf("[x] %5d: %s", y+1, line), "    =>     "+replaced)
+		}
+	}
+	lines[0] = fmt.Sprintf("Replace %q with %q: %d line(s) in %d file(s).", old, repl, len(pr.entries), changed)
+
+	var skipped []string
+	for _, m := range e.searchProject(root, s) {
+		if open[m.path] || len(skipped) > 0 && skipped[len(skipped)-1] == m.path {
+			continue
+		}
+		skipped = append(skipped, m.path)
+	}
+	if len(skipped) > 0 {
+		lines[0] += fmt.Sprintf(" %d file(s) without a canvas are not replaced.", len(skipped))
+		lines = append(lines, "", "NOT REPLACED (no canvas; open them with Ctrl+O and replace again):")
+		for _, p := range skipped {
+			if rel, err := filepath.Rel(root, p); err == nil {
+				p = rel
+			}
+			lines = append(lines, "  "+p)
+		}
+	}
+	if !e.showGeneratedCanvas(CanvasReplacePreview, lines) {
+		return
+	}
+	e.projectReplace = pr
+	if len(pr.entries) > 0 {
+		e.cy = pr.entries[0].row
+	}
+	e.ensureVisible()
+}
+
+// handleReplacePreviewKey handles keys in the replace preview canvas. The
+// canvas is read-only: Space toggles entries, Enter applies them, Ctrl-Z and
+// Ctrl-E undo and redo the whole change. It reports whether ev was consumed.
+// handleReplacePreviewKey обрабатывает клавиши в канвасе предпросмотра замены.
+func (e *Editor) handleReplacePreviewKey(ev *tcell.EventKey) bool {
+	c, ok := e.canvases[e.currentCanvas]
+	if !ok || c.kind != CanvasReplacePreview {
+		return false
+	}
+	pr := e.projectReplace
+	switch ev.Key() {
+	case tcell.KeyRune:
+		if ev.Rune() == ' ' && pr != nil && pr.steps == nil {
+			e.toggleReplaceEntries()
+		}
+		return true
+	case tcell.KeyEnter:
+		if pr != nil {
+			e.applyProjectReplace()
+		}
+		return true
+	case tcell.KeyCtrlZ, tcell.KeyCtrlE:
+		if pr != nil {
+			e.undoProjectReplace(ev.Key() == tcell.KeyCtrlE)
+		}
+		return true
+	case tcell.KeyBackspace, tcell.KeyBackspace2, tcell.KeyDelete, tcell.KeyTab,
+		tcell.KeyCtrlX, tcell.KeyCtrlV, tcell.KeyCtrlK, tcell.KeyCtrlU, tcell.KeyCtrlY, tcell.KeyCtrlW:
+		return true
+	}
+	return false
+}
+
+// setPreviewLine rewrites a line of the preview canvas without recording undo.
+func (e *Editor) setPreviewLine(y int, s string) {
+	e.buf.SetLine(y, s)
+	e.bufferEdited(y, "", "")
+}
+
+// toggleReplaceEntries checks or unchecks the entry under the cursor, or all
+// entries of the file whose name is under the cursor.
+func (e *Editor) toggleReplaceEntries() {
+	pr := e.projectReplace
+	var hit []int
+	for i, en := range pr.entries {
+		if e.cy == en.row || e.cy == en.row+1 {
+			hit = []int{i}
+			break
+		}
+		if e.cy == en.row-1 && (i == 0 || pr.entries[i-1].canvas != en.canvas) {
+			for j := i; j < len(pr.entries) && pr.entries[j].canvas == en.canvas; j++ {
+				hit = append(hit, j)
+			}
+			break
+		}
+	}
+	if len(hit) == 0 {
+		return
+	}
+	checked := !pr.entries[hit[0]].checked
+	for _, i := range hit {
+		en := &pr.entries[i]
+		en.checked = checked
+		mark := "[ ]"
+		if checked {
+			mark = "[x]"
+		}
+		e.setPreviewLine(en.row, mark+e.buf.Line(en.row)[3:])
+	}
+}
+
+// applyProjectReplace applies the checked entries. Each file gets one undo
+// step; together they are undone by Ctrl-Z in the preview canvas. Lines that
+// changed after the preview was built are skipped.
+// applyProjectReplace применяет отмеченные замены; каждый файл получает один
+// шаг отмены, а Ctrl-Z в канвасе предпросмотра отменяет их все вместе.
+func (e *Editor) applyProjectReplace() {
+	pr := e.projectReplace
+	if pr.steps != nil {
+		e.statusMessage("The replace has already been applied; Ctrl-Z undoes it")
+		return
+	}
+	byCanvas := make(map[int][]projectReplaceEntry)
+	var order []int
+	for _, en := range pr.entries {
+		if !en.checked {
+			continue
+		}
+		if _, seen := byCanvas[en.canvas]; !seen {
+			order = append(order, en.canvas)
+		}
+		byCanvas[en.canvas] = append(byCanvas[en.canvas], en)
+	}
+
+	preview := e.currentCanvas
+	e.syncEditorToCanvas()
+	var steps []projectReplaceStep
+	lines, skipped := 0, 0
+	for _, num := range order {
+		c, ok := e.canvases[num]
+		if !ok || c.kind != CanvasFile {
+			skipped += len(byCanvas[num])
+			continue
+		}
+		var todo []projectReplaceEntry
+		for _, en := range byCanvas[num] {
+			if en.line < c.buf.LineCount() && c.buf.Line(en.line) == en.old {
+				todo = append(todo, en)
+			} else {
+				skipped++
+			}
+		}
+		if len(todo) == 0 {
+			continue
+		}
+		e.currentCanvas = num
+		e.syncCanvasToEditor()
+		e.beginUndoGroup()
+		for _, en := range todo {
+			e.setLine(en.line, en.new)
+		}
+		e.endUndoGroup()
+		steps = append(steps, projectReplaceStep{canvas: num, history: e.history, node: e.history.current})
+		e.syncEditorToCanvas()
+		lines += len(todo)
+	}
+	e.currentCanvas = preview
+	e.syncCanvasToEditor()
+
+	msg := fmt.Sprintf("Replaced %d line(s) in %d file(s)", lines, len(steps))
+	if skipped > 0 {
+		msg += fmt.Sprintf(", %d changed since the preview and skipped", skipped)
+	}
+	e.statusMessage(msg)
+	if len(steps) == 0 {
+		return
+	}
+	pr.steps = steps
+	e.setPreviewLine(0, fmt.Sprintf("Replaced %q with %q: %d line(s) in %d file(s).", pr.query, pr.repl, lines, len(steps)))
+	e.setPreviewLine(1, "Ctrl-Z here undoes the change in every file, Ctrl-E redoes it.")
+}
+
+// undoProjectReplace undoes (or, with redo, redoes) an applied project
+// replace in every file it changed. Nothing is done if any of the files has
+// been edited since, so the change is never half undone.
+// undoProjectReplace отменяет (или повторяет) замену по проекту во всех файлах.
+func (e *Editor) undoProjectReplace(redo bool) {
+	pr := e.projectReplace
+	if pr.steps == nil {
+		e.statusMessage("The replace has not been applied yet")
+		return
+	}
+	if pr.undone != redo {
+		if redo {
+			e.statusMessage("Nothing to redo")
+		} else {
+			e.statusMessage("Nothing to undo")
+		}
+		return
+	}
+	e.syncEditorToCanvas()
+	for _, st := range pr.steps {
+		c, ok := e.canvases[st.canvas]
+		want := st.node
+		if redo {
+			want = st.node.parent
+		}
+		if !ok || c.history != st.history || st.history.current != want || st.node == st.history.root {
+			name := "a closed canvas"
+			if ok {
+				name = c.getDisplayName()
+			}
+			e.showError("Cannot undo the project replace: " + name + " has been edited since")
+			return
+		}
+	}
+
+	preview := e.currentCanvas
+	for _, st := range pr.steps {
+		e.currentCanvas = st.canvas
+		e.syncCanvasToEditor()
+		if redo {
+			e.history.current.redo = st.node
+			e.redo()
+		} else {
+			e.undo()
+		}
+		e.syncEditorToCanvas()
+	}
+	e.currentCanvas = preview
+	e.syncCanvasToEditor()
+	pr.undone = !redo
+
+	verb := "Undid"
+	if redo {
+		verb = "Redid"
+	}
+	e.statusMessage(fmt.Sprintf("%s the replace of %q in %d file(s)", verb, pr.query, len(pr.steps)))
+}
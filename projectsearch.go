@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// maxProjectSearchResults caps the number of lines in a results canvas.
+const maxProjectSearchResults = 5000
+
+// maxProjectSearchFileSize skips files on disk larger than this many bytes.
+const maxProjectSearchFileSize = 8 << 20
+
+// resultLineRe parses a "file:line:col: text" result line.
+var resultLineRe = regexp.MustCompile(`^(.+?):(\d+):(\d+): `)
+
+// projectMatch is one project search hit.
+type projectMatch struct {
+	path string
+	line int
+	col  int
+	text string
+}
+
+// projectRoot returns the project directory, or "" outside project mode.
+// projectRoot возвращает каталог проекта или "" вне режима проекта.
+func (e *Editor) projectRoot() string {
+	if e.githubProject != nil {
+		return e.githubProject.LocalPath
+	}
+	if c, ok := e.canvases[1]; ok && c.filename != "" {
+		if info, err := os.Stat(c.filename); err == nil && info.IsDir() {
+			return c.filename
+		}
+	}
+	return ""
+}
+
+// skipProjectDir reports whether a directory is left out of project walks.
+// skipProjectDir сообщает, пропускается ли каталог при обходе проекта.
+func skipProjectDir(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// searchLines appends the matches of s in text to out and returns it.
+func searchLines(s *Searcher, path, text string, out []projectMatch) []projectMatch {
+	for i, line := range strings.Split(text, "\n") {
+		for _, m := range s.FindAll(line) {
+			out = append(out, projectMatch{
+				path: path,
+				line: i,
+				col:  utf8.RuneCountInString(line[:m[0]]),
+				text: line,
+			})
+		}
+	}
+	return out
+}
+
+// searchProject finds q in every file canvas and in the files on disk under
+// root. Canvas buffers win over the disk copy, so unsaved edits are searched.
+// searchProject ищет q во всех канвасах и файлах проекта на диске.
+func (e *Editor) searchProject(root string, s *Searcher) []projectMatch {
+	e.syncEditorToCanvas()
+	var out []projectMatch
+	seen := make(map[string]bool)
+	for _, c := range e.canvases {
+		if c.kind != CanvasFile || c.filename == "" || c.buf == nil {
+			continue
+		}
+		abs, err := filepath.Abs(c.filename)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			continue
+		}
+		seen[abs] = true
+		out = searchLines(s, abs, c.buf.String(), out)
+	}
+
+	newProjectMatcher(root).walk(func(rel string, info os.FileInfo) {
+		if !info.Mode().IsRegular() || info.Size() > maxProjectSearchFileSize {
+			return
+		}
+		path := filepath.Join(root, rel)
+		abs, err := filepath.Abs(path)
+		if err != nil || seen[abs] {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+			return
+		}
+		text, _ := decodeText(data)
+		out = searchLines(s, abs, text, out)
+	})
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].path != out[j].path {
+			return out[i].path < out[j].path
+		}
+		return out[i].line < out[j].line || out[i].line == out[j].line && out[i].col < out[j].col
+	})
+	return out
+}
+
+// showProjectSearchPrompt asks for a query and lists its matches across the
+// project in the search results canvas. An "old -> new" input previews a
+// replace across all file canvases instead.
+// showProjectSearchPrompt запрашивает строку и показывает совпадения по всему проекту.
+func (e *Editor) showProjectSearchPrompt() {
+	root := e.projectRoot()
+	if root == "" {
+		e.showError("Project search needs a project directory")
+		return
+	}
+	const label = "Search project"
+	e.promptShowWithInitial(label+e.searchOpts.String(), e.lastSearch, func(input string) {
+		q := strings.TrimSpace(input)
+		if q == "" {
+			return
+		}
+		if parts := strings.SplitN(q, " -> ", 2); len(parts) == 2 {
+			e.showProjectReplacePreview(root, parts[0], parts[1])
+			return
+		}
+		s, err := NewSearcher(q, e.searchOpts)
+		if err != nil {
+			e.showError("Invalid pattern: " + err.Error())
+			return
+		}
+		e.lastSearch = q
+		matches := e.searchProject(root, s)
+		e.showProjectSearchResults(root, q, matches)
+	})
+	e.prompt.OnKey = func(ev *tcell.EventKey) bool {
+		return ev.Key() == tcell.KeyRune && ev.Modifiers()&tcell.ModAlt != 0 && e.searchOptionKey(ev.Rune(), label)
+	}
+}
+
+// showProjectSearchResults fills the search results canvas, creating it on
+// first use, and switches to it.
+// showProjectSearchResults заполняет канвас результатов поиска и переключается на него.
+func (e *Editor) showProjectSearchResults(root, q string, matches []projectMatch) {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	files := make(map[string]bool)
+	for _, m := range matches {
+		files[m.path] = true
+	}
+	lines := []string{fmt.Sprintf("Search %q: %d match(es) in %d file(s). Enter opens the match under the cursor.", q, len(matches), len(files)), ""}
+	for i, m := range matches {
+		if i == maxProjectSearchResults {
+			lines = append(lines, fmt.Sprintf("... %d more match(es) not shown", len(matches)-i))
+			break
+		}
+		rel, err := filepath.Rel(root, m.path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = m.path
+		}
+		lines = append(lines, fmt.Sprintf("%s:%d:%d: %s", rel, m.line+1, m.col+1, m.text))
+	}
+	if !e.showGeneratedCanvas(CanvasSearchResults, lines) {
+		return
+	}
+	if len(matches) > 0 {
+		e.cy = 2
+	}
+	e.ensureVisible()
+}
+
+// showGeneratedCanvas puts lines into the canvas of the given kind, creating
+// it if needed, and makes it current. It reports false if no canvas is free.
+// showGeneratedCanvas помещает строки в канвас заданного вида и делает его текущим.
+func (e *Editor) showGeneratedCanvas(kind CanvasKind, lines []string) bool {
+	e.syncEditorToCanvas()
+	num := 0
+	for n, c := range e.canvases {
+		if c.kind == kind {
+			num = n
+			break
+		}
+	}
+	if num == 0 {
+		if len(e.canvases) >= MaxCanvases {
+			e.showError("The maximum number of canvases has been reached (" + strconv.Itoa(MaxCanvases) + ")")
+			return false
+		}
+		for i := 1; i <= MaxCanvases; i++ {
+			if _, exists := e.canvases[i]; !exists {
+				num = i
+				break
+			}
+		}
+	}
+	e.canvases[num] = &Canvas{
+		buf:      NewTextBufferFromLines(lines),
+		language: LangUnknown,
+		kind:     kind,
+	}
+	if num != e.currentCanvas {
+		e.prevCanvas = e.currentCanvas
+	}
+	e.currentCanvas = num
+	e.syncCanvasToEditor()
+	return true
+}
+
+// openResultAtCursor opens the file position named by the result line under
+// the cursor. It reports whether the current canvas is a results canvas.
+// openResultAtCursor открывает позицию из строки результата под курсором.
+func (e *Editor) openResultAtCursor() bool {
+	c, ok := e.canvases[e.currentCanvas]
+	if !ok || c.kind != CanvasSearchResults {
+		return false
+	}
+	m := resultLineRe.FindStringSubmatch(e.buf.Line(e.cy))
+	if m == nil {
+		return true
+	}
+	path := m[1]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(e.projectRoot(), path)
+	}
+	line, _ := strconv.Atoi(m[2])
+	col, _ := strconv.Atoi(m[3])
+	e.openOrCreateCanvasForFile(path)
+	if e.canvases[e.currentCanvas] == c {
+		return true
+	}
+	e.cy, e.cx = e.clampPos(line-1, col-1)
+	e.ensureVisible()
+	return true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// replaceSession is the state of an interactive replace: the region still to
+// visit and the match currently offered for replacement.
+// replaceSession — состояние интерактивной замены.
+type replaceSession struct {
+	searcher   *Searcher
+	query      string
+	repl       string
+	endLine    int
+	endCol     int
+	line       int
+	col        int
+	matchLine  int
+	matchStart int
+	matchEnd   int
+	groups     []int
+	count      int
+	wasDirty   bool
+}
+
+// replaceCommand handles "old -> new" from the search prompt. It replaces in
+// the selection when InSelection is on and a selection exists, and asks about
+// every match when Confirm is on.
+// replaceCommand выполняет замену "old -> new" из запроса поиска.
+func (e *Editor) replaceCommand(old, repl string) {
+	s, err := NewSearcher(old, e.searchOpts)
+	if err != nil {
+		e.showError("Invalid pattern: " + err.Error())
+		return
+	}
+	last := e.buf.LineCount() - 1
+	sl, sc, el, ec := 0, 0, last, e.buf.LineLen(last)
+	where := ""
+	if e.searchOpts.InSelection && e.selecting {
+		sl, sc, el, ec = e.getSelectionRange()
+		where = " in selection"
+	}
+	e.endSelection()
+	if e.searchOpts.Confirm {
+		e.startInteractiveReplace(s, old, repl, sl, sc, el, ec)
+		return
+	}
+	count := e.replaceInRange(s, repl, sl, sc, el, ec)
+	e.ensureVisible()
+	e.statusMessage(fmt.Sprintf("Replaced %d occurrence(s) of %q with %q%s", count, old, repl, where))
+}
+
+// startInteractiveReplace offers each match in the region for replacement.
+// The whole session is undone as one step.
+// startInteractiveReplace предлагает заменить каждое совпадение в области;
+// вся сессия отменяется одним шагом.
+func (e *Editor) startInteractiveReplace(s *Searcher, query, repl string, sl, sc, el, ec int) {
+	e.replaceSession = &replaceSession{
+		searcher: s,
+		query:    query,
+		repl:     repl,
+		endLine:  el,
+		endCol:   ec,
+		line:     sl,
+		col:      sc,
+		wasDirty: e.dirty,
+	}
+	e.beginUndoGroup()
+	e.offerNextReplace()
+}
+
+// findNext moves the session to the next match in its region.
+func (rs *replaceSession) findNext(buf TextBuffer) bool {
+	for ; rs.line <= rs.endLine && rs.line < buf.LineCount(); rs.line, rs.col = rs.line+1, 0 {
+		line := buf.Line(rs.line)
+		for _, m := range rs.searcher.FindAll(line) {
+			start := utf8.RuneCountInString(line[:m[0]])
+			end := start + utf8.RuneCountInString(line[m[0]:m[1]])
+			if start < rs.col {
+				continue
+			}
+			if rs.line == rs.endLine && end > rs.endCol {
+				break
+			}
+			rs.matchLine, rs.matchStart, rs.matchEnd = rs.line, start, end
+			rs.groups = m
+			return true
+		}
+	}
+	return false
+}
+
+// offerNextReplace highlights the next match and asks what to do with it.
+func (e *Editor) offerNextReplace() {
+	rs := e.replaceSession
+	if !rs.findNext(e.buf) {
+		e.finishReplace()
+		return
+	}
+	e.cy, e.cx = rs.matchLine, rs.matchStart
+	e.ensureVisible()
+	e.promptShow(fmt.Sprintf("Replace %q with %q? (y)es (n)o (a)ll (q)uit", rs.query, rs.repl), nil)
+	e.prompt.OnKey = func(ev *tcell.EventKey) bool {
+		switch {
+		case ev.Key() == tcell.KeyEsc:
+			e.finishReplace()
+		case ev.Key() == tcell.KeyEnter:
+			e.replaceCurrentMatch()
+			e.offerNextReplace()
+		case ev.Key() == tcell.KeyRune:
+			switch ev.Rune() {
+			case 'y', 'Y', 'н', 'Н':
+				e.replaceCurrentMatch()
+				e.offerNextReplace()
+			case 'n', 'N', 'т', 'Т':
+				rs.col = rs.matchEnd
+				if rs.matchEnd == rs.matchStart {
+					rs.col++
+				}
+				e.offerNextReplace()
+			case 'a', 'A', 'ф', 'Ф':
+				rs.count += e.replaceInRange(rs.searcher, rs.repl, rs.matchLine, rs.matchStart, rs.endLine, rs.endCol)
+				e.finishReplace()
+			case 'q', 'Q', 'й', 'Й':
+				e.finishReplace()
+			}
+		}
+		return true
+	}
+}
+
+// replaceCurrentMatch replaces the offered match and continues after it.
+func (e *Editor) replaceCurrentMatch() {
+	rs := e.replaceSession
+	line := e.buf.Line(rs.matchLine)
+	text := rs.searcher.Expand(line, rs.groups, rs.repl)
+	e.replaceRange(rs.matchLine, rs.matchStart, rs.matchLine, rs.matchEnd, text)
+	n := utf8.RuneCountInString(text)
+	if rs.matchLine == rs.endLine {
+		rs.endCol += n - (rs.matchEnd - rs.matchStart)
+	}
+	rs.col = rs.matchStart + n
+	if n == 0 && rs.matchEnd == rs.matchStart {
+		rs.col++
+	}
+	rs.count++
+}
+
+// finishReplace closes the interactive replace and its undo step.
+func (e *Editor) finishReplace() {
+	rs := e.replaceSession
+	if rs == nil {
+		return
+	}
+	e.replaceSession = nil
+	e.prompt = nil
+	e.endUndoGroup()
+	e.dirty = rs.wasDirty || rs.count > 0
+	e.ensureVisible()
+	e.statusMessage(fmt.Sprintf("Replaced %d occurrence(s) of %q with %q", rs.count, rs.query, rs.repl))
+}
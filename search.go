@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// SearchOptions are the toggles of the Ctrl-F prompt.
+// SearchOptions — переключатели запроса поиска Ctrl-F.
+type SearchOptions struct {
+	Regex       bool
+	IgnoreCase  bool
+	WholeWord   bool
+	Confirm     bool
+	InSelection bool
+}
+
+// String returns the active options for the prompt label.
+func (o SearchOptions) String() string {
+	var on []string
+	if o.Regex {
+		on = append(on, "regex")
+	}
+	if o.IgnoreCase {
+		on = append(on, "ignore case")
+	}
+	if o.WholeWord {
+		on = append(on, "whole word")
+	}
+	if o.Confirm {
+		on = append(on, "confirm")
+	}
+	if o.InSelection {
+		on = append(on, "in selection")
+	}
+	if len(on) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(on, ", ") + ")"
+}
+
+// Searcher finds matches of one query within single lines.
+// Searcher ищет совпадения запроса в пределах одной строки.
+type Searcher struct {
+	re        *regexp.Regexp
+	regex     bool
+	wholeWord bool
+}
+
+// NewSearcher compiles query according to opt. Without Regex the query is
+// matched literally; an invalid regular expression is returned as an error.
+// NewSearcher компилирует запрос согласно opt.
+func NewSearcher(query string, opt SearchOptions) (*Searcher, error) {
+	pattern := query
+	if !opt.Regex {
+		pattern = regexp.QuoteMeta(query)
+	}
+	if opt.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &Searcher{re: re, regex: opt.Regex, wholeWord: opt.WholeWord}, nil
+}
+
+// isWordRune reports whether r belongs to an identifier-like word.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordBounded reports whether line[start:end] is not glued to word characters.
+func wordBounded(line string, start, end int) bool {
+	if start > 0 {
+		if r, _ := utf8.DecodeLastRuneInString(line[:start]); isWordRune(r) {
+			return false
+		}
+	}
+	if end < len(line) {
+		if r, _ := utf8.DecodeRuneInString(line[end:]); isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// FindAll returns the submatch byte indexes of every match in line.
+// FindAll возвращает байтовые индексы всех совпадений в строке.
+func (s *Searcher) FindAll(line string) [][]int {
+	all := s.re.FindAllStringSubmatchIndex(line, -1)
+	if !s.wholeWord {
+		return all
+	}
+	kept := all[:0]
+	for _, m := range all {
+		if wordBounded(line, m[0], m[1]) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// Expand returns the replacement for match m of line. In regex mode $1 and
+// ${name} refer to capture groups; otherwise repl is used literally.
+// Expand возвращает замену для совпадения m; в режиме regex $1 и ${name}
+// ссылаются на группы.
+func (s *Searcher) Expand(line string, m []int, repl string) string {
+	if !s.regex {
+		return repl
+	}
+	return string(s.re.ExpandString(nil, repl, line, m))
+}
+
+// ReplaceLine replaces every match that lies within the byte range [lo, hi)
+// of line and returns the result and the number of replacements.
+// ReplaceLine заменяет совпадения в диапазоне [lo, hi) строки.
+func (s *Searcher) ReplaceLine(line, repl string, lo, hi int) (string, int) {
+	var b strings.Builder
+	last, n := 0, 0
+	for _, m := range s.FindAll(line) {
+		if m[0] < lo || m[1] > hi {
+			continue
+		}
+		n++
+		b.WriteString(line[last:m[0]])
+		b.WriteString(s.Expand(line, m, repl))
+		last = m[1]
+	}
+	if n == 0 {
+		return line, 0
+	}
+	b.WriteString(line[last:])
+	return b.String(), n
+}
+
+// byteOffset converts the rune column col of line to a byte offset.
+func byteOffset(line string, col int) int {
+	for i := range line {
+		if col == 0 {
+			return i
+		}
+		col--
+	}
+	return len(line)
+}
+
+// isearchStep is a position the incremental search passed through.
+type isearchStep struct {
+	value string
+	cy    int
+	cx    int
+}
+
+// showSearchPrompt opens the Ctrl-F prompt. While typing, the cursor jumps to
+// the nearest match at or after the starting point (incremental search);
+// Backspace steps back through earlier positions and Esc returns to the start.
+// Enter keeps the found match, or moves to the next one if nothing was typed.
+// An "old -> new" input runs a replace instead.
+// showSearchPrompt открывает запрос поиска Ctrl-F с инкрементальным поиском.
+func (e *Editor) showSearchPrompt() {
+	startY, startX := e.cy, e.cx
+	prevSearch := e.lastSearch
+	var steps []isearchStep
+	typed := false
+
+	update := func() {
+		typed = true
+		value := e.prompt.Value
+		q := strings.TrimSpace(value)
+		if strings.Contains(q, " -> ") {
+			// The selection a replace works in ends at the cursor, so it
+			// must not stay on a match found while typing the query.
+			e.lastSearch = prevSearch
+			e.cy, e.cx = startY, startX
+			e.ensureVisible()
+			return
+		}
+		e.lastSearch = q
+		e.cy, e.cx = startY, startX
+		if q == "" {
+			e.ensureVisible()
+			return
+		}
+		if c := e.searchState(); c != nil {
+			if m, ok := c.next(startY, startX); ok {
+				e.cy, e.cx = m.line, m.start
+			}
+		}
+		e.ensureVisible()
+	}
+
+	e.promptShowWithInitial("Search"+e.searchOpts.String(), e.lastSearch, func(input string) {
+		trimmed := strings.TrimSpace(input)
+		if trimmed == "" {
+			e.lastSearch = input
+			return
+		}
+		if strings.Contains(trimmed, " -> ") {
+			parts := strings.SplitN(trimmed, " -> ", 2)
+			if len(parts) == 2 {
+				old := parts[0]
+				newS := parts[1]
+				e.prompt = nil
+				e.cy, e.cx = startY, startX
+				e.replaceCommand(old, newS)
+				return
+			}
+		}
+
+		if _, atMatch := e.matchAt(e.cy, e.cx); !typed || !atMatch {
+			e.findAndJump(input)
+		}
+		e.lastSearch = trimmed
+	})
+	e.prompt.OnKey = func(ev *tcell.EventKey) bool {
+		switch ev.Key() {
+		case tcell.KeyEsc:
+			e.cy, e.cx = startY, startX
+			e.lastSearch = prevSearch
+			e.prompt = nil
+			e.ensureVisible()
+			return true
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+			if len(steps) == 0 {
+				if r := []rune(e.prompt.Value); len(r) > 0 {
+					e.prompt.Value = string(r[:len(r)-1])
+					update()
+				}
+				return true
+			}
+			step := steps[len(steps)-1]
+			steps = steps[:len(steps)-1]
+			e.prompt.Value = step.value
+			e.lastSearch = strings.TrimSpace(step.value)
+			e.cy, e.cx = step.cy, step.cx
+			e.ensureVisible()
+			return true
+		case tcell.KeyRune:
+			if ev.Modifiers()&tcell.ModAlt != 0 {
+				if !e.searchOptionKey(ev.Rune(), "Search") {
+					return false
+				}
+				update()
+				return true
+			}
+			steps = append(steps, isearchStep{value: e.prompt.Value, cy: e.cy, cx: e.cx})
+			e.prompt.Value += string(ev.Rune())
+			update()
+			return true
+		}
+		return false
+	}
+}
+
+// searchOptionKey toggles a search option bound to an Alt key in a search
+// prompt labelled label and reports whether r was such a key.
+// searchOptionKey переключает опцию поиска по Alt-клавише.
+func (e *Editor) searchOptionKey(r rune, label string) bool {
+	switch unicode.ToLower(r) {
+	case 'r', 'к':
+		e.searchOpts.Regex = !e.searchOpts.Regex
+	case 'c', 'с':
+		e.searchOpts.IgnoreCase = !e.searchOpts.IgnoreCase
+	case 'w', 'ц':
+		e.searchOpts.WholeWord = !e.searchOpts.WholeWord
+	case 'i', 'ш':
+		e.searchOpts.Confirm = !e.searchOpts.Confirm
+	case 's', 'ы':
+		e.searchOpts.InSelection = !e.searchOpts.InSelection
+	default:
+		return false
+	}
+	if e.prompt != nil {
+		e.prompt.Label = label + e.searchOpts.String()
+	}
+	return true
+}
+
+// searchMatch is one match of the last search, in rune columns.
+type searchMatch struct {
+	line  int
+	start int
+	end   int
+}
+
+// searchCache holds the number of matches of the last search on every line
+// of one buffer. Edits update the counts of the lines they touch only; the
+// matches themselves are found for the lines that are looked at.
+// searchCache хранит число совпадений последнего поиска в каждой строке.
+type searchCache struct {
+	buf      TextBuffer
+	version  int
+	query    string
+	opts     SearchOptions
+	searcher *Searcher
+	counts   []int
+	total    int
+	spans    map[int][]searchMatch
+}
+
+// searchState returns the cache of the last search for the current buffer,
+// or nil when there is no search or its pattern is invalid. The counts are
+// rebuilt only when the buffer, the query or the options change other than
+// through bufferEdited.
+// searchState возвращает кэш последнего поиска для текущего буфера.
+func (e *Editor) searchState() *searchCache {
+	q := strings.TrimSpace(e.lastSearch)
+	if q == "" {
+		return nil
+	}
+	c := &e.searchCache
+	if c.buf != e.buf || c.version != e.bufVersion || c.query != q || c.opts != e.searchOpts {
+		*c = searchCache{buf: e.buf, version: e.bufVersion, query: q, opts: e.searchOpts}
+		if s, err := NewSearcher(q, e.searchOpts); err == nil {
+			c.searcher = s
+			c.counts = make([]int, e.buf.LineCount())
+			for y := range c.counts {
+				c.counts[y] = len(s.FindAll(e.buf.Line(y)))
+				c.total += c.counts[y]
+			}
+		}
+	}
+	if c.searcher == nil {
+		return nil
+	}
+	return c
+}
+
+// edit follows a change of buf, now at version, that replaced removed+1
+// lines from line on by inserted+1 lines, and recounts the matches of those
+// lines only. A cache that missed an earlier change is left to be rebuilt.
+func (c *searchCache) edit(buf TextBuffer, version, line, removed, inserted int) {
+	if c.buf != buf || c.version != version-1 || c.searcher == nil {
+		return
+	}
+	c.version = version
+	end := line + removed + 1
+	for _, n := range c.counts[line:end] {
+		c.total -= n
+	}
+	fresh := make([]int, inserted+1)
+	for i := range fresh {
+		fresh[i] = len(c.searcher.FindAll(buf.Line(line + i)))
+		c.total += fresh[i]
+	}
+	c.counts = slices.Replace(c.counts, line, end, fresh...)
+	c.spans = nil
+}
+
+// lineMatches returns the matches on line y, sorted by column.
+func (c *searchCache) lineMatches(y int) []searchMatch {
+	if ms, ok := c.spans[y]; ok {
+		return ms
+	}
+	var ms []searchMatch
+	if c.counts[y] > 0 {
+		line := c.buf.Line(y)
+		for _, m := range c.searcher.FindAll(line) {
+			start := utf8.RuneCountInString(line[:m[0]])
+			end := start + utf8.RuneCountInString(line[m[0]:m[1]])
+			ms = append(ms, searchMatch{line: y, start: start, end: end})
+		}
+	}
+	if c.spans == nil {
+		c.spans = make(map[int][]searchMatch)
+	}
+	c.spans[y] = ms
+	return ms
+}
+
+// next returns the first match that does not start before (line, col),
+// wrapping around the end of the buffer.
+func (c *searchCache) next(line, col int) (searchMatch, bool) {
+	n := len(c.counts)
+	for i := 0; i <= n && c.total > 0; i++ {
+		y := (line + i) % n
+		for _, m := range c.lineMatches(y) {
+			if i > 0 || m.start >= col {
+				return m, true
+			}
+		}
+	}
+	return searchMatch{}, false
+}
+
+// prev returns the last match that starts before (line, col), wrapping
+// around the start of the buffer.
+func (c *searchCache) prev(line, col int) (searchMatch, bool) {
+	n := len(c.counts)
+	for i := 0; i <= n && c.total > 0; i++ {
+		y := ((line-i)%n + n) % n
+		ms := c.lineMatches(y)
+		for k := len(ms) - 1; k >= 0; k-- {
+			if i > 0 || ms[k].start < col {
+				return ms[k], true
+			}
+		}
+	}
+	return searchMatch{}, false
+}
+
+// matchAt reports whether a match covers the rune at (line, col) and whether
+// that match starts at the cursor.
+func (e *Editor) matchAt(line, col int) (found, current bool) {
+	c := e.searchState()
+	if c == nil || line >= len(c.counts) {
+		return false, false
+	}
+	ms := c.lineMatches(line)
+	i := sort.Search(len(ms), func(i int) bool { return ms[i].end > col })
+	if i == len(ms) || ms[i].start > col {
+		return false, false
+	}
+	return true, line == e.cy && ms[i].start == e.cx
+}
+
+// jumpToMatch moves the cursor to the next (dir > 0) or previous match of
+// the last search, wrapping around the document.
+// jumpToMatch переходит к следующему или предыдущему совпадению.
+func (e *Editor) jumpToMatch(dir int) {
+	q := strings.TrimSpace(e.lastSearch)
+	if q == "" {
+		e.statusMessage("No previous search")
+		return
+	}
+	if _, err := NewSearcher(q, e.searchOpts); err != nil {
+		e.showError("Invalid pattern: " + err.Error())
+		return
+	}
+	c := e.searchState()
+	var m searchMatch
+	var ok bool
+	if dir > 0 {
+		m, ok = c.next(e.cy, e.cx+1)
+	} else {
+		m, ok = c.prev(e.cy, e.cx)
+	}
+	if !ok {
+		e.statusMessage("Not found: " + q)
+		return
+	}
+	e.endSelection()
+	e.cy, e.cx = m.line, m.start
+	e.ensureVisible()
+}
+
+// searchStatus returns "match k of n" for the status bar, or "n matches"
+// when the cursor is not on a match. Only the line counts before the cursor
+// are summed, and only when the cursor is on a match.
+// searchStatus возвращает число совпадений для строки состояния.
+func (e *Editor) searchStatus() string {
+	if strings.TrimSpace(e.lastSearch) == "" {
+		return ""
+	}
+	c := e.searchState()
+	if c == nil {
+		return "0 matches"
+	}
+	if e.cy < len(c.counts) {
+		for k, m := range c.lineMatches(e.cy) {
+			if m.start != e.cx {
+				continue
+			}
+			for _, n := range c.counts[:e.cy] {
+				k += n
+			}
+			return fmt.Sprintf("match %d of %d", k+1, c.total)
+		}
+	}
+	return fmt.Sprintf("%d matches", c.total)
+}
+
+// matchStyleAt returns the style of the rune at (line, col): the match offered
+// by an interactive replace and the match at the cursor are shown in yellow,
+// other matches of the last search in olive, other runes keep style.
+// matchStyleAt возвращает стиль символа с учётом подсветки совпадений.
+func (e *Editor) matchStyleAt(line, col int, style tcell.Style) tcell.Style {
+	current := tcell.StyleDefault.Background(tcell.ColorYellow).Foreground(tcell.ColorBlack)
+	if rs := e.replaceSession; rs != nil {
+		if line == rs.matchLine && col >= rs.matchStart && col < rs.matchEnd {
+			return current
+		}
+		return style
+	}
+	found, atCursor := e.matchAt(line, col)
+	switch {
+	case atCursor:
+		return current
+	case found:
+		return tcell.StyleDefault.Background(tcell.ColorOlive).Foreground(tcell.ColorBlack)
+	}
+	return style
+}
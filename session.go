@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sessionFileVersion is bumped whenever the on-disk session format changes.
+const sessionFileVersion = 1
+
+// sessionCanvas is a canvas of a saved session: the file it shows and the
+// cursor and scroll position. With soft wrap the top of the view is segment
+// OffsetSeg of line OffsetY.
+type sessionCanvas struct {
+	Num       int    `json:"num"`
+	Path      string `json:"path"`
+	CX        int    `json:"cx"`
+	CY        int    `json:"cy"`
+	OffsetX   int    `json:"offset_x"`
+	OffsetY   int    `json:"offset_y"`
+	OffsetSeg int    `json:"offset_seg,omitempty"`
+}
+
+// sessionFile is the on-disk form of an editor session.
+// sessionFile — представление сессии редактора на диске.
+type sessionFile struct {
+	Version    int             `json:"version"`
+	Dir        string          `json:"dir"`
+	Canvases   []sessionCanvas `json:"canvases"`
+	Current    int             `json:"current"`
+	LastSearch string          `json:"last_search,omitempty"`
+	SearchOpts SearchOptions   `json:"search_opts"`
+	Provider   string          `json:"provider,omitempty"`
+	Model      string          `json:"model,omitempty"`
+}
+
+// sessionFilePath returns the file that stores the session called name, or
+// the session of the working directory if name is empty.
+// sessionFilePath возвращает файл сессии name или сессии текущего каталога.
+func sessionFilePath(name string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "editor", "sessions")
+	if name != "" {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return "", errors.New("invalid session name: " + name)
+		}
+		return filepath.Join(dir, name+".json"), nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if abs, err := filepath.Abs(cwd); err == nil {
+		cwd = abs
+	}
+	sum := sha256.Sum256([]byte(cwd))
+	return filepath.Join(dir, "dir-"+hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// saveSession writes the open file canvases, their positions, the current
+// canvas, the last search and the LLM settings to e.sessionPath. Generated
+// canvases and canvases without a file are left out.
+// saveSession сохраняет сессию в e.sessionPath.
+func (e *Editor) saveSession() error {
+	if e.sessionPath == "" {
+		return nil
+	}
+	e.syncEditorToCanvas()
+	cwd, _ := os.Getwd()
+	f := sessionFile{
+		Version:    sessionFileVersion,
+		Dir:        cwd,
+		LastSearch: e.lastSearch,
+		SearchOpts: e.searchOpts,
+		Provider:   e.llmProvider,
+		Model:      e.llmModel,
+	}
+	nums := make([]int, 0, len(e.canvases))
+	for num := range e.canvases {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		c := e.canvases[num]
+		if c.kind != CanvasFile || c.filename == "" {
+			continue
+		}
+		abs, err := filepath.Abs(c.filename)
+		if err != nil {
+			continue
+		}
+		f.Canvases = append(f.Canvases, sessionCanvas{
+			Num:       num,
+			Path:      abs,
+			CX:        c.cx,
+			CY:        c.cy,
+			OffsetX:   c.offsetX,
+			OffsetY:   c.offsetY,
+			OffsetSeg: c.offsetSeg,
+		})
+		if num == e.currentCanvas || f.Current == 0 {
+			f.Current = num
+		}
+	}
+	if len(f.Canvases) == 0 {
+		os.Remove(e.sessionPath)
+		return nil
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(e.sessionPath), 0700); err != nil {
+		return err
+	}
+	tmp := e.sessionPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, e.sessionPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// restoreSession opens the canvases of the session saved in path. Files are
+// read when their canvas is first viewed; files that no longer exist are
+// dropped. A provider or model given on the command line wins over the
+// saved one. It returns nil if there is no usable session.
+// restoreSession восстанавливает сохранённую сессию или возвращает nil.
+func restoreSession(path, provider, model string) *Editor {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var f sessionFile
+	if json.Unmarshal(data, &f) != nil || f.Version != sessionFileVersion {
+		return nil
+	}
+	if provider == "" && model == "" {
+		provider, model = f.Provider, f.Model
+	}
+	e := NewEditor("", provider, model)
+	delete(e.canvases, 1)
+	for _, sc := range f.Canvases {
+		if sc.Num < 1 || sc.Num > MaxCanvases || e.canvases[sc.Num] != nil {
+			continue
+		}
+		info, err := os.Stat(sc.Path)
+		if err != nil {
+			continue
+		}
+		c := &Canvas{
+			filename:  sc.Path,
+			cx:        sc.CX,
+			cy:        sc.CY,
+			offsetX:   sc.OffsetX,
+			offsetY:   sc.OffsetY,
+			offsetSeg: sc.OffsetSeg,
+			language:  detectLanguage(sc.Path),
+		}
+		if info.IsDir() {
+			files, err := listProjectIndex(sc.Path)
+			if err != nil {
+				continue
+			}
+			c.buf = NewTextBufferFromLines(createProjectOverview(files))
+			c.language = LangUnknown
+			c.cy, c.cx = min(c.cy, c.buf.LineCount()-1), 0
+		}
+		e.canvases[sc.Num] = c
+	}
+	if len(e.canvases) == 0 {
+		return nil
+	}
+	e.currentCanvas = f.Current
+	if _, ok := e.canvases[e.currentCanvas]; !ok {
+		e.currentCanvas = MaxCanvases + 1
+		for num := range e.canvases {
+			e.currentCanvas = min(e.currentCanvas, num)
+		}
+	}
+	e.syncCanvasToEditor()
+	e.lastSearch = f.LastSearch
+	e.searchOpts = f.SearchOpts
+	e.searchOpts.InSelection = false
+	e.sessionPath = path
+	e.offerSwapRecovery(func(p string) bool {
+		for _, c := range e.canvases {
+			if samePath(c.filename, p) {
+				return true
+			}
+		}
+		return false
+	})
+	return e
+}
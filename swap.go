@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// swapFileVersion is bumped whenever the on-disk swap format changes.
+const swapFileVersion = 1
+
+// swapInterval is how often the unsaved canvases are written to swap files.
+const swapInterval = 5 * time.Second
+
+// maxDiffCells caps the size of the table used to diff a swap file against
+// the file on disk; beyond it the changed middle is shown as one block.
+const maxDiffCells = 4 << 20
+
+// swapFile is the on-disk copy of an unsaved canvas. Path is empty for a
+// canvas without a file.
+// swapFile — копия несохранённого канваса на диске.
+type swapFile struct {
+	Version int       `json:"version"`
+	Path    string    `json:"path"`
+	PID     int       `json:"pid"`
+	Time    time.Time `json:"time"`
+	Content string    `json:"content"`
+}
+
+// pendingSwap is a swap file left by an editor that is no longer running.
+type pendingSwap struct {
+	file string
+	swap swapFile
+}
+
+// swapDir returns the directory of the swap files.
+func swapDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "editor", "swap"), nil
+}
+
+// swapPathFor returns the swap file of canvas num: one per file, or one per
+// process and canvas number for a canvas without a file.
+func swapPathFor(num int, c *Canvas) (string, error) {
+	dir, err := swapDir()
+	if err != nil {
+		return "", err
+	}
+	if c.filename == "" {
+		return filepath.Join(dir, fmt.Sprintf("unnamed-%d-%d.json", os.Getpid(), num)), nil
+	}
+	abs, err := filepath.Abs(c.filename)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// writeSwaps writes every canvas with unsaved changes whose content changed
+// since its last swap, and removes the swap files of canvases that have been
+// saved since. Errors are ignored: swapping must never get in the way.
+// writeSwaps записывает несохранённые канвасы в swap-файлы.
+func (e *Editor) writeSwaps() {
+	e.syncEditorToCanvas()
+	for num, c := range e.canvases {
+		if c.kind != CanvasFile || c.buf == nil || c.isProjectOverview() {
+			continue
+		}
+		path, err := swapPathFor(num, c)
+		if err != nil {
+			continue
+		}
+		if c.swapFile != "" && (c.swapFile != path || !c.dirty) {
+			os.Remove(c.swapFile)
+			c.swapFile, c.swapHash = "", ""
+		}
+		if !c.dirty {
+			continue
+		}
+		content := c.buf.String()
+		hash := contentHash(content)
+		if c.swapFile == path && c.swapHash == hash {
+			continue
+		}
+		abs := ""
+		if c.filename != "" {
+			abs, _ = filepath.Abs(c.filename)
+		}
+		data, err := json.Marshal(swapFile{
+			Version: swapFileVersion,
+			Path:    abs,
+			PID:     os.Getpid(),
+			Time:    time.Now(),
+			Content: content,
+		})
+		if err != nil || os.MkdirAll(filepath.Dir(path), 0700) != nil {
+			continue
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			os.Remove(tmp)
+			continue
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			continue
+		}
+		c.swapFile, c.swapHash = path, hash
+	}
+}
+
+// removeSwap deletes the swap file of canvas c, if it has one.
+func (c *Canvas) removeSwap() {
+	if c.swapFile != "" {
+		os.Remove(c.swapFile)
+		c.swapFile, c.swapHash = "", ""
+	}
+}
+
+// removeSwaps deletes the swap files of all canvases, on a normal exit.
+func (e *Editor) removeSwaps() {
+	for _, c := range e.canvases {
+		c.removeSwap()
+	}
+}
+
+// offerSwapRecovery looks for swap files left by editors that are no longer
+// running, for files that match reports true for and for canvases without a
+// file, and asks what to do with each of them.
+// offerSwapRecovery предлагает восстановить оставшиеся swap-файлы.
+func (e *Editor) offerSwapRecovery(match func(path string) bool) {
+	dir, err := swapDir()
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	known := make(map[string]bool)
+	for _, p := range e.pendingSwaps {
+		known[p.file] = true
+	}
+	for _, en := range entries {
+		file := filepath.Join(dir, en.Name())
+		if !strings.HasSuffix(en.Name(), ".json") || known[file] {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var sw swapFile
+		if json.Unmarshal(data, &sw) != nil || sw.Version != swapFileVersion {
+			continue
+		}
+		if processAlive(sw.PID) || sw.Path != "" && !match(sw.Path) {
+			continue
+		}
+		e.pendingSwaps = append(e.pendingSwaps, pendingSwap{file: file, swap: sw})
+	}
+	sort.SliceStable(e.pendingSwaps, func(i, j int) bool {
+		return e.pendingSwaps[i].swap.Time.Before(e.pendingSwaps[j].swap.Time)
+	})
+	if e.prompt == nil {
+		e.promptNextSwap()
+	}
+}
+
+// swapName returns how a swap file is shown in prompts.
+func swapName(sw swapFile) string {
+	if sw.Path == "" {
+		return "an unnamed canvas"
+	}
+	return sw.Path
+}
+
+// promptNextSwap asks about the first pending swap file: recover it, show
+// its diff against the file on disk, discard it or keep it for later. Esc
+// keeps it and the remaining ones.
+func (e *Editor) promptNextSwap() {
+	if len(e.pendingSwaps) == 0 {
+		return
+	}
+	p := e.pendingSwaps[0]
+	label := fmt.Sprintf("Unsaved changes to %s from %s. (r)ecover (d)iff (x) discard (k)eep",
+		swapName(p.swap), p.swap.Time.Format("2006-01-02 15:04"))
+	e.promptShow(label, func(input string) {
+		switch strings.ToLower(strings.TrimSpace(input)) {
+		case "r", "к":
+			e.pendingSwaps = e.pendingSwaps[1:]
+			e.recoverSwap(p)
+		case "d", "в":
+			e.showSwapDiff(p)
+			e.promptNextSwap()
+			return
+		case "x", "ч":
+			e.pendingSwaps = e.pendingSwaps[1:]
+			os.Remove(p.file)
+			e.statusMessage("Discarded the swap file of " + swapName(p.swap))
+		case "k", "л":
+			e.pendingSwaps = e.pendingSwaps[1:]
+		default:
+			e.promptNextSwap()
+			return
+		}
+		e.promptNextSwap()
+	})
+}
+
+// recoverSwap puts the content of a swap file into the canvas of its file,
+// opening one if needed, as a single undoable edit; the canvas stays unsaved.
+// A swap without a file, or of a file that is gone, gets a new canvas.
+// recoverSwap восстанавливает содержимое swap-файла в канвас.
+func (e *Editor) recoverSwap(p pendingSwap) {
+	sw := p.swap
+	opened := false
+	if sw.Path != "" {
+		if info, err := os.Stat(sw.Path); err == nil && !info.IsDir() {
+			e.openOrCreateCanvasForFile(sw.Path)
+			opened = e.canvases[e.currentCanvas].kind == CanvasFile && samePath(e.filename, sw.Path)
+		}
+	}
+	if !opened {
+		if len(e.canvases) >= MaxCanvases {
+			e.showError("The maximum number of canvases has been reached (" + strconv.Itoa(MaxCanvases) + ")")
+			return
+		}
+		e.syncEditorToCanvas()
+		num := 1
+		for ; num <= MaxCanvases; num++ {
+			if _, exists := e.canvases[num]; !exists {
+				break
+			}
+		}
+		e.canvases[num] = &Canvas{
+			filename: sw.Path,
+			buf:      NewTextBuffer(""),
+			language: detectLanguage(sw.Path),
+		}
+		if num != e.currentCanvas {
+			e.prevCanvas = e.currentCanvas
+		}
+		e.currentCanvas = num
+		e.syncCanvasToEditor()
+	}
+	last := e.buf.LineCount() - 1
+	e.beginUndoGroup()
+	e.replaceRange(0, 0, last, e.buf.LineLen(last), sw.Content)
+	e.endUndoGroup()
+	e.cy, e.cx = e.clampPos(e.cy, e.cx)
+	e.ensureVisible()
+	e.syncEditorToCanvas()
+	os.Remove(p.file)
+	e.statusMessage("Recovered unsaved changes to " + swapName(sw) + "; Ctrl-Z restores the file on disk")
+}
+
+// showSwapDiff lists the differences between the file on disk and a swap
+// file in the diff canvas.
+func (e *Editor) showSwapDiff(p pendingSwap) {
+	disk := ""
+	if p.swap.Path != "" {
+		if data, err := os.ReadFile(p.swap.Path); err == nil {
+			disk, _ = decodeText(data)
+		}
+	}
+	lines := []string{
+		"--- " + swapName(p.swap) + " (on disk)",
+		"+++ " + swapName(p.swap) + " (swap file, " + p.swap.Time.Format("2006-01-02 15:04:05") + ")",
+	}
+	lines = append(lines, lineDiff(strings.Split(disk, "\n"), strings.Split(p.swap.Content, "\n"), 2)...)
+	if len(lines) == 2 {
+		lines = append(lines, "", "The swap file matches the file on disk.")
+	}
+	e.showGeneratedCanvas(CanvasDiff, lines)
+}
+
+// lineDiff returns a diff of a and b in unified style: changed lines marked
+// "-" and "+", with up to context unchanged lines around them and a "@@"
+// header with the line numbers before each hunk.
+func lineDiff(a, b []string, context int) []string {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	// ops holds ' ', '-' or '+' for every line of the edit script.
+	ops := make([]byte, 0, len(a)+len(b))
+	for i := 0; i < pre; i++ {
+		ops = append(ops, ' ')
+	}
+	if len(ma)*len(mb) > maxDiffCells {
+		for range ma {
+			ops = append(ops, '-')
+		}
+		for range mb {
+			ops = append(ops, '+')
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of
+		// ma[i:] and mb[j:].
+		lcs := make([][]int32, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) || j < len(mb) {
+			switch {
+			case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+				ops = append(ops, ' ')
+				i++
+				j++
+			case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, '-')
+				i++
+			default:
+				ops = append(ops, '+')
+				j++
+			}
+		}
+	}
+	for i := 0; i < suf; i++ {
+		ops = append(ops, ' ')
+	}
+
+	var out []string
+	ai, bi := 0, 0
+	lastShown := -1
+	for k := 0; k < len(ops); k++ {
+		if ops[k] == ' ' {
+			ai++
+			bi++
+			continue
+		}
+		// Start a hunk with up to context lines before the change.
+		start := max(k-context, lastShown+1)
+		out = append(out, fmt.Sprintf("@@ -%d +%d @@", ai-(k-start)+1, bi-(k-start)+1))
+		for s := start; s < k; s++ {
+			out = append(out, "  "+a[ai-(k-s)])
+		}
+		// Emit the change and the unchanged lines up to the next change that
+		// is at most 2*context lines away.
+		end := k
+		for end < len(ops) {
+			if ops[end] != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run] == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				break
+			}
+			end = run
+		}
+		for ; k < end; k++ {
+			switch ops[k] {
+			case '-':
+				out = append(out, "- "+a[ai])
+				ai++
+			case '+':
+				out = append(out, "+ "+b[bi])
+				bi++
+			default:
+				out = append(out, "  "+a[ai])
+				ai++
+				bi++
+			}
+		}
+		for s := 0; s < context && k < len(ops) && ops[k] == ' '; s++ {
+			out = append(out, "  "+a[ai])
+			ai++
+			bi++
+			k++
+		}
+		lastShown = k - 1
+		k--
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// textTop returns the screen row of the first text line.
+// textTop возвращает экранную строку первой строки текста.
+func (e *Editor) textTop() int {
+	return 1 + e.tabBarHeight
+}
+
+// toggleTabBar shows or hides the tab line under the top status bar.
+// toggleTabBar показывает или скрывает строку вкладок.
+func (e *Editor) toggleTabBar() {
+	e.showTabBar = !e.showTabBar
+	e.refreshSize()
+	e.ensureVisible()
+}
+
+// tabLabel returns the tab text of canvas num: its number, the base name of
+// the file and "*" if it has unsaved changes.
+func tabLabel(num int, c *Canvas) string {
+	name := c.getDisplayName()
+	if c.kind == CanvasFile && c.filename != "" {
+		name = filepath.Base(c.filename)
+	}
+	if c.hasUnsavedChanges() {
+		name += "*"
+	}
+	return " " + strconv.Itoa(num) + ":" + name + " "
+}
+
+// drawTabBar draws the tab line listing the canvases in number order. The
+// current canvas is highlighted; when the tabs do not fit, the line scrolls
+// so that the current tab stays visible and arrows mark the hidden parts.
+// drawTabBar рисует строку вкладок канвасов с прокруткой по горизонтали.
+func (e *Editor) drawTabBar() {
+	if e.tabBarHeight == 0 {
+		return
+	}
+	e.syncEditorToCanvas()
+	nums := make([]int, 0, len(e.canvases))
+	for num := range e.canvases {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	labels := make([]string, len(nums))
+	starts := make([]int, len(nums))
+	total, activeStart, activeEnd := 0, 0, 0
+	for i, num := range nums {
+		labels[i] = tabLabel(num, e.canvases[num])
+		starts[i] = total
+		total += runewidth.StringWidth(labels[i]) + 1
+		if num == e.currentCanvas {
+			activeStart, activeEnd = starts[i], total-1
+		}
+	}
+	// The gap after the last tab is not part of the line.
+	total--
+
+	width := e.contentWidth
+	if total <= width {
+		e.tabScroll = 0
+	} else {
+		// Leave room for the scroll arrows at both ends.
+		view := width - 2
+		if activeStart < e.tabScroll {
+			e.tabScroll = activeStart
+		}
+		if activeEnd > e.tabScroll+view {
+			e.tabScroll = activeEnd - view
+		}
+		if e.tabScroll > total-view {
+			e.tabScroll = total - view
+		}
+		if e.tabScroll < 0 {
+			e.tabScroll = 0
+		}
+	}
+
+	bar := tcell.StyleDefault.Background(tcell.ColorDarkBlue).Foreground(tcell.ColorWhite)
+	tab := tcell.StyleDefault.Background(tcell.ColorDarkGray).Foreground(tcell.ColorWhite)
+	active := tcell.StyleDefault.Background(tcell.ColorWhite).Foreground(tcell.ColorBlack)
+	const y = 1
+	for x := 0; x < width; x++ {
+		e.screen.SetContent(x, y, ' ', nil, bar)
+	}
+	left, right := 0, width
+	if total > width {
+		left, right = 1, width-1
+	}
+	for i, num := range nums {
+		style := tab
+		if num == e.currentCanvas {
+			style = active
+		}
+		x := left + starts[i] - e.tabScroll
+		for _, r := range labels[i] {
+			rw := runewidth.RuneWidth(r)
+			if x >= left && x+rw <= right {
+				e.screen.SetContent(x, y, r, nil, style)
+			}
+			x += rw
+		}
+	}
+	if total > width {
+		if e.tabScroll > 0 {
+			e.screen.SetContent(0, y, '<', nil, bar)
+		}
+		if e.tabScroll+width-2 < total {
+			e.screen.SetContent(width-1, y, '>', nil, bar)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// utf8BOM is the byte order mark some editors put at the start of UTF-8 files.
+const utf8BOM = "\ufeff"
+
+// textFormat is how a file stores its text apart from the text itself: the
+// encoding, the line endings, a byte order mark and a newline after the last
+// line. The buffer always holds '\n'-separated UTF-8 lines without them. The
+// zero value writes the buffer as it is. For a file that mixes LF and CRLF,
+// mixed holds the ending of every line and crlf the more common one, used
+// for new line breaks.
+// textFormat описывает кодировку, окончания строк, BOM и перевод строки в
+// конце файла.
+type textFormat struct {
+	charset      charset
+	crlf         bool
+	bom          bool
+	finalNewline bool
+	mixed        *lineEndings
+}
+
+// lineEndings records which lines of a file with mixed line endings end with
+// CRLF, so that a save writes every line back the way it was read.
+// lineEndings хранит окончание каждой строки файла со смешанными окончаниями.
+type lineEndings struct {
+	crlf []bool
+}
+
+// scanLineEndings returns the endings of the line breaks in text.
+func scanLineEndings(text string) *lineEndings {
+	m := &lineEndings{}
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			return m
+		}
+		m.crlf = append(m.crlf, i > 0 && text[i-1] == '\r')
+		text = text[i+1:]
+	}
+}
+
+// edit follows a buffer change that replaced removed+1 lines from line on by
+// inserted+1 lines. New line breaks get the ending crlf; the last of the
+// inserted lines keeps the ending of the last removed one.
+func (m *lineEndings) edit(line, removed, inserted int, crlf bool) {
+	end := line + removed + 1
+	if m == nil || end > len(m.crlf) {
+		return
+	}
+	fresh := make([]bool, inserted+1)
+	for i := range inserted {
+		fresh[i] = crlf
+	}
+	fresh[inserted] = m.crlf[end-1]
+	m.crlf = slices.Replace(m.crlf, line, end, fresh...)
+}
+
+// join returns the lines of text separated by their recorded endings, with
+// an ending after the last line too if final is set.
+func (m *lineEndings) join(text string, final bool) string {
+	var sb strings.Builder
+	sb.Grow(len(text) + len(m.crlf))
+	for i := 0; ; i++ {
+		j := strings.IndexByte(text, '\n')
+		last := j < 0
+		if last {
+			j = len(text)
+		}
+		sb.WriteString(text[:j])
+		if last && !final {
+			break
+		}
+		if m.crlf[i] {
+			sb.WriteString("\r\n")
+		} else {
+			sb.WriteByte('\n')
+		}
+		if last {
+			break
+		}
+		text = text[j+1:]
+	}
+	return sb.String()
+}
+
+// decodeText splits the content of a file into the text for the buffer and
+// its format. A file with mixed line endings keeps the ending of every line.
+// decodeText разделяет содержимое файла на текст для буфера и его формат.
+func decodeText(data []byte) (string, textFormat) {
+	return decodeTextAs(data, detectCharset(data))
+}
+
+// decodeTextAs is decodeText for a file known to be in charset cs.
+func decodeTextAs(data []byte, cs charset) (string, textFormat) {
+	f := textFormat{charset: cs}
+	text := cs.decode(data)
+	if cs == charsetUTF8 && strings.HasPrefix(text, utf8BOM) {
+		f.bom = true
+		text = text[len(utf8BOM):]
+	}
+	crlf := strings.Count(text, "\r\n")
+	lf := strings.Count(text, "\n") - crlf
+	f.crlf = crlf > 0 && crlf >= lf
+	if crlf > 0 && lf > 0 {
+		f.mixed = scanLineEndings(text)
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if strings.HasSuffix(text, "\n") {
+		f.finalNewline = true
+		text = text[:len(text)-1]
+	} else if f.mixed != nil {
+		f.mixed.crlf = append(f.mixed.crlf, f.crlf)
+	}
+	return text, f
+}
+
+// encode returns the content of a file in format f holding text. It fails
+// if the text has characters the charset of f cannot hold.
+func (f textFormat) encode(text string) ([]byte, error) {
+	if f.mixed != nil && len(f.mixed.crlf) == strings.Count(text, "\n")+1 {
+		text = f.mixed.join(text, f.finalNewline)
+	} else {
+		if f.finalNewline {
+			text += "\n"
+		}
+		if f.crlf {
+			text = strings.ReplaceAll(text, "\n", "\r\n")
+		}
+	}
+	if f.charset != charsetUTF8 {
+		return f.charset.encode(text)
+	}
+	if f.bom {
+		text = utf8BOM + text
+	}
+	return []byte(text), nil
+}
+
+// String returns the status bar form of f, e.g. "UTF-8 CRLF BOM",
+// "KOI8-R LF noeol" or "UTF-8 mixed CRLF" for mixed line endings.
+func (f textFormat) String() string {
+	s := f.charset.String()
+	if f.mixed != nil {
+		s += " mixed"
+	}
+	if f.crlf {
+		s += " CRLF"
+	} else {
+		s += " LF"
+	}
+	if f.bom && f.charset == charsetUTF8 {
+		s += " BOM"
+	}
+	if !f.finalNewline {
+		s += " noeol"
+	}
+	return s
+}
+
+// showFormatPrompt asks how the current file should be written: converted
+// to UTF-8, the line endings, the byte order mark and the newline at the
+// end. Choosing LF or CRLF converts mixed line endings. The buffer is
+// unchanged; the new format is used from the next save.
+// showFormatPrompt меняет формат файла для следующего сохранения.
+func (e *Editor) showFormatPrompt() {
+	if c, ok := e.canvases[e.currentCanvas]; !ok || c.kind != CanvasFile {
+		e.statusMessage("Only file canvases have a file format")
+		return
+	}
+	label := "Format " + e.format.String() + ": (u)tf-8 (l)f (c)rlf (b)om on/off (n)ewline at end on/off"
+	e.promptShow(label, func(input string) {
+		f := e.format
+		for _, r := range strings.ToLower(input) {
+			switch r {
+			case 'u', 'г':
+				f.charset = charsetUTF8
+			case 'l', 'д':
+				f.crlf, f.mixed = false, nil
+			case 'c', 'с':
+				f.crlf, f.mixed = true, nil
+			case 'b', 'и':
+				f.bom = !f.bom
+			case 'n', 'т':
+				f.finalNewline = !f.finalNewline
+			}
+		}
+		if f == e.format {
+			return
+		}
+		e.format = f
+		e.dirty = true
+		e.syncEditorToCanvas()
+		e.statusMessage("Format " + f.String() + "; save to write it")
+	})
+}
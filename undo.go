@@ -1,77 +1,139 @@
 package main
 
-import "strings"
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
 
-// EditorState представляет состояние редактора для undo/redo.
+// DefaultUndoLimit is the default memory cap of one canvas undo history, in bytes.
+// DefaultUndoLimit — ограничение памяти истории отмены одного канваса по умолчанию, в байтах.
+const DefaultUndoLimit = 16 << 20
+
+// undoEntryOverhead approximates the bookkeeping cost of one undo entry or operation.
+const undoEntryOverhead = 64
+
+// typingMergeDelay is the longest pause between keystrokes that still share one undo step.
+// typingMergeDelay — максимальная пауза между нажатиями, которые ещё попадают в один шаг отмены.
+const typingMergeDelay = time.Second
+
+// typingKind tells which kind of keystroke produced the open undo step.
+type typingKind int
+
+const (
+	typingNone typingKind = iota
+	typingInsert
+	typingDelete
+)
+
+// typingRun tracks the run of keystrokes merged into the open undo step.
+// typingRun хранит серию нажатий, объединённых в открытый шаг отмены.
+type typingRun struct {
+	kind typingKind
+	line int
+	col  int
+	last rune
+	at   time.Time
+}
+
+// EditOp describes one buffer change: at (Line, Col) the text Removed was
+// replaced with Inserted.
+// EditOp описывает одно изменение буфера: в позиции (Line, Col) текст Removed
+// заменён на Inserted.
+type EditOp struct {
+	Line     int
+	Col      int
+	Removed  string
+	Inserted string
+}
+
+// EditorState is one undo/redo step: the edit operations, the cursor before
+// and after, and the time of the last change.
+// EditorState представляет шаг undo/redo: операции правки, положение курсора
+// до и после и время последнего изменения.
 type EditorState struct {
-	Lines []string
-	Cx    int
-	Cy    int
+	Ops     []EditOp
+	Cx      int
+	Cy      int
+	AfterCx int
+	AfterCy int
+	Size    int
+	Time    time.Time
 }
 
-// replaceAllOccurrences заменяет во всём документе все вхождения old на new.
-// Возвращает число сделанных замен.
-func (e *Editor) replaceAllOccurrences(old, new string) int {
+// replaceAllOccurrences replaces every match of old with new using the
+// current search options; in regex mode new may refer to groups ($1, ${name}).
+// replaceAllOccurrences заменяет во всём документе все совпадения old на new
+// с учётом текущих опций поиска. Возвращает число сделанных замен или ошибку
+// неверного регулярного выражения.
+func (e *Editor) replaceAllOccurrences(old, new string) (int, error) {
 	if old == "" {
-		return 0
+		return 0, nil
 	}
-	e.pushUndo()
-	count := 0
-	for i := range e.lines {
-		count += strings.Count(e.lines[i], old)
-		e.lines[i] = strings.ReplaceAll(e.lines[i], old, new)
+	s, err := NewSearcher(old, e.searchOpts)
+	if err != nil {
+		return 0, err
 	}
-	e.dirty = true
+	last := e.buf.LineCount() - 1
+	count := e.replaceInRange(s, new, 0, 0, last, e.buf.LineLen(last))
 	e.ensureVisible()
+	return count, nil
+}
+
+// replaceInRange replaces the matches of s lying between two positions as a
+// single undo step and returns their number.
+// replaceInRange заменяет совпадения между двумя позициями одним шагом отмены.
+func (e *Editor) replaceInRange(s *Searcher, repl string, startLine, startCol, endLine, endCol int) int {
+	wasDirty := e.dirty
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	count := 0
+	for y := startLine; y <= endLine && y < e.buf.LineCount(); y++ {
+		line := e.buf.Line(y)
+		lo, hi := 0, len(line)
+		if y == startLine {
+			lo = byteOffset(line, startCol)
+		}
+		if y == endLine {
+			hi = byteOffset(line, endCol)
+		}
+		if replaced, n := s.ReplaceLine(line, repl, lo, hi); n > 0 {
+			count += n
+			e.setLine(y, replaced)
+		}
+	}
+	e.dirty = wasDirty || count > 0
 	return count
 }
 
-// findAndJump finds the next occurrence of a string and jumps to it.
-// findAndJump находит следующее вхождение строки и переходит к нему.
+// findAndJump finds the next match of query after the cursor, wrapping
+// around the end of the document, and jumps to it.
+// findAndJump находит следующее совпадение после курсора и переходит к нему.
 func (e *Editor) findAndJump(query string) {
 	q := strings.TrimSpace(query)
 	if q == "" {
 		return
 	}
+	s, err := NewSearcher(q, e.searchOpts)
+	if err != nil {
+		e.showError("Invalid pattern: " + err.Error())
+		return
+	}
 	startY := e.cy
-	startX := e.cx
-	totalLines := len(e.lines)
-	for i := 0; i < totalLines; i++ {
-		line := e.lines[(startY+i)%totalLines]
-		var searchFrom int
-		if i == 0 {
-			searchFrom = startX + 1
-		} else {
-			searchFrom = 0
-		}
-		lineRunes := []rune(line)
-		if searchFrom > len(lineRunes) {
-			searchFrom = len(lineRunes)
-		}
-		queryRunes := []rune(q)
-		lineRunesFrom := lineRunes[searchFrom:]
-		found := false
-		pos := -1
-		for j := 0; j <= len(lineRunesFrom)-len(queryRunes); j++ {
-			match := true
-			for k := 0; k < len(queryRunes); k++ {
-				if lineRunesFrom[j+k] != queryRunes[k] {
-					match = false
-					break
-				}
-			}
-			if match {
-				found = true
-				pos = j
-				break
+	totalLines := e.buf.LineCount()
+	for i := 0; i <= totalLines; i++ {
+		y := (startY + i) % totalLines
+		line := e.buf.Line(y)
+		for _, m := range s.FindAll(line) {
+			col := utf8.RuneCountInString(line[:m[0]])
+			if i == 0 && col <= e.cx || i == totalLines && col > e.cx {
+				continue
 			}
-		}
-		if found {
-			idx := searchFrom + pos
-			e.cy = (startY + i) % totalLines
-			e.cx = idx
+			e.cy = y
+			e.cx = col
 			e.ensureVisible()
-			e.lastSearch = strings.TrimSpace(query)
+			e.lastSearch = q
 			return
 		}
 	}
@@ -79,73 +141,325 @@ func (e *Editor) findAndJump(query string) {
 }
 
 // insertRune inserts a rune at the current cursor position.
+// Consecutive characters typed within one word share a single undo step.
 // insertRune вставляет символ в текущую позицию курсора.
 func (e *Editor) insertRune(r rune) {
-	e.pushUndo()
-	lineRunes := []rune(e.lines[e.cy])
 	if e.cx < 0 {
 		e.cx = 0
 	}
-	lineRunes = append(lineRunes[:e.cx], append([]rune{r}, lineRunes[e.cx:]...)...)
-	e.lines[e.cy] = string(lineRunes)
-	e.cx++
-	e.redoStack = nil
+	e.beginTyping(typingInsert, r)
+	e.cy, e.cx = e.insertText(e.cy, e.cx, string(r))
+	e.endTyping()
 	e.dirty = true
 }
 
-// pushUndo pushes the current state onto the undo stack.
-// pushUndo помещает текущее состояние в стек отмены.
+// beginTyping prepares the undo step for a keystroke of the given kind.
+// The open step is reused when the keystroke continues the current run:
+// same kind, the cursor has not moved since the previous keystroke, the pause
+// is shorter than typingMergeDelay and no word boundary is crossed.
+// beginTyping готовит шаг отмены для нажатия: продолжает текущую серию,
+// если курсор не сдвигался, пауза короткая и граница слова не пересечена.
+func (e *Editor) beginTyping(kind typingKind, r rune) {
+	t := e.typing
+	merge := e.undoOpen && e.undoGroup == 0 && e.history != nil && e.history.current != e.history.root &&
+		t.kind == kind && t.line == e.cy && t.col == e.cx &&
+		time.Since(t.at) < typingMergeDelay &&
+		!(unicode.IsSpace(r) && !unicode.IsSpace(t.last))
+	if !merge {
+		e.pushUndo()
+	}
+	e.typing.kind = kind
+	e.typing.last = r
+}
+
+// endTyping remembers where the keystroke left the cursor.
+func (e *Editor) endTyping() {
+	e.typing.line, e.typing.col = e.cy, e.cx
+	e.typing.at = time.Now()
+	e.noteUndoCursor()
+}
+
+// noteUndoCursor records the cursor as the position redo of the open undo
+// step returns to.
+// noteUndoCursor запоминает курсор как позицию после открытого шага отмены.
+func (e *Editor) noteUndoCursor() {
+	if t := e.history; t != nil && e.undoOpen && t.current != t.root {
+		t.current.State.AfterCx, t.current.State.AfterCy = e.cx, e.cy
+	}
+}
+
+// beginUndoGroup opens an undo transaction: every change made until the
+// matching endUndoGroup is undone and redone as one step. Groups may nest.
+// beginUndoGroup открывает транзакцию отмены: все изменения до парного
+// endUndoGroup отменяются одним шагом. Группы могут быть вложенными.
+func (e *Editor) beginUndoGroup() {
+	if e.undoGroup == 0 {
+		e.undoGroupRedo = e.undoHistory().current.redo
+		e.undoGroupDirty = e.dirty
+		e.pushUndo()
+	}
+	e.undoGroup++
+}
+
+// endUndoGroup closes the transaction opened by beginUndoGroup. A group that
+// changed nothing leaves no step behind.
+// endUndoGroup закрывает транзакцию, открытую beginUndoGroup; пустая
+// транзакция не оставляет шага отмены.
+func (e *Editor) endUndoGroup() {
+	if e.undoGroup == 0 {
+		return
+	}
+	e.undoGroup--
+	if e.undoGroup > 0 {
+		return
+	}
+	t := e.undoHistory()
+	if cur := t.current; cur != t.root && len(cur.State.Ops) == 0 && len(cur.children) == 0 {
+		t.drop(e.undoGroupRedo)
+		e.dirty = e.undoGroupDirty
+	} else {
+		e.noteUndoCursor()
+	}
+	e.undoGroupRedo = nil
+	e.undoOpen = false
+}
+
+// pushUndo starts a new undo step at the current cursor position.
+// Buffer changes made through the editing helpers are added to this step
+// until the next pushUndo, undo or redo. Inside an undo group the group's
+// step stays open instead.
+// pushUndo начинает новый шаг отмены в текущей позиции курсора.
 func (e *Editor) pushUndo() {
-	state := EditorState{
-		Lines: make([]string, len(e.lines)),
-		Cx:    e.cx,
-		Cy:    e.cy,
-	}
-	copy(state.Lines, e.lines)
-	e.undoStack = append(e.undoStack, state)
-	e.redoStack = nil
+	e.typing = typingRun{}
+	t := e.undoHistory()
 	e.dirty = true
+	if e.undoOpen && t.current != t.root {
+		if e.undoGroup > 0 {
+			return
+		}
+		if cur := t.current; len(cur.State.Ops) == 0 && len(cur.children) == 0 {
+			cur.State.Cx, cur.State.Cy = e.cx, e.cy
+			return
+		}
+	}
+	t.add(EditorState{
+		Cx:   e.cx,
+		Cy:   e.cy,
+		Size: undoEntryOverhead,
+		Time: time.Now(),
+	})
+	e.undoOpen = true
+	e.trimUndo()
+}
+
+// recordEdit appends op to the open undo step, starting one if needed.
+// recordEdit добавляет операцию в открытый шаг отмены.
+func (e *Editor) recordEdit(op EditOp) {
+	if op.Removed == op.Inserted {
+		return
+	}
+	t := e.undoHistory()
+	if !e.undoOpen || t.current == t.root {
+		e.pushUndo()
+	}
+	top := &t.current.State
+	top.Ops = append(top.Ops, op)
+	// The caller moves the cursor afterwards; until endTyping or
+	// endUndoGroup records it, redo goes to the end of the change.
+	top.AfterCy, top.AfterCx = textEnd(op.Line, op.Col, op.Inserted)
+	size := len(op.Removed) + len(op.Inserted) + undoEntryOverhead
+	top.Size += size
+	t.bytes += size
+	t.touch()
+	e.trimUndo()
+}
+
+// trimUndo drops the oldest undo history while it exceeds the memory cap.
+// The open step is never dropped.
+// trimUndo удаляет самую старую историю, пока она превышает лимит памяти.
+func (e *Editor) trimUndo() {
+	limit := e.undoLimit
+	if limit <= 0 {
+		limit = DefaultUndoLimit
+	}
+	e.undoHistory().trim(limit)
+}
+
+// textEnd returns the position right after text inserted at (line, col).
+func textEnd(line, col int, text string) (int, int) {
+	n := strings.Count(text, "\n")
+	if n == 0 {
+		return line, col + utf8.RuneCountInString(text)
+	}
+	return line + n, utf8.RuneCountInString(text[strings.LastIndexByte(text, '\n')+1:])
+}
+
+// replaceRange replaces the text between two positions with text, records the
+// change for undo and returns the position after the inserted text.
+// replaceRange заменяет текст между двумя позициями и записывает изменение для отмены.
+func (e *Editor) replaceRange(startLine, startCol, endLine, endCol int, text string) (int, int) {
+	startLine, startCol = e.clampPos(startLine, startCol)
+	endLine, endCol = e.clampPos(endLine, endCol)
+	if startLine > endLine || (startLine == endLine && startCol > endCol) {
+		startLine, startCol, endLine, endCol = endLine, endCol, startLine, startCol
+	}
+	removed := ""
+	if startLine != endLine || startCol != endCol {
+		removed = e.buf.Delete(startLine, startCol, endLine, endCol)
+	}
+	endY, endX := startLine, startCol
+	if text != "" {
+		endY, endX = e.buf.Insert(startLine, startCol, text)
+	}
+	e.bufferEdited(startLine, removed, text)
+	e.recordEdit(EditOp{Line: startLine, Col: startCol, Removed: removed, Inserted: text})
+	return endY, endX
+}
+
+// bufferEdited notes a change of the buffer in which the lines from line on
+// spanned by removed were replaced by the lines spanned by inserted. It
+// keeps the search match counts and the endings of a file with mixed line
+// endings in step with the buffer.
+// bufferEdited отмечает изменение буфера и обновляет зависящие от строк данные.
+func (e *Editor) bufferEdited(line int, removed, inserted string) {
+	e.bufVersion++
+	r, n := strings.Count(removed, "\n"), strings.Count(inserted, "\n")
+	e.searchCache.edit(e.buf, e.bufVersion, line, r, n)
+	e.format.mixed.edit(line, r, n, e.format.crlf)
+}
+
+// clampPos limits (line, col) to a valid buffer position.
+func (e *Editor) clampPos(line, col int) (int, int) {
+	if line < 0 {
+		line = 0
+	}
+	if line >= e.buf.LineCount() {
+		line = e.buf.LineCount() - 1
+	}
+	if col < 0 {
+		col = 0
+	}
+	if n := e.buf.LineLen(line); col > n {
+		col = n
+	}
+	return line, col
+}
+
+// insertText inserts text at (line, col) and returns the position after it.
+// insertText вставляет текст в позицию (line, col).
+func (e *Editor) insertText(line, col int, text string) (int, int) {
+	return e.replaceRange(line, col, line, col, text)
+}
+
+// deleteRange removes the text between two positions and returns it.
+// deleteRange удаляет текст между двумя позициями и возвращает его.
+func (e *Editor) deleteRange(startLine, startCol, endLine, endCol int) string {
+	removed := e.buf.Slice(startLine, startCol, endLine, endCol)
+	e.replaceRange(startLine, startCol, endLine, endCol, "")
+	return removed
+}
+
+// setLine replaces the text of line i.
+// setLine заменяет текст строки i.
+func (e *Editor) setLine(i int, s string) {
+	e.replaceRange(i, 0, i, e.buf.LineLen(i), s)
 }
 
-// undo reverts the last change.
+// insertLines inserts whole lines before line at.
+// insertLines вставляет целые строки перед строкой at.
+func (e *Editor) insertLines(at int, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	text := strings.Join(lines, "\n")
+	if at >= e.buf.LineCount() {
+		last := e.buf.LineCount() - 1
+		e.insertText(last, e.buf.LineLen(last), "\n"+text)
+		return
+	}
+	e.insertText(at, 0, text+"\n")
+}
+
+// deleteLines removes lines [from, to); removing every line leaves one empty line.
+// deleteLines удаляет строки [from, to).
+func (e *Editor) deleteLines(from, to int) {
+	count := e.buf.LineCount()
+	if from < 0 {
+		from = 0
+	}
+	if to > count {
+		to = count
+	}
+	if from >= to {
+		return
+	}
+	switch {
+	case to < count:
+		e.deleteRange(from, 0, to, 0)
+	case from > 0:
+		e.deleteRange(from-1, e.buf.LineLen(from-1), to-1, e.buf.LineLen(to-1))
+	default:
+		e.deleteRange(0, 0, to-1, e.buf.LineLen(to-1))
+	}
+}
+
+// revertOps undoes ops in reverse order.
+func (e *Editor) revertOps(ops []EditOp) {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		endY, endX := textEnd(op.Line, op.Col, op.Inserted)
+		e.buf.Delete(op.Line, op.Col, endY, endX)
+		e.buf.Insert(op.Line, op.Col, op.Removed)
+		e.bufferEdited(op.Line, op.Inserted, op.Removed)
+	}
+}
+
+// applyOps reapplies ops in order.
+func (e *Editor) applyOps(ops []EditOp) {
+	for _, op := range ops {
+		endY, endX := textEnd(op.Line, op.Col, op.Removed)
+		e.buf.Delete(op.Line, op.Col, endY, endX)
+		e.buf.Insert(op.Line, op.Col, op.Inserted)
+		e.bufferEdited(op.Line, op.Removed, op.Inserted)
+	}
+}
+
+// undo reverts the last change. The undone state stays in the tree and
+// redo returns to it until a new edit starts another branch.
 // undo отменяет последнее изменение.
 func (e *Editor) undo() {
-	if len(e.undoStack) == 0 {
+	t := e.undoHistory()
+	n := t.current
+	if n == t.root {
 		return
 	}
-	currentState := EditorState{
-		Lines: make([]string, len(e.lines)),
-		Cx:    e.cx,
-		Cy:    e.cy,
-	}
-	copy(currentState.Lines, e.lines)
-	e.redoStack = append(e.redoStack, currentState)
-	lastState := e.undoStack[len(e.undoStack)-1]
-	e.undoStack = e.undoStack[:len(e.undoStack)-1]
+	e.undoOpen = false
+
+	e.revertOps(n.State.Ops)
+	t.current = n.parent
+	t.current.redo = n
 
-	e.lines = lastState.Lines
-	e.cx = lastState.Cx
-	e.cy = lastState.Cy
+	e.cx = n.State.Cx
+	e.cy = n.State.Cy
+	e.dirty = true
 	e.ensureVisible()
 }
 
-// redo reapplies the last undone change.
+// redo reapplies the most recently undone change of the current state.
 // redo повторно применяет последнее отмененное изменение.
 func (e *Editor) redo() {
-	if len(e.redoStack) == 0 {
+	t := e.undoHistory()
+	n := t.current.redo
+	if n == nil {
 		return
 	}
-	currentState := EditorState{
-		Lines: make([]string, len(e.lines)),
-		Cx:    e.cx,
-		Cy:    e.cy,
-	}
-	copy(currentState.Lines, e.lines)
-	e.undoStack = append(e.undoStack, currentState)
-	nextState := e.redoStack[len(e.redoStack)-1]
-	e.redoStack = e.redoStack[:len(e.redoStack)-1]
-	e.lines = nextState.Lines
-	e.cx = nextState.Cx
-	e.cy = nextState.Cy
+	e.undoOpen = false
+
+	e.applyOps(n.State.Ops)
+	t.current = n
+
+	e.cx = n.State.AfterCx
+	e.cy = n.State.AfterCy
+	e.dirty = true
 	e.ensureVisible()
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// undoFileVersion is bumped whenever the on-disk undo format changes.
+const undoFileVersion = 2
+
+// undoFileNode is one undo tree state on disk. Parent indexes an earlier
+// node of the list; the root has -1.
+type undoFileNode struct {
+	State  EditorState `json:"state"`
+	Parent int         `json:"parent"`
+	Seq    int         `json:"seq"`
+	Redo   bool        `json:"redo,omitempty"`
+}
+
+// undoFile is the on-disk form of a canvas undo history.
+// undoFile — представление истории отмены канваса на диске.
+type undoFile struct {
+	Version int            `json:"version"`
+	Path    string         `json:"path"`
+	Hash    string         `json:"hash"`
+	Nodes   []undoFileNode `json:"nodes"`
+	Current int            `json:"current"`
+	Seq     int            `json:"seq"`
+}
+
+// contentHash returns the hex SHA-256 of text.
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// undoCachePath returns the cache file that stores the undo history of path.
+// undoCachePath возвращает файл кэша с историей отмены для path.
+func undoCachePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "editor", "undo", hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// saveUndoHistory stores the undo tree of a file whose current content is
+// text. Errors are ignored: losing the history must never block a save.
+// saveUndoHistory сохраняет дерево отмены файла с содержимым text.
+func saveUndoHistory(path, text string, t *UndoTree) {
+	cachePath, err := undoCachePath(path)
+	if err != nil {
+		return
+	}
+	if t == nil || len(t.root.children) == 0 {
+		os.Remove(cachePath)
+		return
+	}
+	abs, _ := filepath.Abs(path)
+	f := undoFile{
+		Version: undoFileVersion,
+		Path:    abs,
+		Hash:    contentHash(text),
+		Seq:     t.seq,
+	}
+	index := make(map[*undoNode]int)
+	for i, n := range t.nodes() {
+		index[n] = i
+		fn := undoFileNode{State: n.State, Parent: -1, Seq: n.seq}
+		if n != t.root {
+			fn.Parent = index[n.parent]
+			fn.Redo = n.parent.redo == n
+		}
+		if n == t.current {
+			f.Current = i
+		}
+		f.Nodes = append(f.Nodes, fn)
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return
+	}
+	tmp := cachePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, cachePath); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// loadUndoHistory returns the saved undo tree of path if it was recorded for
+// exactly the content text, or nil. A stale or unreadable history is deleted.
+// loadUndoHistory возвращает сохранённое дерево отмены, если оно записано для
+// того же содержимого text. Устаревшая история удаляется.
+func loadUndoHistory(path, text string) *UndoTree {
+	cachePath, err := undoCachePath(path)
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil
+	}
+	var f undoFile
+	abs, _ := filepath.Abs(path)
+	if json.Unmarshal(data, &f) != nil || f.Version != undoFileVersion ||
+		f.Path != abs || f.Hash != contentHash(text) {
+		os.Remove(cachePath)
+		return nil
+	}
+	t := buildUndoTree(f)
+	if t == nil {
+		os.Remove(cachePath)
+	}
+	return t
+}
+
+// buildUndoTree rebuilds an undo tree from its on-disk form, or returns nil
+// if the node list is malformed.
+func buildUndoTree(f undoFile) *UndoTree {
+	if len(f.Nodes) == 0 || f.Nodes[0].Parent != -1 || f.Current < 0 || f.Current >= len(f.Nodes) {
+		return nil
+	}
+	nodes := make([]*undoNode, len(f.Nodes))
+	t := &UndoTree{seq: f.Seq}
+	for i, fn := range f.Nodes {
+		n := &undoNode{State: fn.State, seq: fn.Seq}
+		nodes[i] = n
+		t.bytes += fn.State.Size
+		if i == 0 {
+			t.root = n
+			continue
+		}
+		if fn.Parent < 0 || fn.Parent >= i {
+			return nil
+		}
+		n.parent = nodes[fn.Parent]
+		n.parent.children = append(n.parent.children, n)
+		if fn.Redo {
+			n.parent.redo = n
+		}
+	}
+	t.current = nodes[f.Current]
+	return t
+}
+
+// restoreUndoHistory loads the persisted undo history of the canvas file.
+// restoreUndoHistory загружает сохранённую историю отмены файла канваса.
+func (c *Canvas) restoreUndoHistory() {
+	if c.filename == "" {
+		return
+	}
+	if t := loadUndoHistory(c.filename, c.buf.String()); t != nil {
+		c.history = t
+	}
+}
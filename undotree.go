@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// undoNode is one state of the undo tree. State holds the edit that leads
+// from the parent state to this one; the root holds none.
+// undoNode — состояние дерева отмены; State содержит правку, ведущую от
+// родительского состояния к этому.
+type undoNode struct {
+	State    EditorState
+	parent   *undoNode
+	children []*undoNode
+	redo     *undoNode
+	seq      int
+}
+
+// UndoTree keeps every undo branch: an edit made after undo starts a new
+// branch instead of discarding the undone states.
+// UndoTree хранит все ветви отмены: правка после undo начинает новую ветвь,
+// а отменённые состояния не теряются.
+type UndoTree struct {
+	root    *undoNode
+	current *undoNode
+	bytes   int
+	seq     int
+}
+
+// NewUndoTree creates an empty undo tree.
+// NewUndoTree создает пустое дерево отмены.
+func NewUndoTree() *UndoTree {
+	root := &undoNode{}
+	return &UndoTree{root: root, current: root}
+}
+
+// add appends st as a new child of the current state and makes it current.
+func (t *UndoTree) add(st EditorState) *undoNode {
+	t.seq++
+	n := &undoNode{State: st, parent: t.current, seq: t.seq}
+	t.current.children = append(t.current.children, n)
+	t.current.redo = n
+	t.current = n
+	t.bytes += st.Size
+	return n
+}
+
+// drop removes the current state, which has no children, and makes its
+// parent current again. Redo from the parent leads to redo if it is still
+// one of its children.
+func (t *UndoTree) drop(redo *undoNode) {
+	n, p := t.current, t.current.parent
+	p.children = slices.DeleteFunc(p.children, func(c *undoNode) bool { return c == n })
+	p.redo = nil
+	if slices.Contains(p.children, redo) {
+		p.redo = redo
+	}
+	t.bytes -= n.State.Size
+	t.current = p
+}
+
+// touch records the time of the latest change in the current state.
+func (t *UndoTree) touch() {
+	t.current.State.Time = time.Now()
+}
+
+// depth returns the distance from the root to n.
+func (t *UndoTree) depth(n *undoNode) int {
+	d := 0
+	for ; n != t.root && n != nil; n = n.parent {
+		d++
+	}
+	return d
+}
+
+// nodes returns all states in pre-order, so parents precede their children.
+func (t *UndoTree) nodes() []*undoNode {
+	var out []*undoNode
+	stack := []*undoNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		out = append(out, n)
+		for i := len(n.children) - 1; i >= 0; i-- {
+			stack = append(stack, n.children[i])
+		}
+	}
+	return out
+}
+
+// subtreeSize returns the memory accounted to n and its descendants.
+func subtreeSize(n *undoNode) int {
+	size := n.State.Size
+	for _, c := range n.children {
+		size += subtreeSize(c)
+	}
+	return size
+}
+
+// trim drops the oldest history while the tree exceeds limit bytes: the root
+// moves one step towards the current state and branches that fork off
+// before it are discarded. The current step is never dropped.
+// trim удаляет самую старую историю, пока дерево превышает limit байт.
+func (t *UndoTree) trim(limit int) {
+	for t.bytes > limit {
+		next := t.current
+		for next != nil && next.parent != t.root {
+			next = next.parent
+		}
+		if next == nil || next == t.current {
+			return
+		}
+		for _, c := range t.root.children {
+			if c != next {
+				t.bytes -= subtreeSize(c)
+			}
+		}
+		t.bytes -= next.State.Size
+		next.State = EditorState{Time: next.State.Time}
+		next.parent = nil
+		t.root = next
+	}
+}
+
+// undoHistory returns the undo tree of the current canvas, creating it on first use.
+// undoHistory возвращает дерево отмены текущего канваса.
+func (e *Editor) undoHistory() *UndoTree {
+	if e.history == nil {
+		e.history = NewUndoTree()
+		if canvas, ok := e.canvases[e.currentCanvas]; ok {
+			canvas.history = e.history
+		}
+	}
+	return e.history
+}
+
+// undoTo moves the document to the state n by undoing up to the common
+// ancestor and redoing down the branch that leads to n.
+// undoTo переводит документ в состояние n: отмена до общего предка и повтор
+// по ветви, ведущей к n.
+func (e *Editor) undoTo(n *undoNode) {
+	t := e.undoHistory()
+	a, b := t.current, n
+	da, db := t.depth(a), t.depth(b)
+	var down []*undoNode
+	for ; db > da; db-- {
+		down = append(down, b)
+		b = b.parent
+	}
+	for ; da > db; da-- {
+		e.undo()
+		a = t.current
+	}
+	for a != b && a != nil && b != nil {
+		e.undo()
+		a = t.current
+		down = append(down, b)
+		b = b.parent
+	}
+	for i := len(down) - 1; i >= 0; i-- {
+		t.current.redo = down[i]
+		e.redo()
+	}
+}
+
+// describeUndoNode returns a one-line summary of the edit stored in n.
+func describeUndoNode(n *undoNode) string {
+	if len(n.State.Ops) == 0 {
+		return "(no changes)"
+	}
+	op := n.State.Ops[0]
+	var parts []string
+	if op.Inserted != "" {
+		parts = append(parts, "+"+quoteShort(op.Inserted))
+	}
+	if op.Removed != "" {
+		parts = append(parts, "-"+quoteShort(op.Removed))
+	}
+	s := fmt.Sprintf("line %d: %s", op.Line+1, strings.Join(parts, " "))
+	if len(n.State.Ops) > 1 {
+		s += fmt.Sprintf(" (+%d more)", len(n.State.Ops)-1)
+	}
+	return s
+}
+
+// quoteShort quotes s for a one-line listing, shortening long text.
+func quoteShort(s string) string {
+	const max = 24
+	r := []rune(strings.ReplaceAll(s, "\n", "⏎"))
+	if len(r) > max {
+		return "\"" + string(r[:max]) + "…\""
+	}
+	return "\"" + string(r) + "\""
+}
+
+// showUndoHistory opens a list of all undo states, oldest first; choosing one
+// jumps to it. ">" marks the current state, "|" the states it derives from.
+// showUndoHistory показывает список всех состояний отмены; выбор состояния
+// переводит документ в него.
+func (e *Editor) showUndoHistory() {
+	t := e.undoHistory()
+	all := t.nodes()
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+
+	onPath := make(map[*undoNode]bool)
+	for n := t.current; n != nil; n = n.parent {
+		onPath[n] = true
+	}
+	items := make([]string, len(all))
+	selected := 0
+	for i, n := range all {
+		mark := " "
+		if n == t.current {
+			mark = ">"
+			selected = i
+		} else if onPath[n] {
+			mark = "|"
+		}
+		stamp := "--:--:--"
+		if !n.State.Time.IsZero() {
+			stamp = n.State.Time.Format("15:04:05")
+		}
+		desc := describeUndoNode(n)
+		if n == t.root {
+			desc = "(oldest saved state)"
+		}
+		items[i] = fmt.Sprintf("%s %4d  %s  %s", mark, n.seq, stamp, desc)
+	}
+	e.showListPopup("Undo history (Enter: jump, Esc: close)", items, selected, func(i int) {
+		e.undoTo(all[i])
+		e.statusMessage(fmt.Sprintf("Jumped to undo state %d", all[i].seq))
+	})
+}